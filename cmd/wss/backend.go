@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	repo "com.adoublef.wss/internal/communications/sql"
+	pgRepo "com.adoublef.wss/internal/communications/sql/postgres"
+	sqliteRepo "com.adoublef.wss/internal/communications/sql/sqlite"
+	"com.adoublef.wss/internal/migrate"
+	pgMigrations "com.adoublef.wss/postgres/migrations"
+	sqliteMigrations "com.adoublef.wss/sqlite/migrations"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	driverPostgres = "postgres"
+	driverSqlite   = "sqlite"
+)
+
+// backend holds the repositories of the selected storage driver.
+type backend struct {
+	threads     repo.ThreadRepo
+	messages    repo.MessageRepo
+	attachments repo.AttachmentRepo
+
+	migrator *migrate.Migrator
+
+	close func()
+}
+
+// detectDriver tells the driver from the scheme of a connection string.
+// Postgres URLs use postgres, sqlite:// and file: URLs or plain paths use
+// sqlite. Other schemes are rejected rather than taken for a file name,
+// as they are most likely a typo.
+func detectDriver(dsn string) (string, error) {
+	switch {
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		return driverPostgres, nil
+	case strings.HasPrefix(dsn, "sqlite://"), strings.HasPrefix(dsn, "file:"):
+		return driverSqlite, nil
+	}
+
+	if scheme, _, ok := strings.Cut(dsn, "://"); ok {
+		return "", fmt.Errorf("unknown scheme %q in connection string, set -driver to use it anyway", scheme)
+	}
+	return driverSqlite, nil
+}
+
+// resolveDriver returns driver if set, as given by -driver, or the one
+// detected from dsn otherwise.
+func resolveDriver(driver, dsn string) (string, error) {
+	switch driver {
+	case "":
+		return detectDriver(dsn)
+	case driverPostgres, driverSqlite:
+		return driver, nil
+	}
+
+	return "", fmt.Errorf("unknown driver %q", driver)
+}
+
+func openBackend(ctx context.Context, driver, dsn string) (*backend, error) {
+	driver, err := resolveDriver(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	switch driver {
+	case driverPostgres:
+		conn, err := pgxpool.New(ctx, dsn)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := conn.Ping(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		m, err := migrate.New(migrate.NewPostgresDriver(conn), pgMigrations.FS)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		b := &backend{
+			threads:     pgRepo.NewChatRepo(conn),
+			messages:    pgRepo.NewMessageRepo(conn),
+			attachments: pgRepo.NewAttachmentRepo(conn),
+			migrator:    m,
+			close:       conn.Close,
+		}
+		return b, nil
+	case driverSqlite:
+		db, err := sql.Open("sqlite3", strings.TrimPrefix(dsn, "sqlite://"))
+		if err != nil {
+			return nil, err
+		}
+
+		if err := db.PingContext(ctx); err != nil {
+			db.Close()
+			return nil, err
+		}
+
+		if err := sqliteRepo.CheckFTS5(ctx, db); err != nil {
+			db.Close()
+			return nil, err
+		}
+
+		m, err := migrate.New(migrate.NewSqliteDriver(db), sqliteMigrations.FS)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+
+		b := &backend{
+			threads:     sqliteRepo.NewChatRepo(db),
+			messages:    sqliteRepo.NewMessageRepo(db),
+			attachments: sqliteRepo.NewAttachmentRepo(db),
+			migrator:    m,
+			close:       func() { db.Close() },
+		}
+		return b, nil
+	}
+
+	return nil, fmt.Errorf("unknown driver %q", driver)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+func TestDetectDriver(t *testing.T) {
+	tt := []struct {
+		name   string
+		dsn    string
+		driver string
+		err    bool
+	}{
+		{"postgres url", "postgres://user@localhost/wss", driverPostgres, false},
+		{"postgresql url", "postgresql://localhost:5432/wss?sslmode=disable", driverPostgres, false},
+		{"sqlite url", "sqlite://wss.db", driverSqlite, false},
+		{"file uri", "file:wss.db?_journal_mode=WAL", driverSqlite, false},
+		{"relative path", "wss.db", driverSqlite, false},
+		{"absolute path", "/var/lib/wss/wss.db", driverSqlite, false},
+		{"misspelt scheme", "postgress://localhost/wss", "", true},
+		{"other scheme", "mysql://localhost/wss", "", true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+
+			driver, err := detectDriver(tc.dsn)
+			is.Equal(err != nil, tc.err) // rejected
+			is.Equal(driver, tc.driver)
+		})
+	}
+}
+
+func TestResolveDriver(t *testing.T) {
+	tt := []struct {
+		name   string
+		driver string
+		dsn    string
+		want   string
+		err    bool
+	}{
+		{"detected", "", "postgres://localhost/wss", driverPostgres, false},
+		{"detected scheme rejected", "", "postgress://localhost/wss", "", true},
+		{"override", driverSqlite, "postgres://localhost/wss", driverSqlite, false},
+		{"override of an unknown scheme", driverSqlite, "postgress://localhost/wss", driverSqlite, false},
+		{"unknown driver", "mysql", "wss.db", "", true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+
+			driver, err := resolveDriver(tc.driver, tc.dsn)
+			is.Equal(err != nil, tc.err) // rejected
+			is.Equal(driver, tc.want)
+		})
+	}
+}
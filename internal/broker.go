@@ -8,4 +8,8 @@ type Broker[K, V any] interface {
 	LoadOrStore(key K, value V) (actual V, loaded bool)
 	Store(key K, value V)
 	Delete(key K)
+	// Range calls f for every entry until f returns false.
+	Range(f func(key K, value V) bool)
+	// Len returns the number of entries.
+	Len() int
 }
@@ -0,0 +1,32 @@
+package chat
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Attachment is a file, such as an image, sent to a thread. Its content
+// is kept in a blob store under Hash.
+type Attachment struct {
+	ID        uuid.UUID `json:"id"`
+	ThreadID  uuid.UUID `json:"-"`
+	Name      string    `json:"name"`
+	MimeType  string    `json:"mimeType"`
+	Size      int64     `json:"size"`
+	Hash      string    `json:"-"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func NewAttachment(threadID uuid.UUID, name, mimeType string, size int64) *Attachment {
+	a := Attachment{
+		ID:        uuid.New(),
+		ThreadID:  threadID,
+		Name:      name,
+		MimeType:  mimeType,
+		Size:      size,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	return &a
+}
@@ -2,6 +2,7 @@ package chat
 
 import (
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 
@@ -10,16 +11,28 @@ import (
 )
 
 type Thread struct {
-	ID       uuid.UUID  `json:"id"`
-	Messages []*Message `json:"messages"`
-
+	ID        uuid.UUID  `json:"id"`
+	Messages  []*Message `json:"messages"`
+	CreatedAt time.Time  `json:"createdAt"`
+	// Retention is how long messages are kept for.
+	Retention Retention `json:"retention"`
+	// DeletedAt is only set on deleted threads, which are only read back
+	// by FindDeletedMeta.
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+
+	mu  sync.Mutex
 	cli *websocket.Client
 }
 
 // NOTE this should not be empty but panic if it is
-func (thr *Thread) Client() *websocket.Client {
+//
+// opts are only used when the client is first created.
+func (thr *Thread) Client(opts ...websocket.Option) *websocket.Client {
+	thr.mu.Lock()
+	defer thr.mu.Unlock()
+
 	if thr.cli == nil {
-		thr.cli = websocket.NewClient()
+		thr.cli = websocket.NewClient(opts...)
 	}
 
 	return thr.cli
@@ -27,56 +40,60 @@ func (thr *Thread) Client() *websocket.Client {
 
 // NOTE -- should init on creation as this is just spinning up excessive goroutines
 func (thr *Thread) SetClient(cli *websocket.Client) {
+	thr.mu.Lock()
+	defer thr.mu.Unlock()
+
 	if thr.cli == nil {
 		thr.cli = cli
 	}
 }
 
-func NewThread() *Thread {
-	thread := Thread{ID: uuid.New()}
-
-	return &thread
-}
+// client returns the client of the thread without creating it.
+func (thr *Thread) client() *websocket.Client {
+	thr.mu.Lock()
+	defer thr.mu.Unlock()
 
-func (c *Thread) String() string {
-	return "chat no: " + c.ID.String()
+	return thr.cli
 }
 
-type Message struct {
-	ID      int     `json:"id,omitempty"`
-	Content string  `json:"content"`
-	Thread  *Thread `json:"-"`
+// Close stops the client of the thread, if it has one, disconnecting
+// its peers.
+func (thr *Thread) Close() {
+	if cli := thr.client(); cli != nil {
+		cli.Close()
+	}
 }
 
-type Broker internal.Broker[string, *Thread]
+func NewThread() *Thread {
+	thread := Thread{ID: uuid.New(), CreatedAt: time.Now().UTC()}
 
-type threadBroker struct {
-	m sync.Map
+	return &thread
 }
 
-func NewBroker() Broker {
-	b := &threadBroker{}
-	return b
+func (c *Thread) String() string {
+	return "chat no: " + c.ID.String()
 }
 
-func (b *threadBroker) Delete(id string) {
-	b.m.Delete(id)
+type Message struct {
+	ID      int    `json:"id,omitempty"`
+	Sender  string `json:"sender"`
+	Content string `json:"content"`
+	// EditedAt is set once the content has been changed.
+	EditedAt  *time.Time `json:"editedAt,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	Thread    *Thread    `json:"-"`
 }
 
-func (b *threadBroker) Load(id string) (value *Thread, ok bool) {
-	v, ok := b.m.Load(id)
-	return v.(*Thread), ok
-}
+func NewMessage(thread *Thread, content string) *Message {
+	msg := Message{Content: content, CreatedAt: time.Now().UTC(), Thread: thread}
 
-func (b *threadBroker) Store(id string, thread *Thread) {
-	b.m.Store(id, thread)
+	return &msg
 }
 
-func (b *threadBroker) LoadOrStore(id string, chat *Thread) (*Thread, bool) {
-	actual, loaded := b.m.LoadOrStore(id, chat)
-	if !loaded {
-		actual = chat
-	}
-
-	return actual.(*Thread), loaded
+type Broker interface {
+	internal.Broker[string, *Thread]
+	// Acquire returns the thread stored under id, calling load to create it
+	// if there is none. Concurrent calls for the same id share a single
+	// call to load. The thread is not evicted until release is called.
+	Acquire(id string, load func() (*Thread, error)) (thread *Thread, release func(), err error)
 }
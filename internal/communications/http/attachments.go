@@ -0,0 +1,356 @@
+package service
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/google/uuid"
+
+	thread "com.adoublef.wss/internal/communications"
+	websocket "com.adoublef.wss/internal/http/websocket/gobwas"
+	"com.adoublef.wss/internal/storage"
+)
+
+// Attachments are uploaded over a thread's socket as binary frames. Every
+// frame starts with its kind and the upload id chosen by the client, so
+// that several uploads can be in flight on one connection:
+//
+//	begin: 0x01 | upload id (4) | size (8) | mime type length (1) | mime type | name
+//	chunk: 0x02 | upload id (4) | data
+//	abort: 0x03 | upload id (4)
+//
+// Integers are big-endian. Chunks are streamed to the blob store as they
+// arrive. An upload is complete once size bytes of chunks have been
+// received, every peer is then sent an attachmentEvent with the URL to
+// download it from. The declared mime type is replaced by the one sniffed
+// from the content.
+//
+// Attachments may also be uploaded over HTTP with a POST to
+// /chats/{id}/attachments?name=, the body being the content.
+const (
+	frameBegin byte = iota + 1
+	frameChunk
+	frameAbort
+)
+
+const (
+	// Largest attachment accepted.
+	maxAttachmentSize = 10 << 20
+	// Most uploads a single connection may have in flight.
+	maxPendingUploads = 4
+)
+
+var (
+	errMalformedFrame  = errors.New("malformed attachment frame")
+	errUnknownUpload   = errors.New("unknown upload")
+	errTooManyUploads  = errors.New("too many pending uploads")
+	errAttachmentSize  = errors.New("attachment exceeds size limit")
+	errUploadOverflow  = errors.New("upload exceeds declared size")
+	errDuplicateUpload = errors.New("upload id already in use")
+	errUploadAborted   = errors.New("upload aborted")
+)
+
+type uploadKey struct {
+	conn websocket.ConnID
+	id   uint32
+}
+
+type upload struct {
+	a *thread.Attachment
+	// n is the number of bytes received so far.
+	n  int64
+	pw *io.PipeWriter
+	// blob receives the result of storing the content.
+	blob chan blobResult
+}
+
+type blobResult struct {
+	b   *storage.Blob
+	err error
+}
+
+// uploads assembles the attachments of a single thread. The state of an
+// upload is only ever used by the read loop of the connection that
+// started it, the lock guards the maps.
+type uploads struct {
+	bs storage.BlobStore
+
+	mu sync.Mutex
+	m  map[uploadKey]*upload
+	// pending is the number of uploads in flight per connection.
+	pending map[websocket.ConnID]int
+}
+
+func newUploads(bs storage.BlobStore) *uploads {
+	u := &uploads{
+		bs:      bs,
+		m:       make(map[uploadKey]*upload),
+		pending: make(map[websocket.ConnID]int),
+	}
+
+	return u
+}
+
+// handle processes an attachment frame. It returns the upload once all
+// of its content has been stored.
+func (u *uploads) handle(threadID uuid.UUID, from websocket.Peer, p []byte) (*thread.Attachment, error) {
+	if len(p) < 5 {
+		return nil, errMalformedFrame
+	}
+
+	kind, key := p[0], uploadKey{conn: from.ID, id: binary.BigEndian.Uint32(p[1:5])}
+	p = p[5:]
+
+	switch kind {
+	case frameBegin:
+		if len(p) < 9 || len(p) < 9+int(p[8]) {
+			return nil, errMalformedFrame
+		}
+
+		size, n := int64(binary.BigEndian.Uint64(p)), int(p[8])
+		if size <= 0 || size > maxAttachmentSize {
+			return nil, errAttachmentSize
+		}
+
+		a := thread.NewAttachment(threadID, string(p[9+n:]), string(p[9:9+n]), size)
+		return nil, u.begin(key, a)
+	case frameChunk:
+		return u.write(key, p)
+	case frameAbort:
+		u.abort(key, errUploadAborted)
+		return nil, nil
+	}
+
+	return nil, errMalformedFrame
+}
+
+func (u *uploads) begin(key uploadKey, a *thread.Attachment) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if _, ok := u.m[key]; ok {
+		return errDuplicateUpload
+	}
+	if u.pending[key.conn] >= maxPendingUploads {
+		return errTooManyUploads
+	}
+
+	pr, pw := io.Pipe()
+	up := &upload{a: a, pw: pw, blob: make(chan blobResult, 1)}
+
+	go func() {
+		// NOTE -- the socket has no request context to store with
+		b, err := u.bs.Put(context.Background(), a.ThreadID.String(), pr)
+		pr.CloseWithError(err)
+		up.blob <- blobResult{b, err}
+	}()
+
+	u.m[key] = up
+	u.pending[key.conn]++
+	return nil
+}
+
+func (u *uploads) write(key uploadKey, p []byte) (*thread.Attachment, error) {
+	u.mu.Lock()
+	up, ok := u.m[key]
+	u.mu.Unlock()
+
+	if !ok {
+		return nil, errUnknownUpload
+	}
+	if up.n+int64(len(p)) > up.a.Size {
+		u.abort(key, errUploadOverflow)
+		return nil, errUploadOverflow
+	}
+
+	if _, err := up.pw.Write(p); err != nil {
+		u.abort(key, err)
+		return nil, err
+	}
+
+	if up.n += int64(len(p)); up.n < up.a.Size {
+		return nil, nil
+	}
+
+	u.remove(key)
+	up.pw.Close()
+
+	res := <-up.blob
+	if res.err != nil {
+		return nil, res.err
+	}
+
+	up.a.Hash = res.b.Hash
+	up.a.MimeType = res.b.MimeType
+	return up.a, nil
+}
+
+// abort stops an upload, the partial content is discarded by the store.
+func (u *uploads) abort(key uploadKey, err error) {
+	if up := u.remove(key); up != nil {
+		up.pw.CloseWithError(err)
+	}
+}
+
+func (u *uploads) remove(key uploadKey) *upload {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	up, ok := u.m[key]
+	if !ok {
+		return nil
+	}
+
+	delete(u.m, key)
+	if u.pending[key.conn]--; u.pending[key.conn] <= 0 {
+		delete(u.pending, key.conn)
+	}
+	return up
+}
+
+// discard drops the unfinished uploads of a connection.
+func (u *uploads) discard(conn websocket.ConnID) {
+	u.mu.Lock()
+	var keys []uploadKey
+	for key := range u.m {
+		if key.conn == conn {
+			keys = append(keys, key)
+		}
+	}
+	u.mu.Unlock()
+
+	for _, key := range keys {
+		u.abort(key, errUploadAborted)
+	}
+}
+
+// attachmentEvent is sent to peers as a text message once an attachment
+// has been stored, or to the sender when an upload fails.
+type attachmentEvent struct {
+	Type       string             `json:"type"`
+	Attachment *thread.Attachment `json:"attachment,omitempty"`
+	URL        string             `json:"url,omitempty"`
+	Error      string             `json:"error,omitempty"`
+}
+
+func (e *attachmentEvent) message() *wsutil.Message {
+	p, _ := json.Marshal(e)
+	return &wsutil.Message{OpCode: ws.OpText, Payload: p}
+}
+
+// contentDisposition has an attachment downloaded as name. Names that
+// can't be encoded are left out.
+func contentDisposition(name string) string {
+	if v := mime.FormatMediaType("attachment", map[string]string{"filename": name}); v != "" {
+		return v
+	}
+
+	return "attachment"
+}
+
+func attachmentURL(a *thread.Attachment) string {
+	return "/chats/" + a.ThreadID.String() + "/attachments/" + a.ID.String()
+}
+
+func (s *service) handleAttachmentFrame(cli *websocket.Client, u *uploads, threadID uuid.UUID, from websocket.Peer, p []byte) {
+	a, err := u.handle(threadID, from, p)
+	if err == nil && a != nil {
+		err = s.ar.Create(context.Background(), a)
+	}
+
+	if err != nil {
+		status, detail := errorStatus(err)
+		if status == http.StatusInternalServerError {
+			log.Printf("attachment upload to %s: %v\n", threadID, err)
+		}
+		cli.SendTo(from.ID, (&attachmentEvent{Type: "error", Error: detail}).message())
+		return
+	}
+
+	if a != nil {
+		cli.Broadcast((&attachmentEvent{Type: "attachment", Attachment: a, URL: attachmentURL(a)}).message())
+	}
+}
+
+func (s *service) handleCreateAttachment() http.HandlerFunc {
+	type response struct {
+		Attachment *thread.Attachment `json:"attachment"`
+		Location   string             `json:"location"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		uid, _ := threadIDFromRequest(r)
+
+		if _, err := s.r.FindMeta(r.Context(), uid); err != nil {
+			s.respondError(w, r, err)
+			return
+		}
+
+		body := http.MaxBytesReader(w, r.Body, maxAttachmentSize)
+		b, err := s.bs.Put(r.Context(), uid.String(), body)
+		if err != nil {
+			s.respondError(w, r, err)
+			return
+		}
+
+		// the declared Content-Type isn't trusted, attachments are served
+		// with the type sniffed from their content
+		a := thread.NewAttachment(uid, r.URL.Query().Get("name"), b.MimeType, b.Size)
+		a.Hash = b.Hash
+
+		if err := s.ar.Create(r.Context(), a); err != nil {
+			s.respondError(w, r, err)
+			return
+		}
+
+		if thread, ok := s.br.Load(uid.String()); ok {
+			thread.Client().Broadcast((&attachmentEvent{Type: "attachment", Attachment: a, URL: attachmentURL(a)}).message())
+		}
+
+		s.respond(w, r, &response{
+			Attachment: a,
+			Location:   attachmentURL(a),
+		}, http.StatusCreated)
+	}
+}
+
+func (s *service) handleGetAttachment() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uid, _ := threadIDFromRequest(r)
+
+		aid, err := uuid.Parse(chi.URLParam(r, "aid"))
+		if err != nil {
+			s.respondProblem(w, r, "invalid attachment id", http.StatusBadRequest)
+			return
+		}
+
+		a, err := s.ar.Find(r.Context(), uid, aid)
+		if err != nil {
+			s.respondError(w, r, err)
+			return
+		}
+
+		f, err := s.bs.Open(r.Context(), a.Hash)
+		if err != nil {
+			s.respondError(w, r, err)
+			return
+		}
+		defer f.Close()
+
+		w.Header().Set("Content-Type", a.MimeType)
+		w.Header().Set("Content-Disposition", contentDisposition(a.Name))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		// ServeContent takes care of range requests
+		http.ServeContent(w, r, a.Name, a.CreatedAt, f)
+	}
+}
@@ -0,0 +1,372 @@
+package service_test
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws/wsutil"
+	"github.com/google/uuid"
+	"github.com/hyphengolang/prelude/testing/is"
+
+	chat "com.adoublef.wss/internal/communications"
+	repo "com.adoublef.wss/internal/communications/sql"
+	"com.adoublef.wss/internal/storage"
+)
+
+// attachmentRepo keeps attachments in memory.
+type attachmentRepo struct {
+	repo.AttachmentRepo
+
+	mu sync.Mutex
+	m  map[uuid.UUID]*chat.Attachment
+}
+
+func (r *attachmentRepo) Create(ctx context.Context, a *chat.Attachment) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.m == nil {
+		r.m = make(map[uuid.UUID]*chat.Attachment)
+	}
+	r.m[a.ID] = a
+	return nil
+}
+
+func (r *attachmentRepo) Find(ctx context.Context, threadID, id uuid.UUID) (*chat.Attachment, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	a, ok := r.m[id]
+	if !ok || a.ThreadID != threadID {
+		return nil, repo.ErrNotFound
+	}
+	return a, nil
+}
+
+func (r *attachmentRepo) FindMany(ctx context.Context, threadID uuid.UUID) ([]*chat.Attachment, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	as := []*chat.Attachment{}
+	for _, a := range r.m {
+		if a.ThreadID == threadID {
+			as = append(as, a)
+		}
+	}
+	return as, nil
+}
+
+func (r *attachmentRepo) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.m)
+}
+
+// Frames of the upload protocol, see attachments.go.
+
+func beginFrame(id uint32, size int64, mimeType, name string) []byte {
+	p := []byte{0x01}
+	p = binary.BigEndian.AppendUint32(p, id)
+	p = binary.BigEndian.AppendUint64(p, uint64(size))
+	p = append(p, byte(len(mimeType)))
+	p = append(p, mimeType...)
+	return append(p, name...)
+}
+
+func chunkFrame(id uint32, data string) []byte {
+	p := binary.BigEndian.AppendUint32([]byte{0x02}, id)
+	return append(p, data...)
+}
+
+func abortFrame(id uint32) []byte {
+	return binary.BigEndian.AppendUint32([]byte{0x03}, id)
+}
+
+type attachmentEvent struct {
+	Type       string `json:"type"`
+	Attachment struct {
+		Name     string `json:"name"`
+		MimeType string `json:"mimeType"`
+		Size     int64  `json:"size"`
+	} `json:"attachment"`
+	URL   string `json:"url"`
+	Error string `json:"error"`
+}
+
+// nextEvent reads the next attachment event sent to conn.
+func nextEvent(t *testing.T, conn net.Conn) attachmentEvent {
+	t.Helper()
+
+	msg, err := read(conn, time.Second)
+	if err != nil {
+		t.Fatalf("no attachment event: %v", err)
+	}
+
+	var e attachmentEvent
+	if err := json.Unmarshal([]byte(msg), &e); err != nil {
+		t.Fatalf("attachment event %q: %v", msg, err)
+	}
+	return e
+}
+
+// silent reports whether nothing is sent to conn for a little while.
+func silent(conn net.Conn) bool {
+	_, err := read(conn, 50*time.Millisecond)
+
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+func TestUploadAttachment(t *testing.T) {
+	// setup serves a thread with a blob store under dir, ann and bob are
+	// connected to it.
+	setup := func(t *testing.T) (s *chatServer, ar *attachmentRepo, dir string, ann, bob net.Conn) {
+		dir = t.TempDir()
+		bs, err := storage.NewLocalBlobStore(dir, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ar = &attachmentRepo{}
+		s = newChatServer(t, ar, bs)
+		if ann, err = s.dial("?user=ann", nil, 1); err != nil {
+			t.Fatal(err)
+		}
+		if bob, err = s.dial("?user=bob", nil, 2); err != nil {
+			t.Fatal(err)
+		}
+		return s, ar, dir, ann, bob
+	}
+
+	t.Run("upload in chunks", func(t *testing.T) {
+		is := is.New(t)
+
+		s, ar, _, ann, bob := setup(t)
+
+		is.NoErr(wsutil.WriteClientBinary(ann, beginFrame(7, 11, "text/plain", "hello.txt")))
+		is.NoErr(wsutil.WriteClientBinary(ann, chunkFrame(7, "hello ")))
+		is.NoErr(wsutil.WriteClientBinary(ann, chunkFrame(7, "world")))
+
+		var location string
+		for _, conn := range []net.Conn{ann, bob} {
+			e := nextEvent(t, conn)
+			is.Equal(e.Type, "attachment")                               // every peer is told
+			is.Equal(e.Attachment.Name, "hello.txt")                     // name
+			is.Equal(e.Attachment.Size, int64(11))                       // size
+			is.Equal(e.Attachment.MimeType, "text/plain; charset=utf-8") // sniffed type
+			location = e.URL
+		}
+		is.Equal(ar.len(), 1) // stored
+
+		// the service is mounted at /chats in the server
+		res, err := http.Get(s.base + strings.TrimPrefix(location, "/chats"))
+		is.NoErr(err) // download
+		defer res.Body.Close()
+
+		b, err := io.ReadAll(res.Body)
+		is.NoErr(err)
+		is.Equal(res.StatusCode, http.StatusOK) // found
+		is.Equal(string(b), "hello world")      // chunks put together
+	})
+
+	t.Run("uploads interleaved on one connection", func(t *testing.T) {
+		is := is.New(t)
+
+		_, ar, _, ann, _ := setup(t)
+
+		is.NoErr(wsutil.WriteClientBinary(ann, beginFrame(1, 2, "", "a.txt")))
+		is.NoErr(wsutil.WriteClientBinary(ann, beginFrame(2, 2, "", "b.txt")))
+		is.NoErr(wsutil.WriteClientBinary(ann, chunkFrame(2, "b")))
+		is.NoErr(wsutil.WriteClientBinary(ann, chunkFrame(1, "aa")))
+		is.NoErr(wsutil.WriteClientBinary(ann, chunkFrame(2, "b")))
+
+		is.Equal(nextEvent(t, ann).Attachment.Name, "a.txt") // first to complete
+		is.Equal(nextEvent(t, ann).Attachment.Name, "b.txt") // then the other
+		is.Equal(ar.len(), 2)                                // both stored
+	})
+
+	t.Run("errors are sent to the uploader only", func(t *testing.T) {
+		tt := []struct {
+			name   string
+			frames [][]byte
+			want   string
+		}{
+			{
+				name:   "short frame",
+				frames: [][]byte{{0x02, 0, 0}},
+				want:   "malformed attachment frame",
+			},
+			{
+				name:   "unknown kind",
+				frames: [][]byte{{0x09, 0, 0, 0, 1}},
+				want:   "malformed attachment frame",
+			},
+			{
+				name:   "mime type past the frame",
+				frames: [][]byte{beginFrame(1, 1, "text/plain", "")[:15]},
+				want:   "malformed attachment frame",
+			},
+			{
+				name:   "chunk of an unknown upload",
+				frames: [][]byte{chunkFrame(1, "data")},
+				want:   "unknown upload",
+			},
+			{
+				name:   "empty attachment",
+				frames: [][]byte{beginFrame(1, 0, "", "empty")},
+				want:   "attachment exceeds size limit",
+			},
+			{
+				name:   "attachment too big",
+				frames: [][]byte{beginFrame(1, 10<<20+1, "", "big")},
+				want:   "attachment exceeds size limit",
+			},
+			{
+				name:   "upload id in use",
+				frames: [][]byte{beginFrame(1, 4, "", "a"), beginFrame(1, 4, "", "b")},
+				want:   "upload id already in use",
+			},
+			{
+				name: "too many uploads",
+				frames: [][]byte{
+					beginFrame(1, 4, "", ""),
+					beginFrame(2, 4, "", ""),
+					beginFrame(3, 4, "", ""),
+					beginFrame(4, 4, "", ""),
+					beginFrame(5, 4, "", ""),
+				},
+				want: "too many pending uploads",
+			},
+			{
+				name:   "chunk after an abort",
+				frames: [][]byte{beginFrame(1, 4, "", ""), chunkFrame(1, "ab"), abortFrame(1), chunkFrame(1, "cd")},
+				want:   "unknown upload",
+			},
+		}
+
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				is := is.New(t)
+
+				_, ar, _, ann, bob := setup(t)
+				for _, p := range tc.frames {
+					is.NoErr(wsutil.WriteClientBinary(ann, p))
+				}
+
+				e := nextEvent(t, ann)
+				is.Equal(e.Type, "error")  // upload failed
+				is.Equal(e.Error, tc.want) // with the reason
+				is.True(silent(bob))       // the others aren't told
+				is.Equal(ar.len(), 0)      // nothing stored
+			})
+		}
+	})
+
+	t.Run("overflowing upload is dropped", func(t *testing.T) {
+		is := is.New(t)
+
+		_, _, _, ann, _ := setup(t)
+
+		is.NoErr(wsutil.WriteClientBinary(ann, beginFrame(1, 3, "", "")))
+		is.NoErr(wsutil.WriteClientBinary(ann, chunkFrame(1, "hello")))
+		is.Equal(nextEvent(t, ann).Error, "upload exceeds declared size") // too much
+
+		is.NoErr(wsutil.WriteClientBinary(ann, chunkFrame(1, "h")))
+		is.Equal(nextEvent(t, ann).Error, "unknown upload") // gone
+	})
+
+	t.Run("unfinished uploads are discarded on disconnect", func(t *testing.T) {
+		is := is.New(t)
+
+		s, ar, dir, ann, _ := setup(t)
+
+		is.NoErr(wsutil.WriteClientBinary(ann, beginFrame(1, 10, "", "partial")))
+		is.NoErr(wsutil.WriteClientBinary(ann, chunkFrame(1, "hello")))
+		ann.Close()
+
+		thread, _ := s.reg.Load(s.id.String())
+		is.Equal(peers(thread, 1), 1) // ann left
+
+		tmp := func() int {
+			es, err := os.ReadDir(filepath.Join(dir, "tmp"))
+			is.NoErr(err)
+			return len(es)
+		}
+		deadline := time.Now().Add(time.Second)
+		for tmp() > 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		is.Equal(tmp(), 0)    // partial content removed
+		is.Equal(ar.len(), 0) // nothing stored
+	})
+}
+
+func TestAttachmentOverHTTP(t *testing.T) {
+	bs, err := storage.NewLocalBlobStore(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newChatServer(t, &attachmentRepo{}, bs)
+
+	tt := []struct {
+		name string
+		// declared is the Content-Type of the upload.
+		declared string
+		content  string
+		// want is the Content-Type the attachment is served with.
+		want string
+	}{
+		{"plain.txt", "text/plain", "hello", "text/plain; charset=utf-8"},
+		{`say "hi".txt`, "", "hello", "text/plain; charset=utf-8"},
+		{"naïve; résumé.txt", "", "hello", "text/plain; charset=utf-8"},
+		{"page.html", "text/html", "\x00\x01\x02<script>", "application/octet-stream"},
+		{"data.bin", "image/png", "\x00\x01\x02", "application/octet-stream"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+
+			res, err := http.Post(s.base+"/"+s.id.String()+"/attachments?name="+url.QueryEscape(tc.name), tc.declared, strings.NewReader(tc.content))
+			is.NoErr(err) // upload
+			defer res.Body.Close()
+			is.Equal(res.StatusCode, http.StatusCreated) // stored
+
+			var created struct {
+				Location string `json:"location"`
+			}
+			is.NoErr(json.NewDecoder(res.Body).Decode(&created))
+
+			res, err = http.Get(s.base + strings.TrimPrefix(created.Location, "/chats"))
+			is.NoErr(err) // download
+			defer res.Body.Close()
+
+			b, err := io.ReadAll(res.Body)
+			is.NoErr(err)
+			is.Equal(res.StatusCode, http.StatusOK) // found
+			is.Equal(string(b), tc.content)         // same content
+
+			is.Equal(res.Header.Get("Content-Type"), tc.want)             // sniffed, not declared
+			is.Equal(res.Header.Get("X-Content-Type-Options"), "nosniff") // nor sniffed by browsers
+
+			disposition, params, err := mime.ParseMediaType(res.Header.Get("Content-Disposition"))
+			is.NoErr(err)                         // valid header
+			is.Equal(disposition, "attachment")   // downloaded
+			is.Equal(params["filename"], tc.name) // under its name
+		})
+	}
+}
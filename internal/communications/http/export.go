@@ -0,0 +1,243 @@
+package service
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	thread "com.adoublef.wss/internal/communications"
+)
+
+// exporter writes the transcript of a thread one message at a time, so
+// that threads of any size can be exported.
+type exporter interface {
+	begin(t *thread.Thread) error
+	message(msg *thread.Message) error
+	end() error
+}
+
+type exportFormat struct {
+	contentType string
+	ext         string
+	new         func(w io.Writer) exporter
+}
+
+var exportFormats = map[string]exportFormat{
+	"json":     {"application/json; charset=utf-8", "json", newJSONExporter},
+	"ndjson":   {"application/x-ndjson", "ndjson", newNDJSONExporter},
+	"csv":      {"text/csv; charset=utf-8", "csv", newCSVExporter},
+	"markdown": {"text/markdown; charset=utf-8", "md", newMarkdownExporter},
+}
+
+// handleExport streams the messages of a thread in the format given by the
+// format query parameter, JSON by default.
+func (s *service) handleExport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		uid, _ := threadIDFromRequest(r)
+
+		name := r.URL.Query().Get("format")
+		if name == "" {
+			name = "json"
+		}
+		format, ok := exportFormats[name]
+		if !ok {
+			s.respondProblem(w, r, "unknown format, want json, ndjson, csv or markdown", http.StatusBadRequest)
+			return
+		}
+
+		t, err := s.r.FindMeta(r.Context(), uid)
+		if err != nil {
+			s.respondError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", format.contentType)
+		w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote("thread-"+uid.String()+"."+format.ext))
+		w.WriteHeader(http.StatusOK)
+
+		bw := bufio.NewWriter(w)
+		e := format.new(bw)
+
+		err = e.begin(t)
+		if err == nil {
+			err = s.mr.ForEach(r.Context(), uid, e.message)
+		}
+		if err == nil {
+			err = e.end()
+		}
+		if err == nil {
+			err = bw.Flush()
+		}
+		if err != nil {
+			// the status has already been sent, the client gets a
+			// truncated transcript
+			log.Printf("export %s: %v\n", uid, err)
+		}
+	}
+}
+
+// exportThread is the part of a thread included in a JSON export.
+type exportThread struct {
+	ID         uuid.UUID        `json:"id"`
+	CreatedAt  time.Time        `json:"createdAt"`
+	Retention  thread.Retention `json:"retention"`
+	ExportedAt time.Time        `json:"exportedAt"`
+}
+
+// jsonExporter writes {"thread": {...}, "messages": [...]}.
+type jsonExporter struct {
+	w io.Writer
+	n int
+}
+
+func newJSONExporter(w io.Writer) exporter {
+	return &jsonExporter{w: w}
+}
+
+func (e *jsonExporter) begin(t *thread.Thread) error {
+	p, err := json.Marshal(&exportThread{
+		ID:         t.ID,
+		CreatedAt:  t.CreatedAt,
+		Retention:  t.Retention,
+		ExportedAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(e.w, `{"thread":%s,"messages":[`, p)
+	return err
+}
+
+func (e *jsonExporter) message(msg *thread.Message) error {
+	p, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	sep := ",\n"
+	if e.n == 0 {
+		sep = "\n"
+	}
+	e.n++
+
+	if _, err := io.WriteString(e.w, sep); err != nil {
+		return err
+	}
+
+	_, err = e.w.Write(p)
+	return err
+}
+
+func (e *jsonExporter) end() error {
+	_, err := io.WriteString(e.w, "\n]}\n")
+	return err
+}
+
+// ndjsonExporter writes a message per line.
+type ndjsonExporter struct {
+	enc *json.Encoder
+}
+
+func newNDJSONExporter(w io.Writer) exporter {
+	return &ndjsonExporter{enc: json.NewEncoder(w)}
+}
+
+func (e *ndjsonExporter) begin(t *thread.Thread) error { return nil }
+
+func (e *ndjsonExporter) message(msg *thread.Message) error { return e.enc.Encode(msg) }
+
+func (e *ndjsonExporter) end() error { return nil }
+
+// csvExporter writes a message per record, after a header.
+type csvExporter struct {
+	w *csv.Writer
+}
+
+func newCSVExporter(w io.Writer) exporter {
+	return &csvExporter{w: csv.NewWriter(w)}
+}
+
+func (e *csvExporter) begin(t *thread.Thread) error {
+	return e.w.Write([]string{"id", "sender", "created_at", "edited_at", "content"})
+}
+
+func (e *csvExporter) message(msg *thread.Message) error {
+	var editedAt string
+	if msg.EditedAt != nil {
+		editedAt = msg.EditedAt.UTC().Format(time.RFC3339Nano)
+	}
+
+	return e.w.Write([]string{
+		strconv.Itoa(msg.ID),
+		csvEscape(msg.Sender),
+		msg.CreatedAt.UTC().Format(time.RFC3339Nano),
+		editedAt,
+		csvEscape(msg.Content),
+	})
+}
+
+func (e *csvExporter) end() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// csvEscape prefixes cells that spreadsheets would run as formulas with a
+// quote, so that they are shown as text.
+func csvEscape(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// markdownExporter writes a human readable transcript, messages are
+// quoted so that their content can't break the layout.
+type markdownExporter struct {
+	w io.Writer
+}
+
+func newMarkdownExporter(w io.Writer) exporter {
+	return &markdownExporter{w: w}
+}
+
+func (e *markdownExporter) begin(t *thread.Thread) error {
+	_, err := fmt.Fprintf(e.w, "# Thread %s\n\nCreated %s, exported %s.\n",
+		t.ID, t.CreatedAt.UTC().Format(time.RFC3339), time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+func (e *markdownExporter) message(msg *thread.Message) error {
+	sender := msg.Sender
+	if sender == "" {
+		sender = "anonymous"
+	}
+
+	var edited string
+	if msg.EditedAt != nil {
+		edited = " (edited " + msg.EditedAt.UTC().Format(time.RFC3339) + ")"
+	}
+
+	quoted := "> " + strings.ReplaceAll(msg.Content, "\n", "\n> ")
+	_, err := fmt.Fprintf(e.w, "\n**%s** · %s%s\n\n%s\n", markdownEscape(sender), msg.CreatedAt.UTC().Format(time.RFC3339), edited, quoted)
+	return err
+}
+
+func (e *markdownExporter) end() error { return nil }
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, `*`, `\*`, `_`, `\_`, "`", "\\`", `[`, `\[`, `]`, `\]`, `<`, `\<`, `>`, `\>`, "\n", " ",
+)
+
+func markdownEscape(s string) string {
+	return markdownEscaper.Replace(s)
+}
@@ -0,0 +1,139 @@
+package service_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hyphengolang/prelude/testing/is"
+
+	chat "com.adoublef.wss/internal/communications"
+	service "com.adoublef.wss/internal/communications/http"
+	repo "com.adoublef.wss/internal/communications/sql"
+)
+
+// transcriptRepo holds the messages of every thread.
+type transcriptRepo struct {
+	repo.MessageRepo
+
+	msgs []*chat.Message
+}
+
+func (r *transcriptRepo) ForEach(ctx context.Context, threadID uuid.UUID, fn func(msg *chat.Message) error) error {
+	for _, msg := range r.msgs {
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestExport(t *testing.T) {
+	created := time.Date(2023, 2, 1, 12, 0, 0, 0, time.UTC)
+	edited := created.Add(time.Minute)
+
+	mr := &transcriptRepo{msgs: []*chat.Message{
+		{ID: 1, Sender: "ann", Content: "hello\nworld", CreatedAt: created},
+		{ID: 2, Sender: "*bob*", Content: "=HYPERLINK(\"http://evil\")", CreatedAt: created, EditedAt: &edited},
+		{ID: 3, Sender: "@carl", Content: "-1+1", CreatedAt: created},
+	}}
+
+	srv := httptest.NewServer(service.NewService(&threadRepo{}, mr, nil, nil))
+	t.Cleanup(srv.Close)
+
+	id := uuid.New()
+	export := func(t *testing.T, format string) *http.Response {
+		res, err := http.Get(srv.URL + "/" + id.String() + "/export?format=" + format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { res.Body.Close() })
+		return res
+	}
+
+	t.Run("json", func(t *testing.T) {
+		is := is.New(t)
+
+		res := export(t, "json")
+		is.Equal(res.StatusCode, http.StatusOK)                                     // exported
+		is.Equal(res.Header.Get("Content-Type"), "application/json; charset=utf-8") // as json
+		is.True(strings.Contains(res.Header.Get("Content-Disposition"), `filename="thread-`+id.String()+`.json"`))
+
+		var body struct {
+			Thread struct {
+				ID uuid.UUID `json:"id"`
+			} `json:"thread"`
+			Messages []*chat.Message `json:"messages"`
+		}
+		is.NoErr(json.NewDecoder(res.Body).Decode(&body))
+		is.Equal(body.Thread.ID, id)                       // thread
+		is.Equal(len(body.Messages), 3)                    // every message
+		is.Equal(body.Messages[0].Content, "hello\nworld") // in order
+		is.Equal(*body.Messages[1].EditedAt, edited)       // edits kept
+	})
+
+	t.Run("ndjson", func(t *testing.T) {
+		is := is.New(t)
+
+		res := export(t, "ndjson")
+		is.Equal(res.StatusCode, http.StatusOK)
+		is.Equal(res.Header.Get("Content-Type"), "application/x-ndjson")
+
+		var ids []int
+		sc := bufio.NewScanner(res.Body)
+		for sc.Scan() {
+			var msg chat.Message
+			is.NoErr(json.Unmarshal(sc.Bytes(), &msg)) // a message per line
+			ids = append(ids, msg.ID)
+		}
+		is.NoErr(sc.Err())
+		is.Equal(ids, []int{1, 2, 3}) // in order
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		is := is.New(t)
+
+		res := export(t, "csv")
+		is.Equal(res.StatusCode, http.StatusOK)
+		is.Equal(res.Header.Get("Content-Type"), "text/csv; charset=utf-8")
+
+		records, err := csv.NewReader(res.Body).ReadAll()
+		is.NoErr(err)
+		is.Equal(len(records), 4) // header and a record per message
+		is.Equal(records[0], []string{"id", "sender", "created_at", "edited_at", "content"})
+		is.Equal(records[1], []string{"1", "ann", "2023-02-01T12:00:00Z", "", "hello\nworld"})
+		is.Equal(records[2], []string{"2", "*bob*", "2023-02-01T12:00:00Z", "2023-02-01T12:01:00Z", `'=HYPERLINK("http://evil")`}) // formula quoted
+		is.Equal(records[3], []string{"3", "'@carl", "2023-02-01T12:00:00Z", "", "'-1+1"})                                         // in sender too
+	})
+
+	t.Run("markdown", func(t *testing.T) {
+		is := is.New(t)
+
+		res := export(t, "markdown")
+		is.Equal(res.StatusCode, http.StatusOK)
+		is.Equal(res.Header.Get("Content-Type"), "text/markdown; charset=utf-8")
+
+		p, err := io.ReadAll(res.Body)
+		is.NoErr(err)
+		md := string(p)
+		is.True(strings.HasPrefix(md, "# Thread "+id.String()+"\n"))                                      // title
+		is.True(strings.Contains(md, "**ann** · 2023-02-01T12:00:00Z\n\n> hello\n> world\n"))             // content quoted
+		is.True(strings.Contains(md, `**\*bob\*** · 2023-02-01T12:00:00Z (edited 2023-02-01T12:01:00Z)`)) // sender escaped
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		is := is.New(t)
+
+		res := export(t, "xml")
+		is.Equal(res.StatusCode, http.StatusBadRequest)                      // rejected
+		is.Equal(res.Header.Get("Content-Type"), "application/problem+json") // with a problem
+	})
+}
@@ -0,0 +1,303 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/google/uuid"
+
+	thread "com.adoublef.wss/internal/communications"
+	repo "com.adoublef.wss/internal/communications/sql"
+)
+
+// A bundle is one or more JSON exports one after the other, as written by
+// GET /chats/{id}/export?format=json:
+//
+//	{"thread": {"id": ..., "createdAt": ..., "retention": ...}, "messages": [...]}
+//
+// The keys may come in any order, other keys are ignored. Messages are
+// imported as they are read when the thread comes first, as in exports,
+// and held in memory until the thread is read otherwise. Every thread is
+// imported with its id, and its messages with their sender and
+// timestamps, or not at all. Threads that already exist are
+// reported as conflicts and left untouched.
+
+// ImportReport is the outcome of an import.
+type ImportReport struct {
+	Imported  []*ImportedThread `json:"imported"`
+	Conflicts []*ImportIssue    `json:"conflicts"`
+	Invalid   []*ImportIssue    `json:"invalid"`
+	// Error is set when the bundle could not be read to the end, the
+	// threads after the error are not imported.
+	Error string `json:"error,omitempty"`
+}
+
+// OK reports whether every thread of the bundle was imported.
+func (r *ImportReport) OK() bool {
+	return r.Error == "" && len(r.Conflicts) == 0 && len(r.Invalid) == 0
+}
+
+type ImportedThread struct {
+	ID       uuid.UUID `json:"id"`
+	Messages int       `json:"messages"`
+}
+
+// ImportIssue is a thread that was not imported, Index is its position in
+// the bundle starting from 0.
+type ImportIssue struct {
+	Index  int       `json:"index"`
+	ID     uuid.UUID `json:"id"`
+	Detail string    `json:"detail"`
+}
+
+var errInvalidBundle = errors.New("invalid bundle")
+
+// malformedError is returned when the bundle is not valid JSON, which
+// stops the import.
+type malformedError struct {
+	err error
+}
+
+func (e *malformedError) Error() string { return "malformed bundle: " + e.err.Error() }
+
+func (e *malformedError) Unwrap() error { return e.err }
+
+// Import reads a bundle from body and imports its threads. It only
+// returns an error if the repository fails, problems with the bundle are
+// in the report.
+func Import(ctx context.Context, r repo.ThreadRepo, body io.Reader) (*ImportReport, error) {
+	report := &ImportReport{
+		Imported:  []*ImportedThread{},
+		Conflicts: []*ImportIssue{},
+		Invalid:   []*ImportIssue{},
+	}
+
+	dec := json.NewDecoder(body)
+	for i := 0; dec.More(); i++ {
+		err := importThread(ctx, r, dec, i, report)
+
+		var malformed *malformedError
+		if errors.As(err, &malformed) {
+			report.Error = malformed.Error()
+			return report, nil
+		} else if err != nil {
+			return report, err
+		}
+	}
+
+	// More is also false on a syntax error
+	if _, err := dec.Token(); err != nil && !errors.Is(err, io.EOF) {
+		report.Error = (&malformedError{err}).Error()
+	}
+
+	return report, nil
+}
+
+func importThread(ctx context.Context, r repo.ThreadRepo, dec *json.Decoder, index int, report *ImportReport) error {
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+
+	var (
+		t             *exportThread
+		hasMessages   bool
+		messagesFirst bool
+		// held are the messages read before the thread, the others are
+		// imported as they are read
+		held []json.RawMessage
+	)
+	for dec.More() {
+		key, err := nextKey(dec)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case key == "thread" && t == nil:
+			t = new(exportThread)
+			if err := dec.Decode(t); err != nil {
+				return &malformedError{err}
+			}
+		case key == "messages" && !hasMessages:
+			hasMessages = true
+			if err := expectDelim(dec, '['); err != nil {
+				return err
+			}
+
+			if t == nil {
+				messagesFirst = true
+				for dec.More() {
+					var msg json.RawMessage
+					if err := dec.Decode(&msg); err != nil {
+						return &malformedError{err}
+					}
+					held = append(held, msg)
+				}
+			} else if err := importMessages(ctx, r, t, index, report, dec.More, dec.Decode); err != nil {
+				return err
+			}
+
+			if err := expectDelim(dec, ']'); err != nil {
+				return err
+			}
+		case key == "thread", key == "messages":
+			return &malformedError{fmt.Errorf("duplicate key %q", key)}
+		default:
+			// other keys are ignored
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return &malformedError{err}
+			}
+		}
+	}
+
+	if err := expectDelim(dec, '}'); err != nil {
+		return err
+	}
+
+	switch {
+	case t == nil:
+		return &malformedError{errors.New(`missing key "thread"`)}
+	case !hasMessages:
+		return &malformedError{errors.New(`missing key "messages"`)}
+	case messagesFirst:
+		more := func() bool { return len(held) > 0 }
+		decode := func(v any) error {
+			msg := held[0]
+			held = held[1:]
+			return json.Unmarshal(msg, v)
+		}
+		return importMessages(ctx, r, t, index, report, more, decode)
+	}
+
+	return nil
+}
+
+// importMessages imports t along with the messages read by more and
+// decode, the outcome is added to report. The messages left once the
+// thread has been rejected are read and dropped.
+func importMessages(ctx context.Context, r repo.ThreadRepo, t *exportThread, index int, report *ImportReport, more func() bool, decode func(v any) error) error {
+	issue := &ImportIssue{Index: index, ID: t.ID}
+
+	var n int
+	err := validateThread(t)
+	if err == nil {
+		thr := &thread.Thread{ID: t.ID, CreatedAt: t.CreatedAt, Retention: t.Retention}
+		err = r.Import(ctx, thr, func() (*thread.Message, error) {
+			if !more() {
+				return nil, io.EOF
+			}
+
+			var msg thread.Message
+			if err := decode(&msg); err != nil {
+				return nil, &malformedError{err}
+			}
+			if err := validateMessage(&msg); err != nil {
+				return nil, fmt.Errorf("message %d: %w", n, err)
+			}
+
+			n++
+			return &msg, nil
+		})
+	}
+
+	var malformed *malformedError
+	switch {
+	case err == nil:
+		report.Imported = append(report.Imported, &ImportedThread{ID: t.ID, Messages: n})
+	case errors.As(err, &malformed):
+		return err
+	case errors.Is(err, repo.ErrConflict):
+		issue.Detail = "thread already exists"
+		report.Conflicts = append(report.Conflicts, issue)
+	case errors.Is(err, errInvalidBundle), errors.Is(err, repo.ErrInvalidKey):
+		issue.Detail = err.Error()
+		report.Invalid = append(report.Invalid, issue)
+	default:
+		return err
+	}
+
+	for more() {
+		var skip json.RawMessage
+		if err := decode(&skip); err != nil {
+			return &malformedError{err}
+		}
+	}
+
+	return nil
+}
+
+func validateThread(t *exportThread) error {
+	switch {
+	case t.ID == uuid.Nil:
+		return fmt.Errorf("%w: thread has no id", errInvalidBundle)
+	case t.CreatedAt.IsZero():
+		return fmt.Errorf("%w: thread has no creation time", errInvalidBundle)
+	}
+
+	return nil
+}
+
+func validateMessage(msg *thread.Message) error {
+	switch {
+	case msg.CreatedAt.IsZero():
+		return fmt.Errorf("%w: message has no creation time", errInvalidBundle)
+	case msg.EditedAt != nil && msg.EditedAt.Before(msg.CreatedAt):
+		return fmt.Errorf("%w: message edited before it was created", errInvalidBundle)
+	}
+
+	return nil
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return &malformedError{err}
+	}
+	if d, ok := tok.(json.Delim); !ok || d != want {
+		return &malformedError{fmt.Errorf("expected %v, got %v", want, tok)}
+	}
+
+	return nil
+}
+
+func nextKey(dec *json.Decoder) (string, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return "", &malformedError{err}
+	}
+
+	key, ok := tok.(string)
+	if !ok {
+		return "", &malformedError{fmt.Errorf("expected key, got %v", tok)}
+	}
+
+	return key, nil
+}
+
+// handleImport imports a bundle. The report is sent back with 200 if every
+// thread was imported, 409 if some already existed and 422 if the bundle
+// had problems.
+func (s *service) handleImport() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, err := Import(r.Context(), s.r, r.Body)
+		if err != nil {
+			s.respondError(w, r, err)
+			return
+		}
+
+		status := http.StatusOK
+		switch {
+		case report.Error != "" || len(report.Invalid) > 0:
+			status = http.StatusUnprocessableEntity
+		case len(report.Conflicts) > 0:
+			status = http.StatusConflict
+		}
+
+		s.respond(w, r, report, status)
+	}
+}
@@ -0,0 +1,166 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/hyphengolang/prelude/testing/is"
+
+	chat "com.adoublef.wss/internal/communications"
+	service "com.adoublef.wss/internal/communications/http"
+	repo "com.adoublef.wss/internal/communications/sql"
+)
+
+// importRepo keeps the imported threads in memory.
+type importRepo struct {
+	repo.ThreadRepo
+
+	threads map[uuid.UUID][]*chat.Message
+}
+
+func (r *importRepo) Import(ctx context.Context, t *chat.Thread, next func() (*chat.Message, error)) error {
+	if _, ok := r.threads[t.ID]; ok {
+		return repo.ErrConflict
+	}
+
+	msgs := []*chat.Message{}
+	for {
+		msg, err := next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		msgs = append(msgs, msg)
+	}
+
+	r.threads[t.ID] = msgs
+	return nil
+}
+
+// bundle returns the export of a thread with a message per content.
+func bundle(id uuid.UUID, contents ...string) string {
+	msgs := make([]string, len(contents))
+	for i, content := range contents {
+		msgs[i] = `{"sender":"ann","content":"` + content + `","createdAt":"2023-02-01T12:00:00Z"}`
+	}
+
+	return `{"thread":{"id":"` + id.String() + `","createdAt":"2023-02-01T12:00:00Z","retention":"forever"},"messages":[` + strings.Join(msgs, ",") + `]}`
+}
+
+func TestImport(t *testing.T) {
+	existing := uuid.New()
+	tr := &importRepo{threads: map[uuid.UUID][]*chat.Message{existing: {}}}
+
+	srv := httptest.NewServer(service.NewService(tr, nil, nil, nil))
+	t.Cleanup(srv.Close)
+
+	post := func(t *testing.T, body string) (*http.Response, *service.ImportReport) {
+		res, err := http.Post(srv.URL+"/import", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		var report service.ImportReport
+		if err := json.NewDecoder(res.Body).Decode(&report); err != nil {
+			t.Fatal(err)
+		}
+		return res, &report
+	}
+
+	t.Run("imported", func(t *testing.T) {
+		is := is.New(t)
+
+		a, b := uuid.New(), uuid.New()
+		res, report := post(t, bundle(a, "hello", "world")+"\n"+bundle(b))
+		is.Equal(res.StatusCode, http.StatusOK) // every thread imported
+		is.True(report.OK())
+
+		is.Equal(len(report.Imported), 2) // both threads
+		is.Equal(*report.Imported[0], service.ImportedThread{ID: a, Messages: 2})
+		is.Equal(*report.Imported[1], service.ImportedThread{ID: b, Messages: 0})
+		is.Equal(tr.threads[a][1].Content, "world") // messages in order
+	})
+
+	t.Run("keys in any order", func(t *testing.T) {
+		is := is.New(t)
+
+		id := uuid.New()
+		body := `{"version":1,"messages":[{"sender":"ann","content":"first","createdAt":"2023-02-01T12:00:00Z"}],` +
+			`"thread":{"id":"` + id.String() + `","createdAt":"2023-02-01T12:00:00Z"}}`
+		res, report := post(t, body)
+		is.Equal(res.StatusCode, http.StatusOK)                                    // imported
+		is.Equal(*report.Imported[0], service.ImportedThread{ID: id, Messages: 1}) // with the messages read first
+		is.Equal(tr.threads[id][0].Content, "first")
+	})
+
+	t.Run("existing thread", func(t *testing.T) {
+		is := is.New(t)
+
+		id := uuid.New()
+		res, report := post(t, bundle(existing, "again")+bundle(id, "new"))
+		is.Equal(res.StatusCode, http.StatusConflict) // some threads exist
+
+		is.Equal(len(report.Conflicts), 1) // the existing thread
+		is.Equal(*report.Conflicts[0], service.ImportIssue{Index: 0, ID: existing, Detail: "thread already exists"})
+		is.Equal(len(tr.threads[existing]), 0) // left untouched
+		is.Equal(len(report.Imported), 1)      // the others imported
+		is.Equal(report.Imported[0].ID, id)
+	})
+
+	t.Run("invalid thread", func(t *testing.T) {
+		is := is.New(t)
+
+		id := uuid.New()
+		body := `{"thread":{"id":"` + id.String() + `"},"messages":[{"content":"no time"}]}`
+		res, report := post(t, body)
+		is.Equal(res.StatusCode, http.StatusUnprocessableEntity) // rejected
+		is.Equal(len(report.Invalid), 1)
+		is.Equal(report.Invalid[0].ID, id)
+		is.True(strings.Contains(report.Invalid[0].Detail, "no creation time")) // why
+		is.Equal(report.Error, "")                                              // rest of the bundle read
+	})
+
+	tt := []struct {
+		name string
+		body string
+	}{
+		{"not json", `thread`},
+		{"not an object", `[]`},
+		{"truncated", bundle(uuid.New(), "hello")[:80]},
+		{"missing thread", `{"messages":[]}`},
+		{"missing messages", `{"thread":{"id":"` + uuid.NewString() + `","createdAt":"2023-02-01T12:00:00Z"}}`},
+		{"duplicate key", `{"thread":{},"thread":{},"messages":[]}`},
+		{"messages not an array", `{"thread":{"id":"` + uuid.NewString() + `","createdAt":"2023-02-01T12:00:00Z"},"messages":{}}`},
+		{"message not an object", `{"thread":{"id":"` + uuid.NewString() + `","createdAt":"2023-02-01T12:00:00Z"},"messages":[1]}`},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+
+			res, report := post(t, tc.body)
+			is.Equal(res.StatusCode, http.StatusUnprocessableEntity)       // rejected
+			is.True(strings.HasPrefix(report.Error, "malformed bundle: ")) // why
+			is.Equal(len(report.Imported)+len(report.Invalid), 0)          // nothing imported
+		})
+	}
+
+	t.Run("threads before an error are kept", func(t *testing.T) {
+		is := is.New(t)
+
+		id := uuid.New()
+		res, report := post(t, bundle(id, "hello")+`{"thread":`)
+		is.Equal(res.StatusCode, http.StatusUnprocessableEntity) // rejected
+		is.True(report.Error != "")                              // bundle cut short
+		is.Equal(len(report.Imported), 1)                        // first thread imported
+		is.Equal(report.Imported[0].ID, id)
+	})
+}
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	repo "com.adoublef.wss/internal/communications/sql"
+	"com.adoublef.wss/internal/storage"
+)
+
+// problem is the body of every error response, see RFC 7807.
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+// respondProblem writes a problem response. detail is shown to the client
+// so it must not contain anything internal.
+func (s *service) respondProblem(w http.ResponseWriter, r *http.Request, detail string, status int) {
+	p := problem{
+		// no problem types are defined, the status says it all
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: r.URL.Path,
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(&p); err != nil {
+		log.Printf("could not encode problem: %v\n", err)
+	}
+}
+
+// respondError writes the problem response matching err.
+func (s *service) respondError(w http.ResponseWriter, r *http.Request, err error) {
+	status, detail := errorStatus(err)
+	if status == http.StatusInternalServerError {
+		log.Printf("%s %s: %v\n", r.Method, r.URL.Path, err)
+	}
+
+	s.respondProblem(w, r, detail, status)
+}
+
+// errorStatus maps an error from a repository, the blob store or an upload
+// to a status code and a detail safe to show to clients. Errors it doesn't
+// know about are internal.
+func errorStatus(err error) (status int, detail string) {
+	var maxErr *http.MaxBytesError
+
+	switch {
+	case errors.Is(err, repo.ErrNotFound), errors.Is(err, storage.ErrNotFound):
+		return http.StatusNotFound, "resource not found"
+	case errors.Is(err, repo.ErrConflict):
+		return http.StatusConflict, "resource already exists"
+	case errors.Is(err, repo.ErrInvalidKey):
+		return http.StatusBadRequest, "invalid id"
+	case errors.Is(err, errUnauthenticated):
+		return http.StatusUnauthorized, errUnauthenticated.Error()
+	case errors.Is(err, storage.ErrQuotaExceeded):
+		return http.StatusInsufficientStorage, storage.ErrQuotaExceeded.Error()
+	case errors.As(err, &maxErr), errors.Is(err, errAttachmentSize):
+		return http.StatusRequestEntityTooLarge, errAttachmentSize.Error()
+	case errors.Is(err, errMalformedFrame),
+		errors.Is(err, errUnknownUpload),
+		errors.Is(err, errTooManyUploads),
+		errors.Is(err, errUploadOverflow),
+		errors.Is(err, errDuplicateUpload),
+		errors.Is(err, errUploadAborted):
+		return http.StatusBadRequest, err.Error()
+	}
+
+	return http.StatusInternalServerError, "internal server error"
+}
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	repo "com.adoublef.wss/internal/communications/sql"
+	"com.adoublef.wss/internal/storage"
+)
+
+// Purger removes threads that have been deleted for longer than the
+// retention window, along with their messages and attachments.
+type Purger struct {
+	r         repo.ThreadRepo
+	ar        repo.AttachmentRepo
+	bs        storage.BlobStore
+	retention time.Duration
+}
+
+func NewPurger(r repo.ThreadRepo, ar repo.AttachmentRepo, bs storage.BlobStore, retention time.Duration) *Purger {
+	p := &Purger{
+		r:         r,
+		ar:        ar,
+		bs:        bs,
+		retention: retention,
+	}
+
+	return p
+}
+
+// Run purges every interval until ctx is done.
+func (p *Purger) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := p.Purge(ctx)
+		if err != nil {
+			log.Printf("purge: %v\n", err)
+		}
+		if n > 0 {
+			log.Printf("purged %d threads\n", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Purge removes the expired threads once and returns how many were
+// removed. A thread that fails to be removed is retried on the next run.
+func (p *Purger) Purge(ctx context.Context) (int, error) {
+	ids, err := p.r.FindDeleted(ctx, time.Now().Add(-p.retention))
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, id := range ids {
+		as, err := p.ar.FindMany(ctx, id)
+		if err != nil {
+			log.Printf("purge %s: %v\n", id, err)
+			continue
+		}
+
+		if err := p.r.Purge(ctx, id); err != nil {
+			log.Printf("purge %s: %v\n", id, err)
+			continue
+		}
+		n++
+
+		// the metadata is gone, at worst some content is left unreferenced
+		for _, a := range as {
+			err := p.bs.Delete(ctx, id.String(), a.Hash)
+			if err != nil && !errors.Is(err, storage.ErrNotFound) {
+				log.Printf("purge %s: attachment %s: %v\n", id, a.ID, err)
+			}
+		}
+	}
+
+	return n, ctx.Err()
+}
@@ -0,0 +1,244 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hyphengolang/prelude/testing/is"
+
+	chat "com.adoublef.wss/internal/communications"
+	service "com.adoublef.wss/internal/communications/http"
+	repo "com.adoublef.wss/internal/communications/sql"
+	"com.adoublef.wss/internal/storage"
+)
+
+// deletedRepo keeps when threads were deleted in memory, any other thread
+// is live.
+type deletedRepo struct {
+	repo.ThreadRepo
+
+	mu      sync.Mutex
+	deleted map[uuid.UUID]time.Time
+	// cutoffs holds the time of every FindDeleted call.
+	cutoffs []time.Time
+	// fail is returned once when purging the thread with that id.
+	fail map[uuid.UUID]error
+}
+
+func (r *deletedRepo) FindDeleted(ctx context.Context, deletedBefore time.Time) ([]uuid.UUID, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cutoffs = append(r.cutoffs, deletedBefore)
+
+	ids := []uuid.UUID{}
+	for id, at := range r.deleted {
+		if at.Before(deletedBefore) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (r *deletedRepo) Purge(ctx context.Context, id uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err, ok := r.fail[id]; ok {
+		delete(r.fail, id)
+		return err
+	}
+
+	delete(r.deleted, id)
+	return nil
+}
+
+func (r *deletedRepo) Restore(ctx context.Context, id uuid.UUID, deletedAfter time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	at, ok := r.deleted[id]
+	if !ok || !at.After(deletedAfter) {
+		return repo.ErrNotFound
+	}
+
+	delete(r.deleted, id)
+	return nil
+}
+
+func (r *deletedRepo) Find(ctx context.Context, id uuid.UUID) (*chat.Thread, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.deleted[id]; ok {
+		return nil, repo.ErrNotFound
+	}
+	return &chat.Thread{ID: id, Messages: []*chat.Message{}}, nil
+}
+
+// isDeleted reports whether the thread with id is still deleted.
+func (r *deletedRepo) isDeleted(id uuid.UUID) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.deleted[id]
+	return ok
+}
+
+func TestPurger(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	t.Run("retention cutoff", func(t *testing.T) {
+		is := is.New(t)
+
+		expired, recent := uuid.New(), uuid.New()
+		tr := &deletedRepo{deleted: map[uuid.UUID]time.Time{
+			expired: now.Add(-2 * time.Hour),
+			recent:  now.Add(-30 * time.Minute),
+		}}
+
+		start := time.Now()
+		n, err := service.NewPurger(tr, &attachmentRepo{}, nil, time.Hour).Purge(ctx)
+		is.NoErr(err)
+		is.Equal(n, 1)                  // a single thread purged
+		is.True(!tr.isDeleted(expired)) // past the retention
+		is.True(tr.isDeleted(recent))   // within it
+
+		cutoff := tr.cutoffs[0]
+		is.True(!cutoff.Before(start.Add(-time.Hour))) // an hour ago
+		is.True(!cutoff.After(time.Now().Add(-time.Hour)))
+	})
+
+	t.Run("attachments deleted", func(t *testing.T) {
+		is := is.New(t)
+
+		bs, err := storage.NewLocalBlobStore(t.TempDir(), 0)
+		is.NoErr(err)
+
+		id, other := uuid.New(), uuid.New()
+		put := func(threadID uuid.UUID, content string) *chat.Attachment {
+			b, err := bs.Put(ctx, threadID.String(), strings.NewReader(content))
+			is.NoErr(err)
+
+			a := chat.NewAttachment(threadID, "note.txt", "text/plain", b.Size)
+			a.Hash = b.Hash
+			return a
+		}
+
+		ar := &attachmentRepo{}
+		purged, kept := put(id, "hello"), put(other, "world")
+		is.NoErr(ar.Create(ctx, purged))
+		is.NoErr(ar.Create(ctx, kept))
+
+		tr := &deletedRepo{deleted: map[uuid.UUID]time.Time{id: now.Add(-2 * time.Hour)}}
+		n, err := service.NewPurger(tr, ar, bs, time.Hour).Purge(ctx)
+		is.NoErr(err)
+		is.Equal(n, 1)
+
+		_, err = bs.Open(ctx, purged.Hash)
+		is.True(errors.Is(err, storage.ErrNotFound)) // content of the thread removed
+
+		f, err := bs.Open(ctx, kept.Hash)
+		is.NoErr(err) // content of other threads kept
+		f.Close()
+	})
+
+	t.Run("failed purge skipped", func(t *testing.T) {
+		is := is.New(t)
+
+		failing, other := uuid.New(), uuid.New()
+		tr := &deletedRepo{
+			deleted: map[uuid.UUID]time.Time{
+				failing: now.Add(-2 * time.Hour),
+				other:   now.Add(-2 * time.Hour),
+			},
+			fail: map[uuid.UUID]error{failing: errors.New("database is locked")},
+		}
+
+		n, err := service.NewPurger(tr, &attachmentRepo{}, nil, time.Hour).Purge(ctx)
+		is.NoErr(err)                  // not an error of the run
+		is.Equal(n, 1)                 // the others purged
+		is.True(tr.isDeleted(failing)) // left for the next run
+		is.True(!tr.isDeleted(other))
+	})
+
+	t.Run("failed purge retried by run", func(t *testing.T) {
+		is := is.New(t)
+
+		id := uuid.New()
+		tr := &deletedRepo{
+			deleted: map[uuid.UUID]time.Time{id: now.Add(-2 * time.Hour)},
+			fail:    map[uuid.UUID]error{id: errors.New("database is locked")},
+		}
+
+		ctx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			service.NewPurger(tr, &attachmentRepo{}, nil, time.Hour).Run(ctx, 10*time.Millisecond)
+			close(done)
+		}()
+
+		deadline := time.Now().Add(time.Second)
+		for tr.isDeleted(id) && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+		<-done
+
+		is.True(!tr.isDeleted(id)) // purged on a later run
+	})
+}
+
+func TestRestoreRoute(t *testing.T) {
+	recent, expired := uuid.New(), uuid.New()
+	tr := &deletedRepo{deleted: map[uuid.UUID]time.Time{
+		recent:  time.Now().Add(-30 * time.Minute),
+		expired: time.Now().Add(-2 * time.Hour),
+	}}
+
+	srv := httptest.NewServer(service.NewService(tr, nil, nil, nil, service.WithRetention(time.Hour)))
+	t.Cleanup(srv.Close)
+
+	restore := func(t *testing.T, id uuid.UUID) *http.Response {
+		res, err := http.Post(srv.URL+"/"+id.String()+"/restore", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { res.Body.Close() })
+		return res
+	}
+
+	t.Run("within the grace window", func(t *testing.T) {
+		is := is.New(t)
+
+		res := restore(t, recent)
+		is.Equal(res.StatusCode, http.StatusOK) // restored
+
+		var body struct {
+			Chat struct {
+				ID uuid.UUID `json:"id"`
+			} `json:"chat"`
+		}
+		is.NoErr(json.NewDecoder(res.Body).Decode(&body))
+		is.Equal(body.Chat.ID, recent) // thread returned
+		is.True(!tr.isDeleted(recent)) // live again
+	})
+
+	t.Run("after the grace window", func(t *testing.T) {
+		is := is.New(t)
+
+		res := restore(t, expired)
+		is.Equal(res.StatusCode, http.StatusNotFound)                        // too late
+		is.Equal(res.Header.Get("Content-Type"), "application/problem+json") // with a problem
+		is.True(tr.isDeleted(expired))                                       // left to be purged
+	})
+}
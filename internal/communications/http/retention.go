@@ -0,0 +1,136 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	thread "com.adoublef.wss/internal/communications"
+	repo "com.adoublef.wss/internal/communications/sql"
+)
+
+// DefaultExpireBatch is how many messages are deleted per statement by
+// default, so that expiring a large backlog doesn't hold locks for long.
+const DefaultExpireBatch = 1000
+
+// Expirer deletes the messages that have outlived the retention of their
+// thread.
+type Expirer struct {
+	mr    repo.MessageRepo
+	batch int
+}
+
+func NewExpirer(mr repo.MessageRepo, batch int) *Expirer {
+	if batch <= 0 {
+		batch = DefaultExpireBatch
+	}
+
+	e := &Expirer{
+		mr:    mr,
+		batch: batch,
+	}
+
+	return e
+}
+
+// Run expires messages every interval until ctx is done.
+func (e *Expirer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := e.Expire(ctx)
+		if err != nil {
+			log.Printf("expire messages: %v\n", err)
+		}
+		if n > 0 {
+			log.Printf("expired %d messages\n", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Expire deletes the expired messages in batches and returns how many
+// were deleted.
+func (e *Expirer) Expire(ctx context.Context) (int64, error) {
+	// messages created while expiring are left for the next run
+	now := time.Now()
+
+	var total int64
+	for {
+		n, err := e.mr.DeleteExpired(ctx, now, e.batch)
+		total += n
+		if err != nil || n < int64(e.batch) {
+			return total, err
+		}
+	}
+}
+
+func (s *service) handleSetRetention() http.HandlerFunc {
+	type request struct {
+		Retention thread.Retention `json:"retention"`
+	}
+
+	type response struct {
+		Chat *thread.Thread `json:"chat"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		uid, _ := threadIDFromRequest(r)
+
+		var req request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.respondProblem(w, r, `invalid retention, want "forever" or a duration such as "30d"`, http.StatusBadRequest)
+			return
+		}
+
+		if err := s.r.SetRetention(r.Context(), uid, req.Retention); err != nil {
+			s.respondError(w, r, err)
+			return
+		}
+
+		chat, err := s.r.Find(r.Context(), uid)
+		if err != nil {
+			s.respondError(w, r, err)
+			return
+		}
+
+		s.respond(w, r, &response{
+			Chat: chat,
+		}, http.StatusOK)
+	}
+}
+
+// handleRetentionReport is a dry run of the Expirer, it reports how many
+// messages would be deleted for every retention in use.
+func (s *service) handleRetentionReport() http.HandlerFunc {
+	type response struct {
+		Now      time.Time              `json:"now"`
+		Messages int64                  `json:"messages"`
+		Policies []*repo.RetentionCount `json:"policies"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now().UTC()
+
+		counts, err := s.mr.CountExpired(r.Context(), now)
+		if err != nil {
+			s.respondError(w, r, err)
+			return
+		}
+
+		res := response{Now: now, Policies: counts}
+		for _, c := range counts {
+			res.Messages += c.Messages
+		}
+
+		s.respond(w, r, &res, http.StatusOK)
+	}
+}
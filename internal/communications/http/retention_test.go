@@ -0,0 +1,216 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hyphengolang/prelude/testing/is"
+
+	chat "com.adoublef.wss/internal/communications"
+	service "com.adoublef.wss/internal/communications/http"
+	repo "com.adoublef.wss/internal/communications/sql"
+)
+
+// expiringRepo has expired messages to delete.
+type expiringRepo struct {
+	repo.MessageRepo
+
+	// expired is the number of messages left to expire.
+	expired int64
+	// err is returned once the messages left drop to zero, if set.
+	err error
+	// nows holds the time of every DeleteExpired call.
+	nows []time.Time
+
+	counts []*repo.RetentionCount
+}
+
+func (r *expiringRepo) DeleteExpired(ctx context.Context, now time.Time, limit int) (int64, error) {
+	r.nows = append(r.nows, now)
+
+	n := int64(limit)
+	if n > r.expired {
+		n = r.expired
+	}
+	r.expired -= n
+
+	if r.expired == 0 && r.err != nil {
+		return n, r.err
+	}
+	return n, nil
+}
+
+func (r *expiringRepo) CountExpired(ctx context.Context, now time.Time) ([]*repo.RetentionCount, error) {
+	return r.counts, nil
+}
+
+func TestExpirer(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("deletes in batches", func(t *testing.T) {
+		is := is.New(t)
+
+		mr := &expiringRepo{expired: 25}
+		n, err := service.NewExpirer(mr, 10).Expire(ctx)
+		is.NoErr(err)
+		is.Equal(n, int64(25))    // every expired message
+		is.Equal(len(mr.nows), 3) // in batches of 10
+
+		for _, now := range mr.nows {
+			is.Equal(now, mr.nows[0]) // as of the same time
+		}
+	})
+
+	t.Run("full last batch", func(t *testing.T) {
+		is := is.New(t)
+
+		mr := &expiringRepo{expired: 20}
+		n, err := service.NewExpirer(mr, 10).Expire(ctx)
+		is.NoErr(err)
+		is.Equal(n, int64(20))    // every expired message
+		is.Equal(len(mr.nows), 3) // until a batch comes back short
+	})
+
+	t.Run("stops at the first error", func(t *testing.T) {
+		is := is.New(t)
+
+		errDB := errors.New("database is locked")
+		mr := &expiringRepo{expired: 15, err: errDB}
+		n, err := service.NewExpirer(mr, 10).Expire(ctx)
+		is.True(errors.Is(err, errDB)) // error returned
+		is.Equal(n, int64(15))         // along with what was deleted
+	})
+
+	t.Run("default batch", func(t *testing.T) {
+		is := is.New(t)
+
+		mr := &expiringRepo{expired: service.DefaultExpireBatch + 1}
+		_, err := service.NewExpirer(mr, 0).Expire(ctx)
+		is.NoErr(err)
+		is.Equal(len(mr.nows), 2) // batches of the default size
+	})
+}
+
+// retentionRepo keeps the retention of live threads in memory.
+type retentionRepo struct {
+	repo.ThreadRepo
+
+	threads map[uuid.UUID]chat.Retention
+}
+
+func (r *retentionRepo) SetRetention(ctx context.Context, id uuid.UUID, ret chat.Retention) error {
+	if _, ok := r.threads[id]; !ok {
+		return repo.ErrNotFound
+	}
+
+	r.threads[id] = ret
+	return nil
+}
+
+func (r *retentionRepo) Find(ctx context.Context, id uuid.UUID) (*chat.Thread, error) {
+	ret, ok := r.threads[id]
+	if !ok {
+		return nil, repo.ErrNotFound
+	}
+
+	return &chat.Thread{ID: id, Retention: ret, Messages: []*chat.Message{}}, nil
+}
+
+func TestRetentionRoutes(t *testing.T) {
+	id := uuid.New()
+	tr := &retentionRepo{threads: map[uuid.UUID]chat.Retention{id: chat.RetainForever}}
+	mr := &expiringRepo{counts: []*repo.RetentionCount{
+		{Retention: chat.RetainForever, Threads: 3},
+		{Retention: chat.Retention(time.Hour), Threads: 2, Messages: 5},
+		{Retention: chat.Retention(24 * time.Hour), Threads: 1, Messages: 7},
+	}}
+
+	srv := httptest.NewServer(service.NewService(tr, mr, nil, nil))
+	t.Cleanup(srv.Close)
+
+	setRetention := func(id, body string) *http.Response {
+		req, err := http.NewRequest(http.MethodPut, srv.URL+"/"+id+"/retention", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { res.Body.Close() })
+		return res
+	}
+
+	t.Run("set retention", func(t *testing.T) {
+		is := is.New(t)
+
+		res := setRetention(id.String(), `{"retention":"30d"}`)
+		is.Equal(res.StatusCode, http.StatusOK) // set
+
+		var body struct {
+			Chat struct {
+				Retention string `json:"retention"`
+			} `json:"chat"`
+		}
+		is.NoErr(json.NewDecoder(res.Body).Decode(&body))
+		is.Equal(body.Chat.Retention, "720h0m0s")                 // thread returned
+		is.Equal(tr.threads[id], chat.Retention(30*24*time.Hour)) // stored
+	})
+
+	tt := []struct {
+		name string
+		id   string
+		body string
+		want int
+	}{
+		{"invalid retention", id.String(), `{"retention":"1ms"}`, http.StatusBadRequest},
+		{"invalid body", id.String(), `{"retention":`, http.StatusBadRequest},
+		{"missing thread", uuid.NewString(), `{"retention":"1h"}`, http.StatusNotFound},
+		{"invalid thread id", "thread", `{"retention":"1h"}`, http.StatusBadRequest},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+
+			res := setRetention(tc.id, tc.body)
+			is.Equal(res.StatusCode, tc.want)                                    // rejected
+			is.Equal(res.Header.Get("Content-Type"), "application/problem+json") // with a problem
+		})
+	}
+
+	t.Run("report", func(t *testing.T) {
+		is := is.New(t)
+
+		res, err := http.Get(srv.URL + "/retention")
+		is.NoErr(err)
+		defer res.Body.Close()
+		is.Equal(res.StatusCode, http.StatusOK) // reported
+
+		var body struct {
+			Now      time.Time `json:"now"`
+			Messages int64     `json:"messages"`
+			Policies []struct {
+				Retention string `json:"retention"`
+				Threads   int64  `json:"threads"`
+				Messages  int64  `json:"messages"`
+			} `json:"policies"`
+		}
+		is.NoErr(json.NewDecoder(res.Body).Decode(&body))
+		is.True(!body.Now.IsZero())        // as of when
+		is.Equal(body.Messages, int64(12)) // total of every policy
+		is.Equal(len(body.Policies), 3)    // every retention in use
+		is.Equal(body.Policies[0].Retention, "forever")
+		is.Equal(body.Policies[1].Retention, "1h0m0s")
+		is.Equal(body.Policies[1].Threads, int64(2))
+		is.Equal(body.Policies[1].Messages, int64(5))
+	})
+}
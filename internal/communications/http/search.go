@@ -0,0 +1,159 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+
+	thread "com.adoublef.wss/internal/communications"
+	repo "com.adoublef.wss/internal/communications/sql"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// NewSearchService returns the handler of GET /?q=, which searches the
+// messages of the threads the user has sent messages to. The user is
+// told as set by WithIdentity, the only option it reads.
+func NewSearchService(r repo.ThreadRepo, mr repo.MessageRepo, opts ...Option) http.Handler {
+	s := &service{
+		m:        chi.NewMux(),
+		r:        r,
+		mr:       mr,
+		identify: QueryIdentity,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.m.Get("/", s.handleSearch())
+	return s
+}
+
+// searchResult is a message found by a search.
+type searchResult struct {
+	ThreadID uuid.UUID       `json:"threadId"`
+	Message  *thread.Message `json:"message"`
+	// Snippet is HTML, with the matching words in <mark> elements.
+	Snippet string `json:"snippet"`
+}
+
+type searchResponse struct {
+	Query   string          `json:"query"`
+	Results []*searchResult `json:"results"`
+	Limit   int             `json:"limit"`
+	Offset  int             `json:"offset"`
+	// Next is the offset of the next page, if any.
+	Next *int `json:"next,omitempty"`
+}
+
+// handleSearch searches the messages of the threads the user has sent
+// messages to, or only those of the thread in the path. Anonymous users
+// can't search.
+func (s *service) handleSearch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := s.identify(r)
+		if err == nil && user == "" {
+			err = errUnauthenticated
+		}
+		if err != nil {
+			s.respondError(w, r, err)
+			return
+		}
+
+		q, err := searchQuery(r)
+		if err != nil {
+			s.respondProblem(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q.Member = user
+
+		if uid, err := threadIDFromRequest(r); err == nil {
+			if _, err := s.r.FindMeta(r.Context(), uid); err != nil {
+				s.respondError(w, r, err)
+				return
+			}
+			q.ThreadID = uid
+		}
+
+		limit := q.Limit
+		// one more to know if there is a next page
+		q.Limit++
+		matches, err := s.mr.Search(r.Context(), q)
+		if err != nil {
+			s.respondError(w, r, err)
+			return
+		}
+
+		res := searchResponse{
+			Query:   q.Text,
+			Results: make([]*searchResult, 0, len(matches)),
+			Limit:   limit,
+			Offset:  q.Offset,
+		}
+		if len(matches) > limit {
+			matches = matches[:limit]
+			next := q.Offset + limit
+			res.Next = &next
+		}
+
+		for _, m := range matches {
+			res.Results = append(res.Results, &searchResult{
+				ThreadID: m.ThreadID,
+				Message:  m.Message,
+				Snippet:  highlight(m.Snippet),
+			})
+		}
+
+		s.respond(w, r, &res, http.StatusOK)
+	}
+}
+
+// searchQuery reads the q, limit and offset query parameters.
+func searchQuery(r *http.Request) (repo.MessageQuery, error) {
+	v := r.URL.Query()
+
+	q := repo.MessageQuery{
+		Text:  strings.TrimSpace(v.Get("q")),
+		Limit: defaultSearchLimit,
+	}
+	if q.Text == "" {
+		return q, errors.New("missing search query q")
+	}
+
+	if s := v.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxSearchLimit)
+		}
+		q.Limit = n
+	}
+
+	if s := v.Get("offset"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return q, errors.New("offset must be positive")
+		}
+		q.Offset = n
+	}
+
+	return q, nil
+}
+
+// highlight escapes a snippet so that it can be shown as HTML, the
+// matching words being put in <mark> elements.
+func highlight(snippet string) string {
+	return strings.NewReplacer(
+		repo.HighlightStart, "<mark>",
+		repo.HighlightStop, "</mark>",
+	).Replace(html.EscapeString(snippet))
+}
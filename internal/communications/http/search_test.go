@@ -0,0 +1,92 @@
+package service_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/hyphengolang/prelude/testing/is"
+
+	service "com.adoublef.wss/internal/communications/http"
+	repo "com.adoublef.wss/internal/communications/sql"
+)
+
+// searchRepo keeps the last query it was asked to search.
+type searchRepo struct {
+	repo.MessageRepo
+
+	query repo.MessageQuery
+}
+
+func (r *searchRepo) Search(ctx context.Context, q repo.MessageQuery) ([]*repo.MessageMatch, error) {
+	r.query = q
+	return nil, nil
+}
+
+func TestSearch(t *testing.T) {
+	search := func(t *testing.T, h http.Handler, path string, header http.Header) *http.Response {
+		srv := httptest.NewServer(h)
+		t.Cleanup(srv.Close)
+
+		req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { res.Body.Close() })
+		return res
+	}
+
+	t.Run("scoped to the user", func(t *testing.T) {
+		is := is.New(t)
+
+		mr := &searchRepo{}
+		res := search(t, service.NewSearchService(&threadRepo{}, mr), "/?q=fox&user=ann", nil)
+		is.Equal(res.StatusCode, http.StatusOK) // searched
+		is.Equal(mr.query.Member, "ann")        // threads of the user
+		is.Equal(mr.query.ThreadID, uuid.Nil)   // every one of them
+	})
+
+	t.Run("anonymous", func(t *testing.T) {
+		is := is.New(t)
+
+		mr := &searchRepo{}
+		res := search(t, service.NewSearchService(&threadRepo{}, mr), "/?q=fox", nil)
+		is.Equal(res.StatusCode, http.StatusUnauthorized) // rejected
+		is.Equal(mr.query.Text, "")                       // not searched
+	})
+
+	t.Run("header identity", func(t *testing.T) {
+		is := is.New(t)
+
+		mr := &searchRepo{}
+		h := service.NewSearchService(&threadRepo{}, mr, service.WithIdentity(service.HeaderIdentity("X-User")))
+
+		res := search(t, h, "/?q=fox&user=ann", nil)
+		is.Equal(res.StatusCode, http.StatusUnauthorized) // query not trusted
+
+		res = search(t, h, "/?q=fox", http.Header{"X-User": {"bob"}})
+		is.Equal(res.StatusCode, http.StatusOK) // searched
+		is.Equal(mr.query.Member, "bob")        // as told by the proxy
+	})
+
+	t.Run("within a thread", func(t *testing.T) {
+		is := is.New(t)
+
+		id := uuid.New()
+		mr := &searchRepo{}
+		res := search(t, service.NewService(&threadRepo{}, mr, nil, nil), "/"+id.String()+"/messages/search?q=fox&user=ann", nil)
+		is.Equal(res.StatusCode, http.StatusOK) // searched
+		is.Equal(mr.query.ThreadID, id)         // the thread
+		is.Equal(mr.query.Member, "ann")        // if the user is in it
+	})
+}
@@ -4,33 +4,95 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
 	"github.com/google/uuid"
 
 	thread "com.adoublef.wss/internal/communications"
-	repo "com.adoublef.wss/internal/communications/sql/postgres"
+	repo "com.adoublef.wss/internal/communications/sql"
+	websocket "com.adoublef.wss/internal/http/websocket/gobwas"
+	"com.adoublef.wss/internal/storage"
 )
 
 var _ http.Handler = (*service)(nil)
 
 type service struct {
-	r repo.ThreadRepo
-	m chi.Router
+	r  repo.ThreadRepo
+	mr repo.MessageRepo
+	ar repo.AttachmentRepo
+	bs storage.BlobStore
+	m  chi.Router
 
 	br thread.Broker
+	// retention is how long a deleted thread can be restored for.
+	retention time.Duration
+	// wsOpts are added to the options of every thread's socket.
+	wsOpts []websocket.Option
+	// identify tells who makes a request.
+	identify Identity
 }
 
 func (s *service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.m.ServeHTTP(w, r)
 }
 
-func NewService(r repo.ThreadRepo) http.Handler {
+// DefaultRetention is how long deleted threads are kept by default.
+const DefaultRetention = 30 * 24 * time.Hour
+
+type Option func(s *service)
+
+// WithRetention sets how long a deleted thread can be restored for. It
+// should match the retention of the Purger.
+func WithRetention(d time.Duration) Option {
+	return func(s *service) {
+		s.retention = d
+	}
+}
+
+// WithBroker sets where the live threads are kept, by default a
+// thread.Registry that never evicts them.
+func WithBroker(br thread.Broker) Option {
+	return func(s *service) {
+		s.br = br
+	}
+}
+
+// WithSocketOptions adds options to the socket of every thread, such as
+// websocket.WithPoller.
+func WithSocketOptions(opts ...websocket.Option) Option {
+	return func(s *service) {
+		s.wsOpts = append(s.wsOpts, opts...)
+	}
+}
+
+// WithIdentity sets how the user making a request is told, by default
+// QueryIdentity.
+func WithIdentity(id Identity) Option {
+	return func(s *service) {
+		s.identify = id
+	}
+}
+
+func NewService(r repo.ThreadRepo, mr repo.MessageRepo, ar repo.AttachmentRepo, bs storage.BlobStore, opts ...Option) http.Handler {
 	s := &service{
-		m:  chi.NewMux(),
-		r:  r,
-		br: thread.NewBroker(),
+		m:         chi.NewMux(),
+		r:         r,
+		mr:        mr,
+		ar:        ar,
+		bs:        bs,
+		br:        thread.NewRegistry(),
+		retention: DefaultRetention,
+		identify:  QueryIdentity,
+	}
+
+	for _, opt := range opts {
+		opt(s)
 	}
 
 	s.routes()
@@ -40,11 +102,20 @@ func NewService(r repo.ThreadRepo) http.Handler {
 func (s *service) routes() {
 	s.m.Post("/", s.handleCreateChat())
 	s.m.Get("/", s.handleListChats())
+	s.m.Get("/retention", s.handleRetentionReport())
+	s.m.Post("/import", s.handleImport())
 
-	s.m.With(threadIDMiddleware).Route("/{id}", func(r chi.Router) {
+	s.m.With(s.threadIDMiddleware).Route("/{id}", func(r chi.Router) {
 		r.Get("/", s.handleChatInfo())
 		r.Delete("/", s.handleDeleteChat())
+		r.Post("/restore", s.handleRestoreChat())
+		r.Put("/retention", s.handleSetRetention())
+		r.Get("/messages/search", s.handleSearch())
+		r.Get("/export", s.handleExport())
 		r.Get("/ws", s.handleP2PConn())
+		r.Post("/notify", s.handleNotify())
+		r.Post("/attachments", s.handleCreateAttachment())
+		r.Get("/attachments/{aid}", s.handleGetAttachment())
 	})
 }
 
@@ -59,7 +130,7 @@ const (
 	apiVersionKey contextKey = "apiVersion"
 )
 
-func threadIDMiddleware(hf http.Handler) http.Handler {
+func (s *service) threadIDMiddleware(hf http.Handler) http.Handler {
 	parseID := func(r *http.Request) (uuid.UUID, error) {
 		return uuid.Parse(chi.URLParam(r, "id"))
 	}
@@ -67,7 +138,7 @@ func threadIDMiddleware(hf http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		id, err := parseID(r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			s.respondProblem(w, r, "invalid chat id", http.StatusBadRequest)
 			return
 		}
 
@@ -89,18 +160,185 @@ func threadIDFromContext(ctx context.Context) (uuid.UUID, error) {
 	return id, nil
 }
 
+var errUnauthenticated = errors.New("user not authenticated")
+
+// Identity returns the user making a request. Whispers and notifications
+// addressed to a user reach the sockets opened under that name.
+type Identity func(r *http.Request) (string, error)
+
+// QueryIdentity takes the user as is from the user query parameter, it
+// may be empty. Nothing checks it, anyone can claim any name and read
+// what is sent to it, so the names are advisory only.
+func QueryIdentity(r *http.Request) (string, error) {
+	return r.URL.Query().Get("user"), nil
+}
+
+// HeaderIdentity takes the user from the header key, as set by an
+// authenticating proxy in front of the service. The proxy must drop the
+// header from the requests it receives. Requests without it are rejected.
+func HeaderIdentity(key string) Identity {
+	return func(r *http.Request) (string, error) {
+		user := r.Header.Get(key)
+		if user == "" {
+			return "", errUnauthenticated
+		}
+		return user, nil
+	}
+}
+
 func (s *service) handleP2PConn() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		uid, _ := threadIDFromRequest(r)
-		// NOTE lookup cache first, then db
-		thread, err := s.r.Find(r.Context(), uid)
+
+		user, err := s.identify(r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusNotFound)
+			s.respondError(w, r, err)
+			return
+		}
+
+		thread, release, err := s.liveThread(uid)
+		if err != nil {
+			s.respondError(w, r, err)
+			return
+		}
+		defer release()
+
+		ctx := websocket.NewContext(r.Context(), user)
+		thread.Client().ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// Time allowed to load a thread that isn't live yet.
+const threadLoadTimeout = 5 * time.Second
+
+// liveThread returns a thread along with its hub, the repository is only
+// used if the thread isn't live already. Joins racing for the same thread
+// share one load and one hub. release must be called once the hub has
+// been joined.
+func (s *service) liveThread(uid uuid.UUID) (*thread.Thread, func(), error) {
+	return s.br.Acquire(uid.String(), func() (*thread.Thread, error) {
+		// the load is shared so it doesn't belong to any one request
+		ctx, cancel := context.WithTimeout(context.Background(), threadLoadTimeout)
+		defer cancel()
+
+		thr, err := s.r.FindMeta(ctx, uid)
+		if err != nil {
+			return nil, err
+		}
+
+		thr.SetClient(websocket.NewClient(s.clientOptions(uid)...))
+		return thr, nil
+	})
+}
+
+const (
+	// whisperPrefix starts a private message, as in "/w alice hello".
+	whisperPrefix = "/w "
+	// Largest message, or attachment chunk, accepted from a peer.
+	maxMessageSize = 1 << 20
+)
+
+// clientOptions configures the socket of the thread with the given id.
+func (s *service) clientOptions(threadID uuid.UUID) []websocket.Option {
+	u := newUploads(s.bs)
+
+	handleMessage := func(cli *websocket.Client, from websocket.Peer, msg *wsutil.Message) {
+		if msg.OpCode == ws.OpBinary {
+			s.handleAttachmentFrame(cli, u, threadID, from, msg.Payload)
+			return
+		}
+
+		if !strings.HasPrefix(string(msg.Payload), whisperPrefix) {
+			// whispers are private, only what the thread sees is kept
+			s.storeMessage(threadID, from.User, string(msg.Payload))
+		}
+		handleTextMessage(cli, from, msg)
+	}
+
+	handleDisconnect := func(p websocket.Peer, reason websocket.CloseReason) {
+		u.discard(p.ID)
+	}
+
+	opts := []websocket.Option{
+		websocket.WithMessageHandler(handleMessage),
+		websocket.WithDisconnectHandler(handleDisconnect),
+		websocket.WithMaxMessageSize(maxMessageSize),
+	}
+
+	return append(opts, s.wsOpts...)
+}
+
+// Time allowed to store a message, the read loop of the sender waits for
+// it.
+const messageStoreTimeout = 2 * time.Second
+
+// storeMessage keeps a message sent to a thread. It is still delivered if
+// it could not be stored.
+func (s *service) storeMessage(threadID uuid.UUID, sender, content string) {
+	// the socket has no request context to store with
+	ctx, cancel := context.WithTimeout(context.Background(), messageStoreTimeout)
+	defer cancel()
+
+	msg := thread.NewMessage(&thread.Thread{ID: threadID}, content)
+	msg.Sender = sender
+	if err := s.mr.Create(ctx, msg); err != nil {
+		log.Printf("store message in %s: %v\n", threadID, err)
+	}
+}
+
+// handleTextMessage routes text messages received on a thread's socket.
+// Whispers are only sent to their recipient and the sender, everything
+// else is sent to the rest of the thread, the sender already has it.
+func handleTextMessage(cli *websocket.Client, from websocket.Peer, msg *wsutil.Message) {
+	if !strings.HasPrefix(string(msg.Payload), whisperPrefix) {
+		cli.BroadcastExcept(from.ID, msg)
+		return
+	}
+
+	to, text, ok := strings.Cut(strings.TrimPrefix(string(msg.Payload), whisperPrefix), " ")
+	if !ok || to == "" {
+		return
+	}
+
+	whisper := &wsutil.Message{OpCode: ws.OpText, Payload: []byte(from.User + " whispers: " + text)}
+	cli.SendToUser(to, whisper)
+	if from.User != to {
+		cli.SendTo(from.ID, whisper)
+	}
+}
+
+func (s *service) handleNotify() http.HandlerFunc {
+	type request struct {
+		// User receives the notification, it is sent to the whole
+		// thread when empty.
+		User    string `json:"user"`
+		Content string `json:"content"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		uid, _ := threadIDFromRequest(r)
+
+		var req request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.respondProblem(w, r, "invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		// only threads with live connections have someone to notify
+		thread, ok := s.br.Load(uid.String())
+		if !ok {
+			s.respond(w, r, nil, http.StatusAccepted)
 			return
 		}
-		// NOTE this may be risky
-		thread, _ = s.br.LoadOrStore(uid.String(), thread)
-		thread.Client().ServeHTTP(w, r)
+
+		msg := &wsutil.Message{OpCode: ws.OpText, Payload: []byte(req.Content)}
+		if req.User != "" {
+			thread.Client().SendToUser(req.User, msg)
+		} else {
+			thread.Client().Broadcast(msg)
+		}
+
+		s.respond(w, r, nil, http.StatusAccepted)
 	}
 }
 
@@ -109,7 +347,7 @@ func (s *service) handleDeleteChat() http.HandlerFunc {
 		uid, _ := threadIDFromRequest(r)
 
 		if err := s.r.Delete(r.Context(), uid); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			s.respondError(w, r, err)
 			return
 		}
 		// NOTE async deletion is ok
@@ -119,6 +357,31 @@ func (s *service) handleDeleteChat() http.HandlerFunc {
 	}
 }
 
+func (s *service) handleRestoreChat() http.HandlerFunc {
+	type response struct {
+		Chat *thread.Thread `json:"chat"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		uid, _ := threadIDFromRequest(r)
+
+		if err := s.r.Restore(r.Context(), uid, time.Now().Add(-s.retention)); err != nil {
+			s.respondError(w, r, err)
+			return
+		}
+
+		chat, err := s.r.Find(r.Context(), uid)
+		if err != nil {
+			s.respondError(w, r, err)
+			return
+		}
+
+		s.respond(w, r, &response{
+			Chat: chat,
+		}, http.StatusOK)
+	}
+}
+
 func (s *service) handleCreateChat() http.HandlerFunc {
 	type response struct {
 		Location string `json:"location"`
@@ -130,12 +393,10 @@ func (s *service) handleCreateChat() http.HandlerFunc {
 		thread := thread.NewThread()
 
 		if err := s.r.Create(r.Context(), thread); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			s.respondError(w, r, err)
 			return
 		}
 
-		s.br.Store(thread.ID.String(), thread)
-
 		s.respond(w, r, &response{
 			// TODO use the real host + path
 			Location: "http://localhost:8080/" + thread.ID.String(),
@@ -153,7 +414,7 @@ func (s *service) handleChatInfo() http.HandlerFunc {
 
 		chat, err := s.r.Find(r.Context(), uid)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusNotFound)
+			s.respondError(w, r, err)
 			return
 		}
 
@@ -172,7 +433,7 @@ func (s *service) handleListChats() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		cs, err := s.r.FindMany(r.Context())
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			s.respondError(w, r, err)
 			return
 		}
 
@@ -189,7 +450,8 @@ func (s *service) respond(w http.ResponseWriter, r *http.Request, data any, stat
 	if data != nil {
 		err := json.NewEncoder(w).Encode(data)
 		if err != nil {
-			http.Error(w, "Could not encode in json", status)
+			// the status has already been sent
+			log.Printf("could not encode response: %v\n", err)
 		}
 	}
 }
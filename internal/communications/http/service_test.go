@@ -0,0 +1,260 @@
+package service_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/google/uuid"
+	"github.com/hyphengolang/prelude/testing/is"
+
+	chat "com.adoublef.wss/internal/communications"
+	service "com.adoublef.wss/internal/communications/http"
+	repo "com.adoublef.wss/internal/communications/sql"
+	"com.adoublef.wss/internal/storage"
+)
+
+// threadRepo counts the threads loaded from it, the other methods are
+// not used by the socket and attachment routes.
+type threadRepo struct {
+	repo.ThreadRepo
+	finds atomic.Int32
+}
+
+func (r *threadRepo) FindMeta(ctx context.Context, id uuid.UUID) (*chat.Thread, error) {
+	r.finds.Add(1)
+	// give racing joins time to pile up
+	time.Sleep(10 * time.Millisecond)
+	return &chat.Thread{ID: id, CreatedAt: time.Now()}, nil
+}
+
+func (r *threadRepo) Find(ctx context.Context, id uuid.UUID) (*chat.Thread, error) {
+	return &chat.Thread{ID: id, CreatedAt: time.Now()}, nil
+}
+
+// peers waits a little for a thread to have want peers, as the dial may
+// return just before the server counts the connection.
+func peers(thread *chat.Thread, want int) int {
+	deadline := time.Now().Add(time.Second)
+	for thread.Client().Len() != want && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	return thread.Client().Len()
+}
+
+func TestJoin(t *testing.T) {
+	is := is.New(t)
+
+	var (
+		tr  = &threadRepo{}
+		reg = chat.NewRegistry()
+		id  = uuid.New()
+	)
+	srv := httptest.NewServer(service.NewService(tr, nil, nil, nil, service.WithBroker(reg)))
+	t.Cleanup(srv.Close)
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/" + id.String() + "/ws"
+	join := func(n int) {
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				conn, _, _, err := ws.Dial(context.Background(), url)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				t.Cleanup(func() { conn.Close() })
+			}()
+		}
+		wg.Wait()
+	}
+
+	t.Run("concurrent joins share one hub", func(t *testing.T) {
+		join(20)
+
+		is.Equal(tr.finds.Load(), int32(1)) // thread should be loaded once
+		is.Equal(reg.Len(), 1)              // thread should be live once
+
+		thread, ok := reg.Load(id.String())
+		is.True(ok)                     // thread should be live
+		is.Equal(peers(thread, 20), 20) // every peer should be in the same room
+	})
+
+	t.Run("live thread is not loaded again", func(t *testing.T) {
+		join(5)
+
+		is.Equal(tr.finds.Load(), int32(1)) // live thread should come from the registry
+
+		thread, _ := reg.Load(id.String())
+		is.Equal(peers(thread, 25), 25) // new peers should join the same room
+	})
+}
+
+// messageRepo drops the messages stored in it, after sending them to
+// stored if set.
+type messageRepo struct {
+	repo.MessageRepo
+
+	stored chan<- storedMessage
+}
+
+type storedMessage struct {
+	msg *chat.Message
+	// deadline is when the store times out.
+	deadline time.Time
+}
+
+func (r messageRepo) Create(ctx context.Context, msg *chat.Message) error {
+	if r.stored != nil {
+		deadline, _ := ctx.Deadline()
+		r.stored <- storedMessage{msg: msg, deadline: deadline}
+	}
+	return nil
+}
+
+// chatServer serves a single thread.
+type chatServer struct {
+	t *testing.T
+	// base is the http URL of the service, url the websocket one.
+	base, url string
+	reg       *chat.Registry
+	id        uuid.UUID
+}
+
+func newChatServer(t *testing.T, ar repo.AttachmentRepo, bs storage.BlobStore, opts ...service.Option) *chatServer {
+	return newChatServerWith(t, messageRepo{}, ar, bs, opts...)
+}
+
+func newChatServerWith(t *testing.T, mr repo.MessageRepo, ar repo.AttachmentRepo, bs storage.BlobStore, opts ...service.Option) *chatServer {
+	reg := chat.NewRegistry()
+	h := service.NewService(&threadRepo{}, mr, ar, bs, append(opts, service.WithBroker(reg))...)
+
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	return &chatServer{t: t, base: srv.URL, url: "ws" + strings.TrimPrefix(srv.URL, "http"), reg: reg, id: uuid.New()}
+}
+
+// dial joins the thread with the given query and headers, and waits for
+// the thread to count want peers.
+func (s *chatServer) dial(query string, h http.Header, want int) (net.Conn, error) {
+	d := ws.Dialer{Header: ws.HandshakeHeaderHTTP(h)}
+	conn, _, _, err := d.Dial(context.Background(), s.url+"/"+s.id.String()+"/ws"+query)
+	if err != nil {
+		return nil, err
+	}
+	s.t.Cleanup(func() { conn.Close() })
+
+	thread, _ := s.reg.Load(s.id.String())
+	if peers(thread, want) != want {
+		s.t.Fatalf("got %d peers, want %d", thread.Client().Len(), want)
+	}
+	return conn, nil
+}
+
+// read returns the next text message of conn, or an error if none came
+// within wait.
+func read(conn net.Conn, wait time.Duration) (string, error) {
+	conn.SetReadDeadline(time.Now().Add(wait))
+	defer conn.SetReadDeadline(time.Time{})
+
+	b, err := wsutil.ReadServerText(conn)
+	return string(b), err
+}
+
+func TestChat(t *testing.T) {
+	t.Run("messages are not sent back to the sender", func(t *testing.T) {
+		is := is.New(t)
+
+		s := newChatServer(t, nil, nil)
+		ann, err := s.dial("?user=ann", nil, 1)
+		is.NoErr(err) // ann joins
+		bob, err := s.dial("?user=bob", nil, 2)
+		is.NoErr(err) // bob joins
+
+		is.NoErr(wsutil.WriteClientText(ann, []byte("hello")))
+
+		msg, err := read(bob, time.Second)
+		is.NoErr(err)          // bob gets the message
+		is.Equal(msg, "hello") // as sent
+
+		_, err = read(ann, 50*time.Millisecond)
+		var ne net.Error
+		is.True(errors.As(err, &ne) && ne.Timeout()) // ann doesn't get it back
+	})
+
+	t.Run("messages are stored in time", func(t *testing.T) {
+		is := is.New(t)
+
+		stored := make(chan storedMessage, 2)
+		s := newChatServerWith(t, messageRepo{stored: stored}, nil, nil)
+		ann, err := s.dial("?user=ann", nil, 1)
+		is.NoErr(err) // ann joins
+
+		is.NoErr(wsutil.WriteClientText(ann, []byte("/w bob psst")))
+		is.NoErr(wsutil.WriteClientText(ann, []byte("hello")))
+
+		select {
+		case m := <-stored:
+			is.Equal(m.msg.Content, "hello") // whispers aren't stored
+			is.Equal(m.msg.Sender, "ann")    // from the sender
+			is.True(!m.deadline.IsZero())    // the read loop isn't held up for good
+		case <-time.After(time.Second):
+			t.Fatal("message not stored")
+		}
+	})
+
+	t.Run("query identity is advisory", func(t *testing.T) {
+		is := is.New(t)
+
+		s := newChatServer(t, nil, nil)
+		ann, err := s.dial("?user=ann", nil, 1)
+		is.NoErr(err) // ann joins
+		bob, err := s.dial("?user=bob", nil, 2)
+		is.NoErr(err) // bob joins
+		eve, err := s.dial("?user=bob", nil, 3)
+		is.NoErr(err) // eve joins claiming to be bob
+
+		is.NoErr(wsutil.WriteClientText(ann, []byte("/w bob psst")))
+
+		for _, conn := range []net.Conn{ann, bob, eve} {
+			msg, err := read(conn, time.Second)
+			is.NoErr(err)                       // whisper delivered
+			is.Equal(msg, "ann whispers: psst") // to the sender and every "bob"
+		}
+	})
+
+	t.Run("header identity", func(t *testing.T) {
+		is := is.New(t)
+
+		s := newChatServer(t, nil, nil, service.WithIdentity(service.HeaderIdentity("X-User")))
+
+		_, err := s.dial("?user=ann", nil, 0)
+		is.Equal(err, ws.StatusError(http.StatusUnauthorized)) // no header, the query isn't trusted
+
+		ann, err := s.dial("", http.Header{"X-User": {"ann"}}, 1)
+		is.NoErr(err) // ann joins
+		eve, err := s.dial("?user=bob", http.Header{"X-User": {"eve"}}, 2)
+		is.NoErr(err) // eve can't claim to be bob
+
+		is.NoErr(wsutil.WriteClientText(ann, []byte("/w bob psst")))
+		is.NoErr(wsutil.WriteClientText(ann, []byte("/w eve hi")))
+
+		msg, err := read(eve, time.Second)
+		is.NoErr(err)                     // eve gets the whisper to eve
+		is.Equal(msg, "ann whispers: hi") // not the one to bob
+	})
+}
@@ -0,0 +1,355 @@
+package chat
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Registry holds the threads that are live on this server. It is a Broker
+// that also evicts threads, either the least recently used ones once it
+// holds too many or those that have had no peers for a while. Threads
+// with peers are never evicted to make room, so the registry may go over
+// its limit while they are all in use.
+//
+// Evicting or deleting a thread stops its hub before the eviction
+// handlers are called. Threads held by Acquire are not idle, which keeps
+// them from being evicted between being found and being joined.
+type Registry struct {
+	mu sync.Mutex
+	m  map[string]*list.Element
+	// ll is ordered from most to least recently used.
+	ll *list.List
+	// calls are the loads of Acquire in progress.
+	calls map[string]*registryCall
+
+	maxThreads  int
+	idleTimeout time.Duration
+	onEvict     []func(id string, thread *Thread)
+}
+
+type registryEntry struct {
+	id     string
+	thread *Thread
+	// stored is when the thread was added, used as its idle time until
+	// it has a client.
+	stored time.Time
+	// holds counts the callers of Acquire that have yet to release the
+	// thread, it is not idle while they do.
+	holds int
+}
+
+// ErrLoadPanicked is returned by Acquire to the callers that waited on a
+// load that panicked.
+var ErrLoadPanicked = errors.New("thread load panicked")
+
+type registryCall struct {
+	done chan struct{}
+	err  error
+}
+
+// RegistryOption configures a Registry.
+type RegistryOption func(r *Registry)
+
+// WithMaxThreads sets how many threads are kept before the least recently
+// used idle ones are evicted. Zero means no limit.
+func WithMaxThreads(n int) RegistryOption {
+	return func(r *Registry) {
+		r.maxThreads = n
+	}
+}
+
+// WithIdleTimeout sets how long a thread is kept without peers before
+// Sweep evicts it. Zero means threads are never evicted for being idle.
+func WithIdleTimeout(d time.Duration) RegistryOption {
+	return func(r *Registry) {
+		r.idleTimeout = d
+	}
+}
+
+// WithEvictHandler adds a function called with every thread that is
+// evicted or deleted, after its hub has been stopped.
+func WithEvictHandler(f func(id string, thread *Thread)) RegistryOption {
+	return func(r *Registry) {
+		r.onEvict = append(r.onEvict, f)
+	}
+}
+
+func NewRegistry(opts ...RegistryOption) *Registry {
+	r := &Registry{
+		m:     make(map[string]*list.Element),
+		ll:    list.New(),
+		calls: make(map[string]*registryCall),
+	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r
+}
+
+func (r *Registry) Load(id string) (*Thread, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	el, ok := r.m[id]
+	if !ok {
+		return nil, false
+	}
+
+	r.ll.MoveToFront(el)
+	return el.Value.(*registryEntry).thread, true
+}
+
+func (r *Registry) LoadOrStore(id string, thread *Thread) (*Thread, bool) {
+	r.mu.Lock()
+	if el, ok := r.m[id]; ok {
+		r.ll.MoveToFront(el)
+		r.mu.Unlock()
+		return el.Value.(*registryEntry).thread, true
+	}
+
+	evicted := r.insert(id, thread)
+	r.mu.Unlock()
+
+	r.evict(evicted...)
+	return thread, false
+}
+
+func (r *Registry) Acquire(id string, load func() (*Thread, error)) (*Thread, func(), error) {
+	r.mu.Lock()
+	for {
+		if el, ok := r.m[id]; ok {
+			r.ll.MoveToFront(el)
+			e := el.Value.(*registryEntry)
+			e.holds++
+			r.mu.Unlock()
+			return e.thread, r.releaser(e), nil
+		}
+
+		c, ok := r.calls[id]
+		if !ok {
+			break
+		}
+
+		// wait for the load in progress and look again
+		r.mu.Unlock()
+		<-c.done
+		if c.err != nil {
+			return nil, nil, c.err
+		}
+		r.mu.Lock()
+	}
+
+	c := &registryCall{done: make(chan struct{})}
+	r.calls[id] = c
+	r.mu.Unlock()
+
+	loaded := false
+	defer func() {
+		if loaded {
+			return
+		}
+
+		// load panicked, the waiters must not block on it forever
+		r.mu.Lock()
+		delete(r.calls, id)
+		c.err = ErrLoadPanicked
+		close(c.done)
+		r.mu.Unlock()
+	}()
+
+	thread, err := load()
+	loaded = true
+
+	r.mu.Lock()
+	delete(r.calls, id)
+	c.err = err
+	close(c.done)
+	if err != nil {
+		r.mu.Unlock()
+		return nil, nil, err
+	}
+
+	evicted := r.insert(id, thread)
+	e := r.m[id].Value.(*registryEntry)
+	e.holds++
+	r.mu.Unlock()
+
+	r.evict(evicted...)
+	return thread, r.releaser(e), nil
+}
+
+func (r *Registry) releaser(e *registryEntry) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			r.mu.Lock()
+			e.holds--
+			r.mu.Unlock()
+		})
+	}
+}
+
+// Store adds a thread, replacing and evicting the one stored under the
+// same id.
+func (r *Registry) Store(id string, thread *Thread) {
+	r.mu.Lock()
+	var evicted []*registryEntry
+	if el, ok := r.m[id]; ok {
+		e := el.Value.(*registryEntry)
+		if e.thread == thread {
+			r.ll.MoveToFront(el)
+			r.mu.Unlock()
+			return
+		}
+
+		r.remove(el)
+		evicted = append(evicted, e)
+	}
+	evicted = append(evicted, r.insert(id, thread)...)
+	r.mu.Unlock()
+
+	r.evict(evicted...)
+}
+
+// Delete removes a thread and stops its hub.
+func (r *Registry) Delete(id string) {
+	r.mu.Lock()
+	el, ok := r.m[id]
+	if ok {
+		r.remove(el)
+	}
+	r.mu.Unlock()
+
+	if ok {
+		r.evict(el.Value.(*registryEntry))
+	}
+}
+
+// Range calls f for every thread, from the most to the least recently
+// used, until f returns false. It works on a snapshot so f may use the
+// registry.
+func (r *Registry) Range(f func(id string, thread *Thread) bool) {
+	r.mu.Lock()
+	es := make([]*registryEntry, 0, r.ll.Len())
+	for el := r.ll.Front(); el != nil; el = el.Next() {
+		es = append(es, el.Value.(*registryEntry))
+	}
+	r.mu.Unlock()
+
+	for _, e := range es {
+		if !f(e.id, e.thread) {
+			return
+		}
+	}
+}
+
+func (r *Registry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.ll.Len()
+}
+
+// Sweep evicts the threads that have been without peers for longer than
+// the idle timeout and returns how many were evicted.
+func (r *Registry) Sweep(now time.Time) int {
+	if r.idleTimeout <= 0 {
+		return 0
+	}
+
+	r.mu.Lock()
+	var evicted []*registryEntry
+	for el := r.ll.Back(); el != nil; {
+		prev := el.Prev()
+
+		e := el.Value.(*registryEntry)
+		if since, ok := e.idleSince(); ok && now.Sub(since) > r.idleTimeout {
+			r.remove(el)
+			evicted = append(evicted, e)
+		}
+
+		el = prev
+	}
+	r.mu.Unlock()
+
+	r.evict(evicted...)
+	return len(evicted)
+}
+
+// Run sweeps every interval until ctx is done.
+func (r *Registry) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.Sweep(now)
+		}
+	}
+}
+
+// insert adds a thread and, if the registry is over its limit, removes
+// the least recently used idle threads, which are returned to be evicted.
+// r.mu must be held.
+func (r *Registry) insert(id string, thread *Thread) []*registryEntry {
+	r.m[id] = r.ll.PushFront(&registryEntry{id: id, thread: thread, stored: time.Now()})
+
+	if r.maxThreads <= 0 {
+		return nil
+	}
+
+	var evicted []*registryEntry
+	for el := r.ll.Back(); el != nil && r.ll.Len() > r.maxThreads; {
+		prev := el.Prev()
+
+		e := el.Value.(*registryEntry)
+		if _, idle := e.idleSince(); idle && e.id != id {
+			r.remove(el)
+			evicted = append(evicted, e)
+		}
+
+		el = prev
+	}
+
+	return evicted
+}
+
+// remove must be called with r.mu held.
+func (r *Registry) remove(el *list.Element) {
+	r.ll.Remove(el)
+	delete(r.m, el.Value.(*registryEntry).id)
+}
+
+// evict stops the hubs of removed threads and calls the eviction
+// handlers. It must be called without r.mu held.
+func (r *Registry) evict(es ...*registryEntry) {
+	for _, e := range es {
+		e.thread.Close()
+
+		for _, f := range r.onEvict {
+			f(e.id, e.thread)
+		}
+	}
+}
+
+// idleSince must be called with r.mu held.
+func (e *registryEntry) idleSince() (time.Time, bool) {
+	if e.holds > 0 {
+		return time.Time{}, false
+	}
+
+	cli := e.thread.client()
+	if cli == nil {
+		return e.stored, true
+	}
+
+	return cli.IdleSince()
+}
@@ -0,0 +1,282 @@
+package chat_test
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/hyphengolang/prelude/testing/is"
+
+	chat "com.adoublef.wss/internal/communications"
+)
+
+func TestRegistry(t *testing.T) {
+	t.Run("load missing thread", func(t *testing.T) {
+		is := is.New(t)
+
+		r := chat.NewRegistry()
+		thread, ok := r.Load("missing")
+		is.True(!ok)           // missing thread should not be found
+		is.True(thread == nil) // missing thread should be nil
+	})
+
+	t.Run("load or store", func(t *testing.T) {
+		is := is.New(t)
+
+		r := chat.NewRegistry()
+		first, second := chat.NewThread(), chat.NewThread()
+
+		actual, loaded := r.LoadOrStore("a", first)
+		is.True(!loaded) // thread should be stored
+		is.True(actual == first)
+
+		actual, loaded = r.LoadOrStore("a", second)
+		is.True(loaded)          // thread should be loaded
+		is.True(actual == first) // stored thread should be kept
+		is.Equal(r.Len(), 1)
+	})
+
+	t.Run("range from most recently used", func(t *testing.T) {
+		is := is.New(t)
+
+		r := chat.NewRegistry()
+		for _, id := range []string{"a", "b", "c"} {
+			r.Store(id, chat.NewThread())
+		}
+		r.Load("a")
+
+		var ids []string
+		r.Range(func(id string, _ *chat.Thread) bool {
+			ids = append(ids, id)
+			return len(ids) < 2
+		})
+		is.Equal(ids, []string{"a", "c"}) // range should stop when f returns false
+	})
+
+	t.Run("evict least recently used", func(t *testing.T) {
+		is := is.New(t)
+
+		var evicted []string
+		r := chat.NewRegistry(
+			chat.WithMaxThreads(2),
+			chat.WithEvictHandler(func(id string, _ *chat.Thread) { evicted = append(evicted, id) }),
+		)
+		r.Store("a", chat.NewThread())
+		r.Store("b", chat.NewThread())
+		r.Load("a")
+		r.Store("c", chat.NewThread())
+
+		is.Equal(r.Len(), 2)
+		is.Equal(evicted, []string{"b"}) // least recently used thread should be evicted
+		_, ok := r.Load("b")
+		is.True(!ok) // evicted thread should be gone
+	})
+
+	t.Run("evict idle threads", func(t *testing.T) {
+		is := is.New(t)
+
+		var evicted []string
+		r := chat.NewRegistry(
+			chat.WithIdleTimeout(time.Minute),
+			chat.WithEvictHandler(func(id string, _ *chat.Thread) { evicted = append(evicted, id) }),
+		)
+
+		thread := chat.NewThread()
+		cli := thread.Client()
+		r.Store("a", thread)
+
+		is.Equal(r.Sweep(time.Now()), 0)                    // thread is not idle for long enough
+		is.Equal(r.Sweep(time.Now().Add(2*time.Minute)), 1) // idle thread should be evicted
+		is.Equal(evicted, []string{"a"})
+		is.Equal(r.Len(), 0)
+
+		// the hub is stopped so sends don't block
+		cli.Broadcast(&wsutil.Message{OpCode: ws.OpText, Payload: []byte("hello")})
+	})
+
+	t.Run("delete stops hub", func(t *testing.T) {
+		is := is.New(t)
+
+		var evicted int
+		r := chat.NewRegistry(chat.WithEvictHandler(func(string, *chat.Thread) { evicted++ }))
+
+		thread := chat.NewThread()
+		cli := thread.Client()
+		r.Store("a", thread)
+		r.Delete("a")
+		r.Delete("a")
+
+		is.Equal(evicted, 1) // eviction handler should run once
+		cli.SendToUser("ann", &wsutil.Message{OpCode: ws.OpText, Payload: []byte("hello")})
+	})
+
+	t.Run("acquire loads once", func(t *testing.T) {
+		is := is.New(t)
+
+		r := chat.NewRegistry()
+
+		var loads atomic.Int32
+		load := func() (*chat.Thread, error) {
+			loads.Add(1)
+			// give the other callers time to pile up
+			time.Sleep(10 * time.Millisecond)
+			thread := chat.NewThread()
+			thread.Client()
+			return thread, nil
+		}
+
+		const n = 50
+		var (
+			wg      sync.WaitGroup
+			threads [n]*chat.Thread
+		)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				thread, release, err := r.Acquire("a", load)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer release()
+
+				threads[i] = thread
+			}(i)
+		}
+		wg.Wait()
+
+		is.Equal(loads.Load(), int32(1)) // thread should be loaded once
+		for _, thread := range threads {
+			is.True(thread == threads[0])                   // every caller should get the same thread
+			is.True(thread.Client() == threads[0].Client()) // every caller should get the same hub
+		}
+	})
+
+	t.Run("acquire shares load error", func(t *testing.T) {
+		is := is.New(t)
+
+		r := chat.NewRegistry()
+		errLoad := errors.New("load")
+
+		const n = 10
+		var wg sync.WaitGroup
+		errs := make(chan error, n)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				_, _, err := r.Acquire("a", func() (*chat.Thread, error) {
+					time.Sleep(10 * time.Millisecond)
+					return nil, errLoad
+				})
+				errs <- err
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			is.True(errors.Is(err, errLoad)) // load error should be returned
+		}
+		is.Equal(r.Len(), 0) // failed load should not be stored
+	})
+
+	t.Run("acquire survives a panicking load", func(t *testing.T) {
+		is := is.New(t)
+
+		r := chat.NewRegistry()
+		started := make(chan struct{})
+
+		panicked := make(chan any, 1)
+		go func() {
+			defer func() { panicked <- recover() }()
+
+			r.Acquire("a", func() (*chat.Thread, error) {
+				close(started)
+				// give the waiter time to pile up
+				time.Sleep(10 * time.Millisecond)
+				panic("load")
+			})
+		}()
+
+		<-started
+		errs := make(chan error, 1)
+		go func() {
+			_, _, err := r.Acquire("a", func() (*chat.Thread, error) { return chat.NewThread(), nil })
+			errs <- err
+		}()
+
+		is.Equal(<-panicked, "load") // panic left to the caller
+		select {
+		case err := <-errs:
+			is.True(errors.Is(err, chat.ErrLoadPanicked)) // waiter released
+		case <-time.After(time.Second):
+			t.Fatal("waiter blocked by the panicked load")
+		}
+
+		_, release, err := r.Acquire("a", func() (*chat.Thread, error) { return chat.NewThread(), nil })
+		is.NoErr(err) // loaded again
+		release()
+	})
+
+	t.Run("acquired thread is not evicted", func(t *testing.T) {
+		is := is.New(t)
+
+		r := chat.NewRegistry(chat.WithIdleTimeout(time.Minute), chat.WithMaxThreads(1))
+
+		thread, release, err := r.Acquire("a", func() (*chat.Thread, error) { return chat.NewThread(), nil })
+		is.NoErr(err)
+
+		later := time.Now().Add(2 * time.Minute)
+		is.Equal(r.Sweep(later), 0) // held thread should not be swept
+
+		r.Store("b", chat.NewThread())
+		actual, ok := r.Load("a")
+		is.True(ok)               // held thread should not make room
+		is.True(actual == thread) // held thread should be kept
+
+		release()
+		release()
+		is.Equal(r.Sweep(later), 2) // released thread should be swept
+	})
+
+	t.Run("concurrent use", func(t *testing.T) {
+		r := chat.NewRegistry(chat.WithMaxThreads(4), chat.WithIdleTimeout(time.Nanosecond))
+
+		ids := []string{"a", "b", "c", "d", "e", "f"}
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				for j := 0; j < 100; j++ {
+					id := ids[(i+j)%len(ids)]
+					switch j % 5 {
+					case 0:
+						_, release, err := r.Acquire(id, func() (*chat.Thread, error) { return chat.NewThread(), nil })
+						if err == nil {
+							release()
+						}
+					case 1:
+						r.LoadOrStore(id, chat.NewThread())
+					case 2:
+						r.Delete(id)
+					case 3:
+						r.Sweep(time.Now())
+					default:
+						r.Range(func(string, *chat.Thread) bool { return true })
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+	})
+}
@@ -0,0 +1,66 @@
+package chat
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Retention is how long the messages of a thread are kept. The zero value
+// keeps them forever.
+type Retention time.Duration
+
+const RetainForever Retention = 0
+
+var ErrInvalidRetention = errors.New("invalid retention")
+
+func (r Retention) String() string {
+	if r <= 0 {
+		return "forever"
+	}
+
+	return time.Duration(r).String()
+}
+
+func (r Retention) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText parses "forever" or a duration as understood by
+// time.ParseDuration, with the addition of days such as "30d".
+func (r *Retention) UnmarshalText(p []byte) error {
+	s := string(p)
+	if s == "" || s == "forever" {
+		*r = RetainForever
+		return nil
+	}
+
+	var (
+		d   time.Duration
+		err error
+	)
+	if strings.HasSuffix(s, "d") {
+		var n int64
+		n, err = strconv.ParseInt(strings.TrimSuffix(s, "d"), 10, 64)
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	// retentions are stored in seconds
+	if err != nil || d < time.Second {
+		return ErrInvalidRetention
+	}
+
+	*r = Retention(d)
+	return nil
+}
+
+// Seconds is how the retention is stored, sub-second precision is lost.
+func (r Retention) Seconds() int64 {
+	return int64(time.Duration(r) / time.Second)
+}
+
+func RetentionFromSeconds(s int64) Retention {
+	return Retention(time.Duration(s) * time.Second)
+}
@@ -0,0 +1,83 @@
+package chat_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hyphengolang/prelude/testing/is"
+
+	chat "com.adoublef.wss/internal/communications"
+)
+
+func TestRetention(t *testing.T) {
+	tt := []struct {
+		in   string
+		want chat.Retention
+		err  error
+	}{
+		{in: "", want: chat.RetainForever},
+		{in: "forever", want: chat.RetainForever},
+		{in: "30d", want: chat.Retention(30 * 24 * time.Hour)},
+		{in: "1h30m", want: chat.Retention(90 * time.Minute)},
+		{in: "1s", want: chat.Retention(time.Second)},
+		{in: "500ms", err: chat.ErrInvalidRetention},
+		{in: "0d", err: chat.ErrInvalidRetention},
+		{in: "-1h", err: chat.ErrInvalidRetention},
+		{in: "-2d", err: chat.ErrInvalidRetention},
+		{in: "1.5d", err: chat.ErrInvalidRetention},
+		{in: "d", err: chat.ErrInvalidRetention},
+		{in: "never", err: chat.ErrInvalidRetention},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.in, func(t *testing.T) {
+			is := is.New(t)
+
+			var r chat.Retention
+			err := r.UnmarshalText([]byte(tc.in))
+			is.True(errors.Is(err, tc.err)) // parse error
+			is.Equal(r, tc.want)            // parsed retention
+		})
+	}
+
+	t.Run("text round trip", func(t *testing.T) {
+		is := is.New(t)
+
+		for _, r := range []chat.Retention{chat.RetainForever, chat.Retention(time.Second), chat.Retention(30 * 24 * time.Hour)} {
+			p, err := r.MarshalText()
+			is.NoErr(err)
+
+			var got chat.Retention
+			is.NoErr(got.UnmarshalText(p)) // parses what it prints
+			is.Equal(got, r)               // same retention
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		is := is.New(t)
+
+		var v struct {
+			Retention chat.Retention `json:"retention"`
+		}
+		is.NoErr(json.Unmarshal([]byte(`{"retention":"7d"}`), &v))
+		is.Equal(v.Retention, chat.Retention(7*24*time.Hour)) // parsed from a string
+
+		p, err := json.Marshal(v)
+		is.NoErr(err)
+		is.Equal(string(p), `{"retention":"168h0m0s"}`) // printed as a duration
+
+		err = json.Unmarshal([]byte(`{"retention":3600}`), &v)
+		is.True(err != nil) // numbers are ambiguous
+	})
+
+	t.Run("stored in seconds", func(t *testing.T) {
+		is := is.New(t)
+
+		r := chat.Retention(90*time.Second + 500*time.Millisecond)
+		is.Equal(r.Seconds(), int64(90))                                        // sub-second precision lost
+		is.Equal(chat.RetentionFromSeconds(90), chat.Retention(90*time.Second)) // read back
+		is.Equal(chat.RetentionFromSeconds(0), chat.RetainForever)              // zero keeps forever
+	})
+}
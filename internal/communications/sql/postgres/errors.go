@@ -0,0 +1,42 @@
+package repo
+
+import (
+	"errors"
+
+	repo "com.adoublef.wss/internal/communications/sql"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Postgres error codes, see https://www.postgresql.org/docs/current/errcodes-appendix.html
+const (
+	codeForeignKeyViolation       = "23503"
+	codeUniqueViolation           = "23505"
+	codeInvalidTextRepresentation = "22P02"
+)
+
+// wrapError maps driver errors onto the errors of the repo package.
+func wrapError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(err, pgx.ErrNoRows) {
+		return repo.WrapError(repo.ErrNotFound, err)
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case codeUniqueViolation:
+			return repo.WrapError(repo.ErrConflict, err)
+		case codeForeignKeyViolation:
+			// the row referenced, such as the thread of a message, is missing
+			return repo.WrapError(repo.ErrNotFound, err)
+		case codeInvalidTextRepresentation:
+			return repo.WrapError(repo.ErrInvalidKey, err)
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,50 @@
+package repo
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/hyphengolang/prelude/testing/is"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	repo "com.adoublef.wss/internal/communications/sql"
+)
+
+func TestWrapError(t *testing.T) {
+	errOther := errors.New("connection reset")
+
+	tt := []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"no rows", pgx.ErrNoRows, repo.ErrNotFound},
+		{"unique violation", &pgconn.PgError{Code: codeUniqueViolation}, repo.ErrConflict},
+		{"foreign key violation", &pgconn.PgError{Code: codeForeignKeyViolation}, repo.ErrNotFound},
+		{"invalid text", &pgconn.PgError{Code: codeInvalidTextRepresentation}, repo.ErrInvalidKey},
+		{"wrapped", fmt.Errorf("insert: %w", &pgconn.PgError{Code: codeUniqueViolation}), repo.ErrConflict},
+		{"other", errOther, errOther},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+
+			err := wrapError(tc.err)
+			is.True(errors.Is(err, tc.want)) // mapped
+			is.True(errors.Is(err, tc.err))  // driver error kept
+		})
+	}
+
+	t.Run("driver error can be inspected", func(t *testing.T) {
+		is := is.New(t)
+
+		var pgErr *pgconn.PgError
+		is.True(errors.As(wrapError(&pgconn.PgError{Code: codeForeignKeyViolation}), &pgErr)) // still a PgError
+		is.Equal(pgErr.Code, codeForeignKeyViolation)                                         // with its code
+	})
+
+	is.New(t).NoErr(wrapError(nil)) // no error
+}
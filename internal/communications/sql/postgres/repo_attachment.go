@@ -0,0 +1,109 @@
+package repo
+
+import (
+	"context"
+	"time"
+
+	comms "com.adoublef.wss/internal/communications"
+	repo "com.adoublef.wss/internal/communications/sql"
+	pg "com.adoublef.wss/internal/postgres"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+type Attachment struct {
+	ID        uuid.UUID
+	ThreadID  uuid.UUID
+	Name      string
+	MimeType  string
+	Size      int64
+	Hash      string
+	CreatedAt time.Time
+}
+
+type AttachmentRepo = repo.AttachmentRepo
+
+var _ AttachmentRepo = (*attachmentRepo)(nil)
+
+type attachmentRepo struct {
+	h pg.Conn[Attachment]
+}
+
+func (r *attachmentRepo) Create(ctx context.Context, a *comms.Attachment) error {
+	const q = `INSERT INTO communications.attachment (id, thread_id, name, mime_type, size, hash, created_at)
+	VALUES (@id, @threadID, @name, @mimeType, @size, @hash, @createdAt)`
+
+	args := pgx.NamedArgs{
+		"id":        a.ID,
+		"threadID":  a.ThreadID,
+		"name":      a.Name,
+		"mimeType":  a.MimeType,
+		"size":      a.Size,
+		"hash":      a.Hash,
+		"createdAt": a.CreatedAt,
+	}
+
+	return wrapError(r.h.ExecContext(ctx, q, args))
+}
+
+func (r *attachmentRepo) Find(ctx context.Context, threadID, id uuid.UUID) (*comms.Attachment, error) {
+	const q = `SELECT id, thread_id, name, mime_type, size, hash, created_at
+	FROM communications.attachment WHERE id = @id AND thread_id = @threadID`
+	args := pgx.NamedArgs{"id": id, "threadID": threadID}
+
+	var attachment comms.Attachment
+	_, err := r.h.QueryRowContext(ctx, func(row pgx.Row, a *Attachment) error {
+		if err := row.Scan(&a.ID, &a.ThreadID, &a.Name, &a.MimeType, &a.Size, &a.Hash, &a.CreatedAt); err != nil {
+			return err
+		}
+
+		attachment = comms.Attachment{
+			ID:        a.ID,
+			ThreadID:  a.ThreadID,
+			Name:      a.Name,
+			MimeType:  a.MimeType,
+			Size:      a.Size,
+			Hash:      a.Hash,
+			CreatedAt: a.CreatedAt,
+		}
+
+		return nil
+	}, q, args)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+
+	return &attachment, nil
+}
+
+func (r *attachmentRepo) FindMany(ctx context.Context, threadID uuid.UUID) ([]*comms.Attachment, error) {
+	const q = `SELECT id, thread_id, name, mime_type, size, hash, created_at
+	FROM communications.attachment WHERE thread_id = @threadID ORDER BY created_at, id`
+	args := pgx.NamedArgs{"threadID": threadID}
+
+	var as []*comms.Attachment
+	_, err := r.h.QueryContext(ctx, func(rows pgx.Rows, a *Attachment) error {
+		if err := rows.Scan(&a.ID, &a.ThreadID, &a.Name, &a.MimeType, &a.Size, &a.Hash, &a.CreatedAt); err != nil {
+			return err
+		}
+
+		as = append(as, &comms.Attachment{
+			ID:        a.ID,
+			ThreadID:  a.ThreadID,
+			Name:      a.Name,
+			MimeType:  a.MimeType,
+			Size:      a.Size,
+			Hash:      a.Hash,
+			CreatedAt: a.CreatedAt,
+		})
+
+		return nil
+	}, q, args)
+	return as, wrapError(err)
+}
+
+func NewAttachmentRepo(conn pg.Querier) AttachmentRepo {
+	r := &attachmentRepo{h: pg.NewHandler[Attachment](conn)}
+
+	return r
+}
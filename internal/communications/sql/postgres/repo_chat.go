@@ -2,85 +2,258 @@ package repo
 
 import (
 	"context"
+	"errors"
+	"io"
+	"time"
 
 	comms "com.adoublef.wss/internal/communications"
 	repo "com.adoublef.wss/internal/communications/sql"
 	pg "com.adoublef.wss/internal/postgres"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type Thread struct {
-	ID uuid.UUID
+	ID        uuid.UUID
+	CreatedAt time.Time
+	// Retention is in seconds.
+	Retention int64
+	DeletedAt *time.Time
 }
 
-type ThreadRepo repo.Repo[*comms.Thread]
+type ThreadRepo = repo.ThreadRepo
+
+var _ ThreadRepo = (*threadRepo)(nil)
 
 type threadRepo struct {
 	h pg.Conn[Thread]
 }
 
-func (r *threadRepo) Delete(ctx context.Context, key any) error {
-	// NOTE -- key needs to be type-checked
-	const q = `DELETE FROM communications.thread WHERE id = @id`
+func (r *threadRepo) Delete(ctx context.Context, id uuid.UUID) error {
+	const q = `UPDATE communications.thread SET deleted_at = @deletedAt WHERE id = @id AND deleted_at IS NULL`
 
 	args := pgx.NamedArgs{
-		"id": key,
+		"id":        id,
+		"deletedAt": time.Now().UTC(),
 	}
 
-	return r.h.ExecContext(ctx, q, args)
+	n, err := r.h.ExecRowsContext(ctx, q, args)
+	if err != nil {
+		return wrapError(err)
+	}
+	if n == 0 {
+		return repo.ErrNotFound
+	}
+
+	return nil
 }
 
 func (r *threadRepo) Create(ctx context.Context, chat *comms.Thread) error {
-	const q = `INSERT INTO communications.thread (id) VALUES (@id)`
+	const q = `INSERT INTO communications.thread (id, created_at, message_retention, deleted_at) VALUES (@id, @createdAt, @retention, @deletedAt)`
+
+	if chat.CreatedAt.IsZero() {
+		chat.CreatedAt = time.Now().UTC()
+	}
 
 	args := pgx.NamedArgs{
-		"id": chat.ID,
+		"id":        chat.ID,
+		"createdAt": chat.CreatedAt,
+		"retention": chat.Retention.Seconds(),
+		"deletedAt": chat.DeletedAt,
+	}
+
+	return wrapError(r.h.ExecContext(ctx, q, args))
+}
+
+func (r *threadRepo) Import(ctx context.Context, chat *comms.Thread, next func() (*comms.Message, error)) error {
+	// next can't be replayed so the transaction isn't retried
+	return WithTx(ctx, r.h.Conn(), func(rs *Repos) error {
+		if err := rs.Threads.Create(ctx, chat); err != nil {
+			return err
+		}
+
+		for {
+			msg, err := next()
+			if errors.Is(err, io.EOF) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			msg.Thread = chat
+			if err := rs.Messages.Create(ctx, msg); err != nil {
+				return err
+			}
+		}
+	}, pg.WithRetries(0))
+}
+
+func (r *threadRepo) Find(ctx context.Context, id uuid.UUID) (*comms.Thread, error) {
+	thread, err := r.FindMeta(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// populate messages
+	thread.Messages = make([]*comms.Message, 0)
+	err = NewMessageRepo(r.h.Conn()).ForEach(ctx, id, func(msg *comms.Message) error {
+		msg.Thread = thread
+		thread.Messages = append(thread.Messages, msg)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return r.h.ExecContext(ctx, q, args)
+	return thread, nil
 }
 
-func (r *threadRepo) Find(ctx context.Context, key any) (*comms.Thread, error) {
-	const q = `SELECT id FROM communications.thread WHERE id = @id`
-	args := pgx.NamedArgs{"id": key}
+func (r *threadRepo) FindMeta(ctx context.Context, id uuid.UUID) (*comms.Thread, error) {
+	const q = `SELECT id, created_at, message_retention FROM communications.thread WHERE id = @id AND deleted_at IS NULL`
+	args := pgx.NamedArgs{"id": id}
 
 	var thread comms.Thread
 	_, err := r.h.QueryRowContext(ctx, func(row pgx.Row, thr *Thread) error {
-		if err := row.Scan(&thr.ID); err != nil {
+		if err := row.Scan(&thr.ID, &thr.CreatedAt, &thr.Retention); err != nil {
 			return err
 		}
 
 		thread = comms.Thread{
-			ID: thr.ID,
+			ID:        thr.ID,
+			CreatedAt: thr.CreatedAt,
+			Retention: comms.RetentionFromSeconds(thr.Retention),
 		}
 
 		return nil
 	}, q, args)
-	return &thread, err
+	if err != nil {
+		return nil, wrapError(err)
+	}
+
+	return &thread, nil
+}
+
+func (r *threadRepo) FindDeletedMeta(ctx context.Context, id uuid.UUID) (*comms.Thread, error) {
+	const q = `SELECT id, created_at, message_retention, deleted_at FROM communications.thread WHERE id = @id AND deleted_at IS NOT NULL`
+	args := pgx.NamedArgs{"id": id}
+
+	var thread comms.Thread
+	_, err := r.h.QueryRowContext(ctx, func(row pgx.Row, thr *Thread) error {
+		if err := row.Scan(&thr.ID, &thr.CreatedAt, &thr.Retention, &thr.DeletedAt); err != nil {
+			return err
+		}
+
+		thread = comms.Thread{
+			ID:        thr.ID,
+			CreatedAt: thr.CreatedAt,
+			Retention: comms.RetentionFromSeconds(thr.Retention),
+			DeletedAt: thr.DeletedAt,
+		}
+
+		return nil
+	}, q, args)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+
+	return &thread, nil
 }
 
 func (r *threadRepo) FindMany(ctx context.Context) ([]*comms.Thread, error) {
-	const q = `SELECT id FROM communications.thread`
+	const q = `SELECT id, created_at, message_retention FROM communications.thread WHERE deleted_at IS NULL ORDER BY created_at, id`
 
 	var tt []*comms.Thread
 	_, err := r.h.QueryContext(ctx, func(rows pgx.Rows, thr *Thread) error {
-		if err := rows.Scan(&thr.ID); err != nil {
+		if err := rows.Scan(&thr.ID, &thr.CreatedAt, &thr.Retention); err != nil {
 			return err
 		}
 
 		thread := comms.Thread{
-			ID: thr.ID,
+			ID:        thr.ID,
+			CreatedAt: thr.CreatedAt,
+			Retention: comms.RetentionFromSeconds(thr.Retention),
 		}
 
 		tt = append(tt, &thread)
 		return nil
 	}, q, nil)
-	return tt, err
+	return tt, wrapError(err)
+}
+
+func (r *threadRepo) Restore(ctx context.Context, id uuid.UUID, deletedAfter time.Time) error {
+	const q = `UPDATE communications.thread SET deleted_at = NULL WHERE id = @id AND deleted_at > @deletedAfter`
+
+	args := pgx.NamedArgs{
+		"id":           id,
+		"deletedAfter": deletedAfter,
+	}
+
+	n, err := r.h.ExecRowsContext(ctx, q, args)
+	if err != nil {
+		return wrapError(err)
+	}
+	if n == 0 {
+		return repo.ErrNotFound
+	}
+
+	return nil
+}
+
+func (r *threadRepo) FindDeleted(ctx context.Context, deletedBefore time.Time) ([]uuid.UUID, error) {
+	const q = `SELECT id FROM communications.thread WHERE deleted_at < @deletedBefore ORDER BY deleted_at`
+	args := pgx.NamedArgs{"deletedBefore": deletedBefore}
+
+	var ids []uuid.UUID
+	_, err := r.h.QueryContext(ctx, func(rows pgx.Rows, thr *Thread) error {
+		if err := rows.Scan(&thr.ID); err != nil {
+			return err
+		}
+
+		ids = append(ids, thr.ID)
+		return nil
+	}, q, args)
+	return ids, wrapError(err)
+}
+
+func (r *threadRepo) Purge(ctx context.Context, id uuid.UUID) error {
+	// messages and attachments are deleted in cascade
+	const q = `DELETE FROM communications.thread WHERE id = @id AND deleted_at IS NOT NULL`
+
+	args := pgx.NamedArgs{
+		"id": id,
+	}
+
+	n, err := r.h.ExecRowsContext(ctx, q, args)
+	if err != nil {
+		return wrapError(err)
+	}
+	if n == 0 {
+		return repo.ErrNotFound
+	}
+
+	return nil
+}
+
+func (r *threadRepo) SetRetention(ctx context.Context, id uuid.UUID, retention comms.Retention) error {
+	const q = `UPDATE communications.thread SET message_retention = @retention WHERE id = @id AND deleted_at IS NULL`
+
+	args := pgx.NamedArgs{
+		"id":        id,
+		"retention": retention.Seconds(),
+	}
+
+	n, err := r.h.ExecRowsContext(ctx, q, args)
+	if err != nil {
+		return wrapError(err)
+	}
+	if n == 0 {
+		return repo.ErrNotFound
+	}
+
+	return nil
 }
 
-func NewChatRepo(conn *pgxpool.Pool) ThreadRepo {
+func NewChatRepo(conn pg.Querier) ThreadRepo {
 	r := &threadRepo{h: pg.NewHandler[Thread](conn)}
 
 	return r
@@ -0,0 +1,170 @@
+package repo
+
+import (
+	"context"
+	"time"
+
+	comms "com.adoublef.wss/internal/communications"
+	repo "com.adoublef.wss/internal/communications/sql"
+	pg "com.adoublef.wss/internal/postgres"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+)
+
+type Message struct {
+	ID        int64
+	ThreadID  uuid.UUID
+	Sender    string
+	Content   string
+	EditedAt  *time.Time
+	CreatedAt time.Time
+}
+
+type MessageRepo = repo.MessageRepo
+
+var _ MessageRepo = (*messageRepo)(nil)
+
+type messageRepo struct {
+	h pg.Conn[Message]
+}
+
+func (r *messageRepo) Create(ctx context.Context, msg *comms.Message) error {
+	const q = `INSERT INTO communications.message (thread_id, sender, content, edited_at, created_at)
+	VALUES (@threadID, @sender, @content, @editedAt, @createdAt) RETURNING id`
+
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = time.Now().UTC()
+	}
+
+	args := pgx.NamedArgs{
+		"threadID":  msg.Thread.ID,
+		"sender":    msg.Sender,
+		"content":   msg.Content,
+		"editedAt":  msg.EditedAt,
+		"createdAt": msg.CreatedAt,
+	}
+
+	_, err := r.h.QueryRowContext(ctx, func(row pgx.Row, m *Message) error {
+		if err := row.Scan(&m.ID); err != nil {
+			return err
+		}
+
+		msg.ID = int(m.ID)
+		return nil
+	}, q, args)
+	return wrapError(err)
+}
+
+func (r *messageRepo) ForEach(ctx context.Context, threadID uuid.UUID, fn func(msg *comms.Message) error) error {
+	const q = `SELECT id, sender, content, edited_at, created_at FROM communications.message WHERE thread_id = @threadID ORDER BY id`
+	args := pgx.NamedArgs{"threadID": threadID}
+
+	err := pg.ForEachContext(ctx, r.h.Conn(), func(rows pgx.Rows, msg *Message) error {
+		return rows.Scan(&msg.ID, &msg.Sender, &msg.Content, &msg.EditedAt, &msg.CreatedAt)
+	}, func(msg *Message) error {
+		return fn(&comms.Message{
+			ID:        int(msg.ID),
+			Sender:    msg.Sender,
+			Content:   msg.Content,
+			EditedAt:  msg.EditedAt,
+			CreatedAt: msg.CreatedAt,
+		})
+	}, q, args)
+	return wrapError(err)
+}
+
+// expired selects the messages that have outlived the retention of their
+// thread at @now.
+const expired = `t.message_retention > 0 AND m.created_at < @now::timestamptz - make_interval(secs => t.message_retention)`
+
+func (r *messageRepo) DeleteExpired(ctx context.Context, now time.Time, limit int) (int64, error) {
+	const q = `DELETE FROM communications.message WHERE id IN (
+		SELECT m.id FROM communications.message m
+		JOIN communications.thread t ON t.id = m.thread_id
+		WHERE ` + expired + `
+		ORDER BY m.id LIMIT @limit
+	)`
+
+	args := pgx.NamedArgs{
+		"now":   now,
+		"limit": limit,
+	}
+
+	n, err := r.h.ExecRowsContext(ctx, q, args)
+	return n, wrapError(err)
+}
+
+func (r *messageRepo) CountExpired(ctx context.Context, now time.Time) ([]*repo.RetentionCount, error) {
+	const q = `SELECT t.message_retention, COUNT(DISTINCT t.id), COUNT(m.id) FILTER (WHERE ` + expired + `)
+	FROM communications.thread t
+	LEFT JOIN communications.message m ON m.thread_id = t.id
+	WHERE t.deleted_at IS NULL
+	GROUP BY t.message_retention
+	ORDER BY t.message_retention`
+
+	args := pgx.NamedArgs{"now": now}
+
+	counts, err := pg.QueryContext(ctx, r.h.Conn(), func(rows pgx.Rows, c *repo.RetentionCount) error {
+		var retention int64
+		if err := rows.Scan(&retention, &c.Threads, &c.Messages); err != nil {
+			return err
+		}
+
+		c.Retention = comms.RetentionFromSeconds(retention)
+		return nil
+	}, q, args)
+	return counts, wrapError(err)
+}
+
+// headlineOptions configures the snippets of search results.
+const headlineOptions = "StartSel=" + repo.HighlightStart + ", StopSel=" + repo.HighlightStop + ", MinWords=5, MaxWords=20"
+
+func (r *messageRepo) Search(ctx context.Context, query repo.MessageQuery) ([]*repo.MessageMatch, error) {
+	const q = `SELECT m.id, m.thread_id, m.sender, m.content, m.edited_at, m.created_at, ts_headline('english', m.content, query, @options)
+	FROM communications.message m
+	JOIN communications.thread t ON t.id = m.thread_id,
+	plainto_tsquery('english', @text) query
+	WHERE m.search @@ query AND t.deleted_at IS NULL AND (@threadID::uuid IS NULL OR m.thread_id = @threadID)
+	AND (@member = '' OR EXISTS (SELECT 1 FROM communications.message s WHERE s.thread_id = m.thread_id AND s.sender = @member))
+	ORDER BY ts_rank(m.search, query) DESC, m.id
+	LIMIT @limit OFFSET @offset`
+
+	var threadID *uuid.UUID
+	if query.ThreadID != uuid.Nil {
+		threadID = &query.ThreadID
+	}
+
+	args := pgx.NamedArgs{
+		"text":     query.Text,
+		"options":  headlineOptions,
+		"threadID": threadID,
+		"member":   query.Member,
+		"limit":    query.Limit,
+		"offset":   query.Offset,
+	}
+
+	matches, err := pg.QueryContext(ctx, r.h.Conn(), func(rows pgx.Rows, match *repo.MessageMatch) error {
+		var msg Message
+		if err := rows.Scan(&msg.ID, &msg.ThreadID, &msg.Sender, &msg.Content, &msg.EditedAt, &msg.CreatedAt, &match.Snippet); err != nil {
+			return err
+		}
+
+		match.ThreadID = msg.ThreadID
+		match.Message = &comms.Message{
+			ID:        int(msg.ID),
+			Sender:    msg.Sender,
+			Content:   msg.Content,
+			EditedAt:  msg.EditedAt,
+			CreatedAt: msg.CreatedAt,
+			Thread:    &comms.Thread{ID: msg.ThreadID},
+		}
+		return nil
+	}, q, args)
+	return matches, wrapError(err)
+}
+
+func NewMessageRepo(conn pg.Querier) MessageRepo {
+	r := &messageRepo{h: pg.NewHandler[Message](conn)}
+
+	return r
+}
@@ -2,14 +2,22 @@ package repo_test
 
 import (
 	"context"
+	"errors"
 	"log"
 	"testing"
 	"time"
 
+	sql "com.adoublef.wss/internal/communications/sql"
 	repo "com.adoublef.wss/internal/communications/sql/postgres"
+	"com.adoublef.wss/internal/communications/sql/repotest"
+	"com.adoublef.wss/internal/migrate"
+	pg "com.adoublef.wss/internal/postgres"
 	"com.adoublef.wss/pkg/docker"
+	"com.adoublef.wss/postgres/migrations"
 	"github.com/google/uuid"
 	"github.com/hyphengolang/prelude/testing/is"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 
 	comms "com.adoublef.wss/internal/communications"
 )
@@ -17,28 +25,31 @@ import (
 var (
 	testRepo      repo.ThreadRepo
 	testContainer *docker.PostgresContainer
-
-	testMigration = `
-	CREATE SCHEMA communications;
-
-	CREATE EXTENSION IF NOT EXISTS pgcrypto;
-
-	CREATE TABLE IF NOT EXISTS communications.thread (
-		id UUID PRIMARY KEY DEFAULT gen_random_uuid()
-	);
-	`
+	testConn      *pgxpool.Pool
 )
 
 func init() {
-	container, conn, err := docker.NewPostgresConnection(context.Background(), "5432/tcp", 15*time.Second, testMigration)
+	ctx := context.Background()
+
+	container, conn, err := docker.NewPostgresConnection(ctx, "5432/tcp", 15*time.Second, "")
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	m, err := migrate.New(migrate.NewPostgresDriver(conn), migrations.FS)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if _, err := m.Up(ctx); err != nil {
+		log.Fatal(err)
+	}
+
 	// initialize test repo
 	testRepo = repo.NewChatRepo(conn)
 	// initialize test container
 	testContainer = container
+	testConn = conn
 }
 
 func TestRepo(t *testing.T) {
@@ -78,3 +89,106 @@ func TestRepo(t *testing.T) {
 		is.Equal(len(threads), 0)
 	})
 }
+
+func TestConformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) repotest.Backend {
+		ctx := context.Background()
+
+		// every case starts from empty tables
+		_, err := testConn.Exec(ctx, `TRUNCATE communications.thread CASCADE`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return repotest.Backend{
+			Threads:     repo.NewChatRepo(testConn),
+			Messages:    repo.NewMessageRepo(testConn),
+			Attachments: repo.NewAttachmentRepo(testConn),
+		}
+	})
+}
+
+func TestWithTx(t *testing.T) {
+	ctx := context.Background()
+	errRollback := errors.New("rollback")
+
+	t.Run("commit thread and message", func(t *testing.T) {
+		is := is.New(t)
+
+		thread := comms.NewThread()
+		err := repo.WithTx(ctx, testConn, func(r *repo.Repos) error {
+			if err := r.Threads.Create(ctx, thread); err != nil {
+				return err
+			}
+			return r.Messages.Create(ctx, comms.NewMessage(thread, "first"))
+		}, pg.WithIsolation(pgx.Serializable))
+		is.NoErr(err) // failed to commit transaction
+
+		found, err := testRepo.Find(ctx, thread.ID)
+		is.NoErr(err)                    // thread not committed
+		is.Equal(len(found.Messages), 1) // message not committed
+	})
+
+	t.Run("rollback on error", func(t *testing.T) {
+		is := is.New(t)
+
+		thread := comms.NewThread()
+		err := repo.WithTx(ctx, testConn, func(r *repo.Repos) error {
+			if err := r.Threads.Create(ctx, thread); err != nil {
+				return err
+			}
+			return errRollback
+		})
+		is.True(errors.Is(err, errRollback)) // error of fn not returned
+
+		_, err = testRepo.Find(ctx, thread.ID)
+		is.True(errors.Is(err, sql.ErrNotFound)) // thread should be rolled back
+	})
+
+	t.Run("rollback on panic", func(t *testing.T) {
+		is := is.New(t)
+
+		thread := comms.NewThread()
+		func() {
+			defer func() { _ = recover() }()
+
+			_ = repo.WithTx(ctx, testConn, func(r *repo.Repos) error {
+				if err := r.Threads.Create(ctx, thread); err != nil {
+					return err
+				}
+				panic("boom")
+			})
+		}()
+
+		_, err := testRepo.Find(ctx, thread.ID)
+		is.True(errors.Is(err, sql.ErrNotFound)) // thread should be rolled back
+	})
+
+	t.Run("rollback savepoint only", func(t *testing.T) {
+		is := is.New(t)
+
+		outer, inner := comms.NewThread(), comms.NewThread()
+		err := pg.WithTx(ctx, testConn, func(tx pgx.Tx) error {
+			if err := repo.NewChatRepo(tx).Create(ctx, outer); err != nil {
+				return err
+			}
+
+			err := pg.WithTx(ctx, tx, func(sp pgx.Tx) error {
+				if err := repo.NewChatRepo(sp).Create(ctx, inner); err != nil {
+					return err
+				}
+				return errRollback
+			})
+			is.True(errors.Is(err, errRollback)) // error of nested fn not returned
+
+			return nil
+		})
+		is.NoErr(err) // failed to commit transaction
+
+		_, err = testRepo.Find(ctx, outer.ID)
+		is.NoErr(err) // outer thread not committed
+
+		_, err = testRepo.Find(ctx, inner.ID)
+		is.True(errors.Is(err, sql.ErrNotFound)) // inner thread should be rolled back
+	})
+}
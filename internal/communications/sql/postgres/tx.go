@@ -0,0 +1,36 @@
+package repo
+
+import (
+	"context"
+
+	pg "com.adoublef.wss/internal/postgres"
+	"github.com/jackc/pgx/v5"
+)
+
+// Repos are the repositories of a unit of work, they share a single
+// transaction.
+type Repos struct {
+	Threads     ThreadRepo
+	Messages    MessageRepo
+	Attachments AttachmentRepo
+}
+
+// NewRepos returns repositories running their queries against conn, which
+// is either the pool or a transaction.
+func NewRepos(conn pg.Querier) *Repos {
+	r := &Repos{
+		Threads:     NewChatRepo(conn),
+		Messages:    NewMessageRepo(conn),
+		Attachments: NewAttachmentRepo(conn),
+	}
+
+	return r
+}
+
+// WithTx runs fn with repositories bound to a transaction, committed once
+// fn returns nil. See pg.WithTx for the options and retries.
+func WithTx(ctx context.Context, conn pg.Querier, fn func(r *Repos) error, opts ...pg.TxOption) error {
+	return pg.WithTx(ctx, conn, func(tx pgx.Tx) error {
+		return wrapError(fn(NewRepos(tx)))
+	}, opts...)
+}
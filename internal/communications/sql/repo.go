@@ -2,8 +2,43 @@ package repo
 
 import (
 	"context"
+	"errors"
+	"time"
+
+	chat "com.adoublef.wss/internal/communications"
+	"github.com/google/uuid"
+)
+
+// Errors returned by every storage backend. The driver error, if any, is
+// wrapped with WrapError so that it can still be logged and inspected.
+var (
+	ErrNotFound   = errors.New("not found")
+	ErrConflict   = errors.New("conflict")
+	ErrInvalidKey = errors.New("invalid key")
 )
 
+// WrapError returns an error that is kind, one of the errors above, and
+// wraps the driver error err, both match with errors.Is and errors.As.
+func WrapError(kind, err error) error {
+	return &driverError{kind: kind, err: err}
+}
+
+type driverError struct {
+	kind, err error
+}
+
+func (e *driverError) Error() string {
+	return e.kind.Error() + ": " + e.err.Error()
+}
+
+func (e *driverError) Unwrap() error {
+	return e.err
+}
+
+func (e *driverError) Is(target error) bool {
+	return target == e.kind
+}
+
 type Chat struct {
 	ID []byte
 }
@@ -14,9 +49,101 @@ type Message struct {
 	Content string
 }
 
-type Repo[T any] interface {
+// Repo stores values of type T identified by keys of type K.
+type Repo[K comparable, T any] interface {
 	Create(ctx context.Context, t T) error
 	FindMany(ctx context.Context) ([]T, error)
-	Find(ctx context.Context, key any) (T, error)
-	Delete(ctx context.Context, key any) error
+	Find(ctx context.Context, key K) (T, error)
+	Delete(ctx context.Context, key K) error
+}
+
+// ThreadRepo is implemented by every storage backend. Delete only marks a
+// thread as deleted, Find and FindMany then behave as if it didn't exist.
+type ThreadRepo interface {
+	Repo[uuid.UUID, *chat.Thread]
+	// Restore undoes the deletion of a thread deleted after the given
+	// time. It returns ErrNotFound if there is no such thread.
+	Restore(ctx context.Context, id uuid.UUID, deletedAfter time.Time) error
+	// FindDeleted returns the ids of the threads deleted before the given
+	// time.
+	FindDeleted(ctx context.Context, deletedBefore time.Time) ([]uuid.UUID, error)
+	// Purge removes a deleted thread for good, along with its messages
+	// and attachments.
+	Purge(ctx context.Context, id uuid.UUID) error
+	// FindMeta is like Find but doesn't load the messages of the thread.
+	FindMeta(ctx context.Context, id uuid.UUID) (*chat.Thread, error)
+	// FindDeletedMeta is like FindMeta but only finds deleted threads,
+	// with DeletedAt set.
+	FindDeletedMeta(ctx context.Context, id uuid.UUID) (*chat.Thread, error)
+	// Import creates a thread along with the messages returned by next,
+	// until it returns io.EOF, all or nothing. It returns ErrConflict if
+	// the thread already exists, even if deleted. A thread with DeletedAt
+	// set is created deleted at that time.
+	Import(ctx context.Context, t *chat.Thread, next func() (*chat.Message, error)) error
+	// SetRetention changes how long the messages of a thread are kept.
+	SetRetention(ctx context.Context, id uuid.UUID, r chat.Retention) error
+}
+
+// MessageRepo is implemented by every storage backend.
+type MessageRepo interface {
+	// Create stores msg in msg.Thread and sets its ID.
+	Create(ctx context.Context, msg *chat.Message) error
+	// DeleteExpired deletes at most limit messages that have outlived the
+	// retention of their thread at now, it returns how many were deleted.
+	DeleteExpired(ctx context.Context, now time.Time, limit int) (int64, error)
+	// CountExpired returns, for every retention in use by live threads,
+	// how many of their messages DeleteExpired would delete at now. The
+	// messages of deleted threads still expire but aren't counted.
+	CountExpired(ctx context.Context, now time.Time) ([]*RetentionCount, error)
+	// ForEach calls fn with every message of a thread in order, without
+	// loading them all in memory. It stops at the first error of fn.
+	ForEach(ctx context.Context, threadID uuid.UUID, fn func(msg *chat.Message) error) error
+	// Search returns the messages of live threads matching every word
+	// of q, best matches first. The text has no query syntax, words such
+	// as or and a leading - are searched like any other.
+	Search(ctx context.Context, q MessageQuery) ([]*MessageMatch, error)
+}
+
+// MessageQuery selects messages by their content.
+type MessageQuery struct {
+	// Text is made of the words to look for, results contain all of them.
+	Text string
+	// ThreadID limits the search to a thread, uuid.Nil searches every
+	// thread.
+	ThreadID uuid.UUID
+	// Member limits the search to the threads Member has sent messages
+	// to, the empty string searches every thread.
+	Member string
+	Limit  int
+	Offset int
+}
+
+// Markers surrounding the matching words of a snippet.
+const (
+	HighlightStart = "\x02"
+	HighlightStop  = "\x03"
+)
+
+// MessageMatch is a message found by a search.
+type MessageMatch struct {
+	Message  *chat.Message
+	ThreadID uuid.UUID
+	// Snippet is an extract of the content with the matching words
+	// between HighlightStart and HighlightStop.
+	Snippet string
+}
+
+// RetentionCount is the number of expired messages of the threads sharing
+// a retention.
+type RetentionCount struct {
+	Retention chat.Retention `json:"retention"`
+	Threads   int64          `json:"threads"`
+	Messages  int64          `json:"messages"`
+}
+
+// AttachmentRepo is implemented by every storage backend.
+type AttachmentRepo interface {
+	Create(ctx context.Context, a *chat.Attachment) error
+	Find(ctx context.Context, threadID, id uuid.UUID) (*chat.Attachment, error)
+	FindMany(ctx context.Context, threadID uuid.UUID) ([]*chat.Attachment, error)
 }
@@ -0,0 +1,31 @@
+package repo_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/hyphengolang/prelude/testing/is"
+
+	repo "com.adoublef.wss/internal/communications/sql"
+)
+
+type driverErr struct{ code string }
+
+func (e *driverErr) Error() string { return "driver error " + e.code }
+
+func TestWrapError(t *testing.T) {
+	is := is.New(t)
+
+	cause := &driverErr{code: "23505"}
+	err := repo.WrapError(repo.ErrConflict, cause)
+
+	is.True(errors.Is(err, repo.ErrConflict))  // kind of error
+	is.True(!errors.Is(err, repo.ErrNotFound)) // of that kind only
+	is.True(errors.Is(err, cause))             // driver error
+
+	var de *driverErr
+	is.True(errors.As(err, &de)) // driver error can be inspected
+	is.Equal(de.code, "23505")   // as returned by the driver
+
+	is.Equal(err.Error(), "conflict: driver error 23505") // both logged
+}
@@ -0,0 +1,509 @@
+// Package repotest provides a conformance suite for the repositories of
+// the storage backends, so that they all behave the same.
+package repotest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	chat "com.adoublef.wss/internal/communications"
+	repo "com.adoublef.wss/internal/communications/sql"
+)
+
+// Backend holds the repositories under test. They must share an empty
+// database.
+type Backend struct {
+	Threads     repo.ThreadRepo
+	Messages    repo.MessageRepo
+	Attachments repo.AttachmentRepo
+}
+
+// Run runs the suite, newBackend is called for every test case.
+func Run(t *testing.T, newBackend func(t *testing.T) Backend) {
+	t.Run("create then find thread", func(t *testing.T) {
+		ctx, b := context.Background(), newBackend(t)
+
+		thread := chat.NewThread()
+		noErr(t, b.Threads.Create(ctx, thread), "failed to create thread")
+
+		found, err := b.Threads.Find(ctx, thread.ID)
+		noErr(t, err, "failed to find thread")
+		equal(t, found.ID, thread.ID, "thread id does not match")
+		check(t, sameTime(found.CreatedAt, thread.CreatedAt), "created at does not match")
+		check(t, found.Messages != nil, "messages should be loaded")
+		equal(t, len(found.Messages), 0, "new thread has no messages")
+	})
+
+	t.Run("find missing thread", func(t *testing.T) {
+		ctx, b := context.Background(), newBackend(t)
+
+		_, err := b.Threads.Find(ctx, uuid.New())
+		check(t, errors.Is(err, repo.ErrNotFound), "missing thread should not be found")
+
+		err = b.Threads.Delete(ctx, uuid.New())
+		check(t, errors.Is(err, repo.ErrNotFound), "missing thread should not be deleted")
+	})
+
+	t.Run("create duplicate thread", func(t *testing.T) {
+		ctx, b := context.Background(), newBackend(t)
+
+		thread := chat.NewThread()
+		noErr(t, b.Threads.Create(ctx, thread), "failed to create thread")
+
+		err := b.Threads.Create(ctx, thread)
+		check(t, errors.Is(err, repo.ErrConflict), "duplicate thread should conflict")
+	})
+
+	t.Run("find many threads in creation order", func(t *testing.T) {
+		ctx, b := context.Background(), newBackend(t)
+
+		threads, err := b.Threads.FindMany(ctx)
+		noErr(t, err, "failed to find threads")
+		equal(t, len(threads), 0, "database should be empty")
+
+		now := time.Now().UTC().Truncate(time.Millisecond)
+
+		want := make([]*chat.Thread, 3)
+		for i := range want {
+			want[i] = chat.NewThread()
+			want[i].CreatedAt = now.Add(time.Duration(i) * time.Second)
+		}
+
+		// insert out of order
+		for _, i := range []int{2, 0, 1} {
+			noErr(t, b.Threads.Create(ctx, want[i]), "failed to create thread")
+		}
+
+		threads, err = b.Threads.FindMany(ctx)
+		noErr(t, err, "failed to find threads")
+		equal(t, len(threads), len(want), "wrong number of threads")
+		for i := range want {
+			equal(t, threads[i].ID, want[i].ID, "threads not in creation order")
+		}
+	})
+
+	t.Run("find thread with messages", func(t *testing.T) {
+		ctx, b := context.Background(), newBackend(t)
+
+		thread, other := chat.NewThread(), chat.NewThread()
+		noErr(t, b.Threads.Create(ctx, thread), "failed to create thread")
+		noErr(t, b.Threads.Create(ctx, other), "failed to create thread")
+
+		contents := []string{"first", "second", "third"}
+		for _, content := range contents {
+			msg := chat.NewMessage(thread, content)
+			noErr(t, b.Messages.Create(ctx, msg), "failed to create message")
+			check(t, msg.ID != 0, "message id not set")
+
+			noErr(t, b.Messages.Create(ctx, chat.NewMessage(other, "other "+content)), "failed to create message")
+		}
+
+		found, err := b.Threads.Find(ctx, thread.ID)
+		noErr(t, err, "failed to find thread")
+		equal(t, len(found.Messages), len(contents), "messages of another thread loaded")
+		for i, msg := range found.Messages {
+			equal(t, msg.Content, contents[i], "messages not in order")
+			if i > 0 {
+				check(t, msg.ID > found.Messages[i-1].ID, "message ids not increasing")
+			}
+		}
+	})
+
+	t.Run("for each message", func(t *testing.T) {
+		ctx, b := context.Background(), newBackend(t)
+
+		thread := chat.NewThread()
+		noErr(t, b.Threads.Create(ctx, thread), "failed to create thread")
+
+		senders := []string{"alice", "bob", "alice"}
+		for _, sender := range senders {
+			msg := chat.NewMessage(thread, "message "+sender)
+			msg.Sender = sender
+			noErr(t, b.Messages.Create(ctx, msg), "failed to create message")
+		}
+
+		var got []*chat.Message
+		err := b.Messages.ForEach(ctx, thread.ID, func(msg *chat.Message) error {
+			got = append(got, msg)
+			return nil
+		})
+		noErr(t, err, "failed to iterate messages")
+		equal(t, len(got), len(senders), "wrong number of messages")
+		for i, msg := range got {
+			equal(t, msg.Sender, senders[i], "sender not stored or wrong order")
+			check(t, msg.EditedAt == nil, "new message should not be edited")
+		}
+
+		errStop := errors.New("stop")
+		var n int
+		err = b.Messages.ForEach(ctx, thread.ID, func(msg *chat.Message) error {
+			n++
+			return errStop
+		})
+		check(t, errors.Is(err, errStop), "error of fn not returned")
+		equal(t, n, 1, "iteration should stop at the first error")
+
+		meta, err := b.Threads.FindMeta(ctx, thread.ID)
+		noErr(t, err, "failed to find thread")
+		equal(t, meta.ID, thread.ID, "thread id does not match")
+		equal(t, len(meta.Messages), 0, "messages should not be loaded")
+	})
+
+	t.Run("import thread", func(t *testing.T) {
+		ctx, b := context.Background(), newBackend(t)
+
+		createdAt := time.Now().UTC().Add(-48 * time.Hour).Truncate(time.Millisecond)
+		editedAt := createdAt.Add(time.Hour)
+
+		thread := chat.NewThread()
+		thread.CreatedAt = createdAt
+		thread.Retention = chat.Retention(24 * time.Hour)
+
+		msgs := []*chat.Message{
+			{Sender: "alice", Content: "first", CreatedAt: createdAt},
+			{Sender: "bob", Content: "second", CreatedAt: createdAt.Add(time.Minute), EditedAt: &editedAt},
+		}
+		noErr(t, b.Threads.Import(ctx, thread, messages(msgs)), "failed to import thread")
+
+		found, err := b.Threads.Find(ctx, thread.ID)
+		noErr(t, err, "failed to find thread")
+		check(t, sameTime(found.CreatedAt, createdAt), "created at not preserved")
+		equal(t, found.Retention, thread.Retention, "retention not preserved")
+		equal(t, len(found.Messages), len(msgs), "wrong number of messages")
+		for i, msg := range found.Messages {
+			equal(t, msg.Sender, msgs[i].Sender, "sender not preserved")
+			equal(t, msg.Content, msgs[i].Content, "content not preserved or wrong order")
+			check(t, sameTime(msg.CreatedAt, msgs[i].CreatedAt), "created at not preserved")
+			equal(t, msg.EditedAt != nil, msgs[i].EditedAt != nil, "edit state not preserved")
+		}
+		check(t, sameTime(*found.Messages[1].EditedAt, editedAt), "edited at not preserved")
+
+		err = b.Threads.Import(ctx, thread, messages(msgs))
+		check(t, errors.Is(err, repo.ErrConflict), "existing thread should conflict")
+
+		found, err = b.Threads.Find(ctx, thread.ID)
+		noErr(t, err, "failed to find thread")
+		equal(t, len(found.Messages), len(msgs), "messages imported twice")
+
+		errBad := errors.New("bad message")
+		failing := chat.NewThread()
+		err = b.Threads.Import(ctx, failing, func() (*chat.Message, error) {
+			return nil, errBad
+		})
+		check(t, errors.Is(err, errBad), "error of next not returned")
+
+		_, err = b.Threads.Find(ctx, failing.ID)
+		check(t, errors.Is(err, repo.ErrNotFound), "failed import should be rolled back")
+	})
+
+	t.Run("import deleted thread", func(t *testing.T) {
+		ctx, b := context.Background(), newBackend(t)
+
+		deletedAt := time.Now().UTC().Add(-time.Hour).Truncate(time.Millisecond)
+
+		thread := chat.NewThread()
+		thread.DeletedAt = &deletedAt
+		msgs := []*chat.Message{{Sender: "alice", Content: "first", CreatedAt: thread.CreatedAt}}
+		noErr(t, b.Threads.Import(ctx, thread, messages(msgs)), "failed to import thread")
+
+		_, err := b.Threads.FindMeta(ctx, thread.ID)
+		check(t, errors.Is(err, repo.ErrNotFound), "thread should be imported deleted")
+
+		found, err := b.Threads.FindDeletedMeta(ctx, thread.ID)
+		noErr(t, err, "failed to find deleted thread")
+		check(t, found.DeletedAt != nil && sameTime(*found.DeletedAt, deletedAt), "deleted at not preserved")
+
+		var n int
+		noErr(t, b.Messages.ForEach(ctx, thread.ID, func(msg *chat.Message) error { n++; return nil }), "failed to read messages")
+		equal(t, n, 1, "messages of deleted thread not imported")
+
+		noErr(t, b.Threads.Restore(ctx, thread.ID, deletedAt.Add(-time.Minute)), "failed to restore thread")
+		_, err = b.Threads.FindDeletedMeta(ctx, thread.ID)
+		check(t, errors.Is(err, repo.ErrNotFound), "live thread found deleted")
+	})
+
+	t.Run("expire messages", func(t *testing.T) {
+		ctx, b := context.Background(), newBackend(t)
+
+		now := time.Now().UTC()
+
+		kept, expiring := chat.NewThread(), chat.NewThread()
+		expiring.Retention = chat.Retention(time.Hour)
+		noErr(t, b.Threads.Create(ctx, kept), "failed to create thread")
+		noErr(t, b.Threads.Create(ctx, expiring), "failed to create thread")
+
+		for _, thread := range []*chat.Thread{kept, expiring} {
+			for _, age := range []time.Duration{3 * time.Hour, 2 * time.Hour, time.Minute} {
+				msg := chat.NewMessage(thread, "message")
+				msg.CreatedAt = now.Add(-age)
+				noErr(t, b.Messages.Create(ctx, msg), "failed to create message")
+			}
+		}
+
+		counts, err := b.Messages.CountExpired(ctx, now)
+		noErr(t, err, "failed to count expired messages")
+		equal(t, len(counts), 2, "one count per retention")
+		equal(t, counts[0].Retention, chat.RetainForever, "counts not ordered by retention")
+		equal(t, counts[0].Messages, int64(0), "messages kept forever should not expire")
+		equal(t, counts[1].Retention, chat.Retention(time.Hour), "retention not stored")
+		equal(t, counts[1].Threads, int64(1), "wrong number of threads")
+		equal(t, counts[1].Messages, int64(2), "wrong number of expired messages")
+
+		n, err := b.Messages.DeleteExpired(ctx, now, 1)
+		noErr(t, err, "failed to delete expired messages")
+		equal(t, n, int64(1), "batch size not respected")
+
+		n, err = b.Messages.DeleteExpired(ctx, now, 10)
+		noErr(t, err, "failed to delete expired messages")
+		equal(t, n, int64(1), "wrong number of expired messages deleted")
+
+		found, err := b.Threads.Find(ctx, expiring.ID)
+		noErr(t, err, "failed to find thread")
+		equal(t, found.Retention, expiring.Retention, "retention not stored")
+		equal(t, len(found.Messages), 1, "unexpired message deleted")
+		check(t, sameTime(found.Messages[0].CreatedAt, now.Add(-time.Minute)), "created at not stored")
+
+		found, err = b.Threads.Find(ctx, kept.ID)
+		noErr(t, err, "failed to find thread")
+		equal(t, len(found.Messages), 3, "messages kept forever deleted")
+
+		noErr(t, b.Threads.SetRetention(ctx, kept.ID, chat.Retention(time.Hour)), "failed to set retention")
+
+		n, err = b.Messages.DeleteExpired(ctx, now, 10)
+		noErr(t, err, "failed to delete expired messages")
+		equal(t, n, int64(2), "new retention not applied")
+
+		err = b.Threads.SetRetention(ctx, uuid.New(), chat.RetainForever)
+		check(t, errors.Is(err, repo.ErrNotFound), "missing thread should not be updated")
+	})
+
+	t.Run("count expired messages of live threads", func(t *testing.T) {
+		ctx, b := context.Background(), newBackend(t)
+
+		now := time.Now().UTC()
+
+		live, deleted := chat.NewThread(), chat.NewThread()
+		for _, thread := range []*chat.Thread{live, deleted} {
+			thread.Retention = chat.Retention(time.Hour)
+			noErr(t, b.Threads.Create(ctx, thread), "failed to create thread")
+
+			msg := chat.NewMessage(thread, "message")
+			msg.CreatedAt = now.Add(-2 * time.Hour)
+			noErr(t, b.Messages.Create(ctx, msg), "failed to create message")
+		}
+		noErr(t, b.Threads.Delete(ctx, deleted.ID), "failed to delete thread")
+
+		counts, err := b.Messages.CountExpired(ctx, now)
+		noErr(t, err, "failed to count expired messages")
+		equal(t, len(counts), 1, "one count per retention")
+		equal(t, counts[0].Threads, int64(1), "deleted thread counted")
+		equal(t, counts[0].Messages, int64(1), "messages of deleted thread counted")
+
+		n, err := b.Messages.DeleteExpired(ctx, now, 10)
+		noErr(t, err, "failed to delete expired messages")
+		equal(t, n, int64(2), "messages of deleted threads should still expire")
+	})
+
+	t.Run("search messages", func(t *testing.T) {
+		ctx, b := context.Background(), newBackend(t)
+
+		thread, other := chat.NewThread(), chat.NewThread()
+		noErr(t, b.Threads.Create(ctx, thread), "failed to create thread")
+		noErr(t, b.Threads.Create(ctx, other), "failed to create thread")
+
+		for _, content := range []string{"the quick brown fox", "lazy dogs sleeping", "so many foxes"} {
+			noErr(t, b.Messages.Create(ctx, chat.NewMessage(thread, content)), "failed to create message")
+		}
+		noErr(t, b.Messages.Create(ctx, chat.NewMessage(other, "a fox in another thread")), "failed to create message")
+
+		matches, err := b.Messages.Search(ctx, repo.MessageQuery{Text: "fox", Limit: 10})
+		noErr(t, err, "failed to search messages")
+		equal(t, len(matches), 3, "words should be stemmed")
+		for _, m := range matches {
+			check(t, strings.Contains(m.Snippet, repo.HighlightStart+"fox"), "match not highlighted")
+			equal(t, m.Message.Thread.ID, m.ThreadID, "thread of message not set")
+		}
+
+		matches, err = b.Messages.Search(ctx, repo.MessageQuery{Text: "fox", ThreadID: thread.ID, Limit: 10})
+		noErr(t, err, "failed to search messages")
+		equal(t, len(matches), 2, "search not limited to thread")
+		for _, m := range matches {
+			equal(t, m.ThreadID, thread.ID, "message of another thread found")
+		}
+
+		page, err := b.Messages.Search(ctx, repo.MessageQuery{Text: "fox", ThreadID: thread.ID, Limit: 1, Offset: 1})
+		noErr(t, err, "failed to search messages")
+		equal(t, len(page), 1, "limit not applied")
+		equal(t, page[0].Message.ID, matches[1].Message.ID, "offset not applied")
+
+		matches, err = b.Messages.Search(ctx, repo.MessageQuery{Text: "quick fox", Limit: 10})
+		noErr(t, err, "failed to search messages")
+		equal(t, len(matches), 1, "every word should match")
+
+		_, err = b.Messages.Search(ctx, repo.MessageQuery{Text: `"fox OR (`, Limit: 10})
+		noErr(t, err, "query syntax should not be interpreted")
+
+		matches, err = b.Messages.Search(ctx, repo.MessageQuery{Text: "fox or dogs", Limit: 10})
+		noErr(t, err, "failed to search messages")
+		equal(t, len(matches), 0, "or should not be an operator")
+
+		matches, err = b.Messages.Search(ctx, repo.MessageQuery{Text: "-fox", Limit: 10})
+		noErr(t, err, "failed to search messages")
+		equal(t, len(matches), 3, "a leading - should not exclude the word")
+
+		msg := chat.NewMessage(other, "ann was here")
+		msg.Sender = "ann"
+		noErr(t, b.Messages.Create(ctx, msg), "failed to create message")
+
+		matches, err = b.Messages.Search(ctx, repo.MessageQuery{Text: "fox", Member: "ann", Limit: 10})
+		noErr(t, err, "failed to search messages")
+		equal(t, len(matches), 1, "search not limited to the threads of the member")
+		equal(t, matches[0].ThreadID, other.ID, "message of a thread the member is not in found")
+
+		matches, err = b.Messages.Search(ctx, repo.MessageQuery{Text: "fox", Member: "bob", Limit: 10})
+		noErr(t, err, "failed to search messages")
+		equal(t, len(matches), 0, "messages of threads without the member found")
+
+		noErr(t, b.Threads.Delete(ctx, other.ID), "failed to delete thread")
+
+		matches, err = b.Messages.Search(ctx, repo.MessageQuery{Text: "another", Limit: 10})
+		noErr(t, err, "failed to search messages")
+		equal(t, len(matches), 0, "messages of deleted threads found")
+	})
+
+	t.Run("delete thread", func(t *testing.T) {
+		ctx, b := context.Background(), newBackend(t)
+
+		thread, other := chat.NewThread(), chat.NewThread()
+		noErr(t, b.Threads.Create(ctx, thread), "failed to create thread")
+		noErr(t, b.Threads.Create(ctx, other), "failed to create thread")
+
+		noErr(t, b.Threads.Delete(ctx, thread.ID), "failed to delete thread")
+
+		_, err := b.Threads.Find(ctx, thread.ID)
+		check(t, errors.Is(err, repo.ErrNotFound), "deleted thread should not be found")
+
+		threads, err := b.Threads.FindMany(ctx)
+		noErr(t, err, "failed to find threads")
+		equal(t, len(threads), 1, "deleted thread should not be listed")
+		equal(t, threads[0].ID, other.ID, "wrong thread deleted")
+
+		err = b.Threads.Delete(ctx, thread.ID)
+		check(t, errors.Is(err, repo.ErrNotFound), "thread deleted twice")
+	})
+
+	t.Run("restore thread", func(t *testing.T) {
+		ctx, b := context.Background(), newBackend(t)
+
+		thread := chat.NewThread()
+		noErr(t, b.Threads.Create(ctx, thread), "failed to create thread")
+		noErr(t, b.Messages.Create(ctx, chat.NewMessage(thread, "hello")), "failed to create message")
+
+		err := b.Threads.Restore(ctx, thread.ID, time.Time{})
+		check(t, errors.Is(err, repo.ErrNotFound), "live thread should not be restored")
+
+		noErr(t, b.Threads.Delete(ctx, thread.ID), "failed to delete thread")
+
+		err = b.Threads.Restore(ctx, thread.ID, time.Now().Add(time.Hour))
+		check(t, errors.Is(err, repo.ErrNotFound), "thread deleted before the grace period")
+
+		noErr(t, b.Threads.Restore(ctx, thread.ID, time.Now().Add(-time.Hour)), "failed to restore thread")
+
+		found, err := b.Threads.Find(ctx, thread.ID)
+		noErr(t, err, "restored thread should be found")
+		equal(t, len(found.Messages), 1, "messages should be kept")
+	})
+
+	t.Run("purge deleted threads", func(t *testing.T) {
+		ctx, b := context.Background(), newBackend(t)
+
+		thread, other := chat.NewThread(), chat.NewThread()
+		noErr(t, b.Threads.Create(ctx, thread), "failed to create thread")
+		noErr(t, b.Threads.Create(ctx, other), "failed to create thread")
+		noErr(t, b.Messages.Create(ctx, chat.NewMessage(thread, "hello")), "failed to create message")
+
+		a := chat.NewAttachment(thread.ID, "a.txt", "text/plain", 5)
+		a.Hash = "hash"
+		noErr(t, b.Attachments.Create(ctx, a), "failed to create attachment")
+
+		err := b.Threads.Purge(ctx, thread.ID)
+		check(t, errors.Is(err, repo.ErrNotFound), "live thread should not be purged")
+
+		noErr(t, b.Threads.Delete(ctx, thread.ID), "failed to delete thread")
+
+		ids, err := b.Threads.FindDeleted(ctx, time.Now().Add(-time.Hour))
+		noErr(t, err, "failed to find deleted threads")
+		equal(t, len(ids), 0, "thread deleted too recently")
+
+		ids, err = b.Threads.FindDeleted(ctx, time.Now().Add(time.Second))
+		noErr(t, err, "failed to find deleted threads")
+		equal(t, len(ids), 1, "wrong number of deleted threads")
+		equal(t, ids[0], thread.ID, "wrong deleted thread")
+
+		noErr(t, b.Threads.Purge(ctx, thread.ID), "failed to purge thread")
+
+		as, err := b.Attachments.FindMany(ctx, thread.ID)
+		noErr(t, err, "failed to find attachments")
+		equal(t, len(as), 0, "attachments should be purged")
+
+		err = b.Threads.Restore(ctx, thread.ID, time.Time{})
+		check(t, errors.Is(err, repo.ErrNotFound), "purged thread should not be restored")
+
+		ids, err = b.Threads.FindDeleted(ctx, time.Now().Add(time.Second))
+		noErr(t, err, "failed to find deleted threads")
+		equal(t, len(ids), 0, "purged thread still listed")
+	})
+}
+
+// noErr stops the test with msg if err isn't nil.
+func noErr(t *testing.T, err error, msg string) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatalf("%s: %v", msg, err)
+	}
+}
+
+// equal stops the test with msg if got isn't want.
+func equal[T comparable](t *testing.T, got, want T, msg string) {
+	t.Helper()
+
+	if got != want {
+		t.Fatalf("%s: got %v, want %v", msg, got, want)
+	}
+}
+
+// check stops the test with msg if ok is false.
+func check(t *testing.T, ok bool, msg string) {
+	t.Helper()
+
+	if !ok {
+		t.Fatal(msg)
+	}
+}
+
+// messages returns a next function for Import.
+func messages(msgs []*chat.Message) func() (*chat.Message, error) {
+	var i int
+	return func() (*chat.Message, error) {
+		if i == len(msgs) {
+			return nil, io.EOF
+		}
+		// Import sets the thread of the message
+		msg := *msgs[i]
+		i++
+		return &msg, nil
+	}
+}
+
+// sameTime compares times at the precision kept by every backend.
+func sameTime(a, b time.Time) bool {
+	d := a.Sub(b)
+	return d > -time.Millisecond && d < time.Millisecond
+}
@@ -0,0 +1,19 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+)
+
+// conn is implemented by *sql.DB and *sql.Tx, so that repositories can
+// run inside a transaction.
+type conn interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+var (
+	_ conn = (*sql.DB)(nil)
+	_ conn = (*sql.Tx)(nil)
+)
@@ -0,0 +1,31 @@
+package repo
+
+import (
+	"database/sql"
+	"errors"
+
+	repo "com.adoublef.wss/internal/communications/sql"
+	"github.com/mattn/go-sqlite3"
+)
+
+// wrapError maps driver errors onto the errors of the repo package.
+func wrapError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return repo.WrapError(repo.ErrNotFound, err)
+	}
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrConstraint {
+		if sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey {
+			// the row referenced, such as the thread of a message, is missing
+			return repo.WrapError(repo.ErrNotFound, err)
+		}
+		return repo.WrapError(repo.ErrConflict, err)
+	}
+
+	return err
+}
@@ -0,0 +1,68 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+
+	intern "com.adoublef.wss/internal/communications"
+	repo "com.adoublef.wss/internal/communications/sql"
+	"github.com/google/uuid"
+)
+
+type AttachmentRepo = repo.AttachmentRepo
+
+var _ AttachmentRepo = (*attachmentRepo)(nil)
+
+type attachmentRepo struct {
+	db *sql.DB
+}
+
+func (r *attachmentRepo) Create(ctx context.Context, a *intern.Attachment) error {
+	q := `INSERT INTO "attachments" (id, chat_id, name, mime_type, size, hash, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`
+
+	_, err := r.db.ExecContext(ctx, q, a.ID, a.ThreadID, a.Name, a.MimeType, a.Size, a.Hash, a.CreatedAt)
+	return wrapError(err)
+}
+
+func (r *attachmentRepo) Find(ctx context.Context, threadID, id uuid.UUID) (*intern.Attachment, error) {
+	q := `SELECT id, chat_id, name, mime_type, size, hash, created_at FROM "attachments" WHERE id = ? AND chat_id = ?`
+
+	var a intern.Attachment
+	err := r.db.QueryRowContext(ctx, q, id, threadID).Scan(&a.ID, &a.ThreadID, &a.Name, &a.MimeType, &a.Size, &a.Hash, &a.CreatedAt)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+
+	return &a, nil
+}
+
+func (r *attachmentRepo) FindMany(ctx context.Context, threadID uuid.UUID) ([]*intern.Attachment, error) {
+	q := `SELECT id, chat_id, name, mime_type, size, hash, created_at FROM "attachments" WHERE chat_id = ? ORDER BY created_at, id`
+
+	rows, err := r.db.QueryContext(ctx, q, threadID)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	defer rows.Close()
+
+	as := []*intern.Attachment{}
+	for rows.Next() {
+		var a intern.Attachment
+
+		if err := rows.Scan(&a.ID, &a.ThreadID, &a.Name, &a.MimeType, &a.Size, &a.Hash, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		as = append(as, &a)
+	}
+
+	return as, rows.Err()
+}
+
+func NewAttachmentRepo(conn *sql.DB) AttachmentRepo {
+	r := attachmentRepo{
+		db: conn,
+	}
+
+	return &r
+}
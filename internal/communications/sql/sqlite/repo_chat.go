@@ -3,12 +3,16 @@ package repo
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"io"
+	"time"
 
 	intern "com.adoublef.wss/internal/communications"
 	repo "com.adoublef.wss/internal/communications/sql"
+	"github.com/google/uuid"
 )
 
-type ThreadRepo repo.Repo[*intern.Thread]
+type ThreadRepo = repo.ThreadRepo
 
 var _ ThreadRepo = (*chatRepo)(nil)
 
@@ -16,72 +20,146 @@ type chatRepo struct {
 	db *sql.DB
 }
 
-func (r *chatRepo) Delete(ctx context.Context, key any) error {
-	q := `DELETE FROM "chats" WHERE id = ?`
+func (r *chatRepo) Delete(ctx context.Context, id uuid.UUID) error {
+	q := `UPDATE "chats" SET deleted_at = ? WHERE id = ? AND deleted_at IS NULL`
 
-	_, err := r.db.ExecContext(ctx, q, key)
-	return err
+	res, err := r.db.ExecContext(ctx, q, time.Now().UTC(), id)
+	if err != nil {
+		return wrapError(err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return repo.ErrNotFound
+	}
+
+	return nil
 }
 
 func (r *chatRepo) Create(ctx context.Context, chat *intern.Thread) error {
-	q := `INSERT INTO "chats" (id) VALUES (?)`
+	return createChat(ctx, r.db, chat)
+}
+
+func createChat(ctx context.Context, db conn, chat *intern.Thread) error {
+	q := `INSERT INTO "chats" (id, created_at, message_retention, deleted_at) VALUES (?, ?, ?, ?)`
+
+	if chat.CreatedAt.IsZero() {
+		chat.CreatedAt = time.Now().UTC()
+	}
 
-	_, err := r.db.ExecContext(ctx, q, chat.ID)
-	return err
+	var deletedAt any
+	if chat.DeletedAt != nil {
+		deletedAt = chat.DeletedAt.UTC()
+	}
+
+	_, err := db.ExecContext(ctx, q, chat.ID, chat.CreatedAt, chat.Retention.Seconds(), deletedAt)
+	return wrapError(err)
 }
 
-func (r *chatRepo) Find(ctx context.Context, key any) (*intern.Thread, error) {
-	q1 := `SELECT id FROM "chats" WHERE id = ?`
-	var chat intern.Thread = intern.Thread{
-		Messages: make([]*intern.Message, 0),
+func (r *chatRepo) Import(ctx context.Context, chat *intern.Thread, next func() (*intern.Message, error)) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := createChat(ctx, tx, chat); err != nil {
+		return err
 	}
 
-	err := r.db.QueryRowContext(ctx, q1, key).Scan(&chat.ID)
+	msgs := &messageRepo{db: tx}
+	for {
+		msg, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		msg.Thread = chat
+		if err := msgs.Create(ctx, msg); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (r *chatRepo) Find(ctx context.Context, id uuid.UUID) (*intern.Thread, error) {
+	chat, err := r.FindMeta(ctx, id)
 	if err != nil {
 		return nil, err
 	}
 
 	// populate messages
-	q2 := `SELECT content FROM "messages" WHERE chat_id = ?`
-	rows, err := r.db.QueryContext(ctx, q2, key)
+	chat.Messages = make([]*intern.Message, 0)
+	err = NewMessageRepo(r.db).ForEach(ctx, id, func(msg *intern.Message) error {
+		msg.Thread = chat
+		chat.Messages = append(chat.Messages, msg)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var msg intern.Message
+	return chat, nil
+}
 
-		if err := rows.Scan(&msg.Content); err != nil {
-			return nil, err
-		}
+func (r *chatRepo) FindMeta(ctx context.Context, id uuid.UUID) (*intern.Thread, error) {
+	q := `SELECT id, created_at, message_retention FROM "chats" WHERE id = ? AND deleted_at IS NULL`
 
-		chat.Messages = append(chat.Messages, &msg)
+	var (
+		chat      intern.Thread
+		retention int64
+	)
+	err := r.db.QueryRowContext(ctx, q, id).Scan(&chat.ID, &chat.CreatedAt, &retention)
+	if err != nil {
+		return nil, wrapError(err)
 	}
+	chat.Retention = intern.RetentionFromSeconds(retention)
 
-	if err := rows.Err(); err != nil {
-		return nil, err
+	return &chat, nil
+}
+
+func (r *chatRepo) FindDeletedMeta(ctx context.Context, id uuid.UUID) (*intern.Thread, error) {
+	q := `SELECT id, created_at, message_retention, deleted_at FROM "chats" WHERE id = ? AND deleted_at IS NOT NULL`
+
+	var (
+		chat      intern.Thread
+		retention int64
+	)
+	err := r.db.QueryRowContext(ctx, q, id).Scan(&chat.ID, &chat.CreatedAt, &retention, &chat.DeletedAt)
+	if err != nil {
+		return nil, wrapError(err)
 	}
+	chat.Retention = intern.RetentionFromSeconds(retention)
 
 	return &chat, nil
 }
 
 func (r *chatRepo) FindMany(ctx context.Context) ([]*intern.Thread, error) {
-	q := `SELECT id FROM "chats"`
+	q := `SELECT id, created_at, message_retention FROM "chats" WHERE deleted_at IS NULL ORDER BY created_at, id`
 
 	rows, err := r.db.QueryContext(ctx, q)
 	if err != nil {
-		return nil, err
+		return nil, wrapError(err)
 	}
 	defer rows.Close()
 
 	cs := []*intern.Thread{}
 	for rows.Next() {
-		var c intern.Thread
+		var (
+			c         intern.Thread
+			retention int64
+		)
 
-		if err := rows.Scan(&c.ID); err != nil {
+		if err := rows.Scan(&c.ID, &c.CreatedAt, &retention); err != nil {
 			return nil, err
 		}
+		c.Retention = intern.RetentionFromSeconds(retention)
 
 		cs = append(cs, &c)
 	}
@@ -89,6 +167,101 @@ func (r *chatRepo) FindMany(ctx context.Context) ([]*intern.Thread, error) {
 	return cs, rows.Err()
 }
 
+func (r *chatRepo) Restore(ctx context.Context, id uuid.UUID, deletedAfter time.Time) error {
+	q := `UPDATE "chats" SET deleted_at = NULL WHERE id = ? AND deleted_at > ?`
+
+	res, err := r.db.ExecContext(ctx, q, id, deletedAfter.UTC())
+	if err != nil {
+		return wrapError(err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return repo.ErrNotFound
+	}
+
+	return nil
+}
+
+func (r *chatRepo) FindDeleted(ctx context.Context, deletedBefore time.Time) ([]uuid.UUID, error) {
+	q := `SELECT id FROM "chats" WHERE deleted_at < ? ORDER BY deleted_at`
+
+	rows, err := r.db.QueryContext(ctx, q, deletedBefore.UTC())
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	defer rows.Close()
+
+	var ids []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+func (r *chatRepo) Purge(ctx context.Context, id uuid.UUID) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// foreign keys are not enforced so the rows referencing the chat
+	// are deleted first
+	for _, q := range []string{
+		`DELETE FROM "messages" WHERE chat_id = ?`,
+		`DELETE FROM "attachments" WHERE chat_id = ?`,
+	} {
+		if _, err := tx.ExecContext(ctx, q, id); err != nil {
+			return wrapError(err)
+		}
+	}
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM "chats" WHERE id = ? AND deleted_at IS NOT NULL`, id)
+	if err != nil {
+		return wrapError(err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return repo.ErrNotFound
+	}
+
+	return tx.Commit()
+}
+
+func (r *chatRepo) SetRetention(ctx context.Context, id uuid.UUID, retention intern.Retention) error {
+	q := `UPDATE "chats" SET message_retention = ? WHERE id = ? AND deleted_at IS NULL`
+
+	res, err := r.db.ExecContext(ctx, q, retention.Seconds(), id)
+	if err != nil {
+		return wrapError(err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return repo.ErrNotFound
+	}
+
+	return nil
+}
+
 func NewChatRepo(conn *sql.DB) ThreadRepo {
 	r := chatRepo{
 		db: conn,
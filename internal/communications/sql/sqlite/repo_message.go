@@ -0,0 +1,207 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	intern "com.adoublef.wss/internal/communications"
+	repo "com.adoublef.wss/internal/communications/sql"
+	"github.com/google/uuid"
+)
+
+type MessageRepo = repo.MessageRepo
+
+var _ MessageRepo = (*messageRepo)(nil)
+
+type messageRepo struct {
+	db conn
+}
+
+func (r *messageRepo) Create(ctx context.Context, msg *intern.Message) error {
+	q := `INSERT INTO "messages" (chat_id, sender, content, edited_at, created_at) VALUES (?, ?, ?, ?, ?)`
+
+	if msg.CreatedAt.IsZero() {
+		msg.CreatedAt = time.Now().UTC()
+	}
+
+	res, err := r.db.ExecContext(ctx, q, msg.Thread.ID, msg.Sender, msg.Content, msg.EditedAt, msg.CreatedAt)
+	if err != nil {
+		return wrapError(err)
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	msg.ID = int(id)
+	return nil
+}
+
+func (r *messageRepo) ForEach(ctx context.Context, threadID uuid.UUID, fn func(msg *intern.Message) error) error {
+	q := `SELECT id, sender, content, edited_at, created_at FROM "messages" WHERE chat_id = ? ORDER BY id`
+
+	rows, err := r.db.QueryContext(ctx, q, threadID)
+	if err != nil {
+		return wrapError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var msg intern.Message
+
+		if err := rows.Scan(&msg.ID, &msg.Sender, &msg.Content, &msg.EditedAt, &msg.CreatedAt); err != nil {
+			return err
+		}
+
+		if err := fn(&msg); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// expired selects the messages that have outlived the retention of their
+// chat at the time given as the first argument. Retentions are in seconds
+// and julianday in days.
+const expired = `c.message_retention > 0 AND julianday(m.created_at) < julianday(?) - c.message_retention / 86400.0`
+
+func (r *messageRepo) DeleteExpired(ctx context.Context, now time.Time, limit int) (int64, error) {
+	q := `DELETE FROM "messages" WHERE id IN (
+		SELECT m.id FROM "messages" m
+		JOIN "chats" c ON c.id = m.chat_id
+		WHERE ` + expired + `
+		ORDER BY m.id LIMIT ?
+	)`
+
+	res, err := r.db.ExecContext(ctx, q, now.UTC(), limit)
+	if err != nil {
+		return 0, wrapError(err)
+	}
+
+	return res.RowsAffected()
+}
+
+func (r *messageRepo) CountExpired(ctx context.Context, now time.Time) ([]*repo.RetentionCount, error) {
+	q := `SELECT c.message_retention, COUNT(DISTINCT c.id), COUNT(CASE WHEN ` + expired + ` THEN 1 END)
+	FROM "chats" c
+	LEFT JOIN "messages" m ON m.chat_id = c.id
+	WHERE c.deleted_at IS NULL
+	GROUP BY c.message_retention
+	ORDER BY c.message_retention`
+
+	rows, err := r.db.QueryContext(ctx, q, now.UTC())
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	defer rows.Close()
+
+	counts := []*repo.RetentionCount{}
+	for rows.Next() {
+		var (
+			c         repo.RetentionCount
+			retention int64
+		)
+
+		if err := rows.Scan(&retention, &c.Threads, &c.Messages); err != nil {
+			return nil, err
+		}
+		c.Retention = intern.RetentionFromSeconds(retention)
+
+		counts = append(counts, &c)
+	}
+
+	return counts, rows.Err()
+}
+
+func (r *messageRepo) Search(ctx context.Context, q repo.MessageQuery) ([]*repo.MessageMatch, error) {
+	match := matchExpr(q.Text)
+	if match == "" {
+		return []*repo.MessageMatch{}, nil
+	}
+
+	query := `SELECT m.id, m.chat_id, m.sender, m.content, m.edited_at, m.created_at, snippet("messages_fts", 0, ?, ?, '…', 16)
+	FROM "messages_fts" f
+	JOIN "messages" m ON m.id = f.rowid
+	JOIN "chats" c ON c.id = m.chat_id
+	WHERE "messages_fts" MATCH ? AND c.deleted_at IS NULL`
+	args := []any{repo.HighlightStart, repo.HighlightStop, match}
+
+	if q.ThreadID != uuid.Nil {
+		query += ` AND m.chat_id = ?`
+		args = append(args, q.ThreadID)
+	}
+
+	if q.Member != "" {
+		query += ` AND EXISTS (SELECT 1 FROM "messages" s WHERE s.chat_id = m.chat_id AND s.sender = ?)`
+		args = append(args, q.Member)
+	}
+
+	query += ` ORDER BY bm25("messages_fts"), m.id LIMIT ? OFFSET ?`
+	args = append(args, q.Limit, q.Offset)
+
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	defer rows.Close()
+
+	matches := []*repo.MessageMatch{}
+	for rows.Next() {
+		var (
+			m   repo.MessageMatch
+			msg intern.Message
+		)
+
+		if err := rows.Scan(&msg.ID, &m.ThreadID, &msg.Sender, &msg.Content, &msg.EditedAt, &msg.CreatedAt, &m.Snippet); err != nil {
+			return nil, err
+		}
+		msg.Thread = &intern.Thread{ID: m.ThreadID}
+		m.Message = &msg
+
+		matches = append(matches, &m)
+	}
+
+	return matches, rows.Err()
+}
+
+// matchExpr turns text into an FTS5 query matching every word of it. The
+// words are quoted so that the query syntax of FTS5 can't be used.
+func matchExpr(text string) string {
+	words := strings.Fields(text)
+	for i, w := range words {
+		words[i] = `"` + strings.ReplaceAll(w, `"`, `""`) + `"`
+	}
+
+	return strings.Join(words, " ")
+}
+
+// ErrNoFTS5 is returned by CheckFTS5 when sqlite can't search messages.
+var ErrNoFTS5 = errors.New("sqlite is built without FTS5, build with -tags sqlite_fts5")
+
+// CheckFTS5 returns ErrNoFTS5 if the sqlite linked in lacks the FTS5
+// extension that messages are searched with. The migrations can't be
+// applied without it.
+func CheckFTS5(ctx context.Context, db *sql.DB) error {
+	var ok bool
+	if err := db.QueryRowContext(ctx, `SELECT sqlite_compileoption_used('ENABLE_FTS5')`).Scan(&ok); err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNoFTS5
+	}
+
+	return nil
+}
+
+func NewMessageRepo(conn *sql.DB) MessageRepo {
+	r := messageRepo{
+		db: conn,
+	}
+
+	return &r
+}
@@ -0,0 +1,48 @@
+package repo_test
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"com.adoublef.wss/internal/communications/sql/repotest"
+	repo "com.adoublef.wss/internal/communications/sql/sqlite"
+	"com.adoublef.wss/internal/migrate"
+	"com.adoublef.wss/sqlite/migrations"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newBackend(t *testing.T) repotest.Backend {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection to :memory: is a new database
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	m, err := migrate.New(migrate.NewSqliteDriver(db), migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every backend must search messages, fail rather than skip
+	if err := repo.CheckFTS5(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return repotest.Backend{
+		Threads:     repo.NewChatRepo(db),
+		Messages:    repo.NewMessageRepo(db),
+		Attachments: repo.NewAttachmentRepo(db),
+	}
+}
+
+func TestConformance(t *testing.T) {
+	repotest.Run(t, newBackend)
+}
@@ -0,0 +1,362 @@
+// Package transfer copies threads, messages and attachments from one
+// storage backend to another, for example from a sqlite file used while
+// prototyping to Postgres.
+//
+// Each thread is copied with its messages in a single transaction, so the
+// destination itself records how far a copy got: running it again after
+// an interruption skips the threads that are already there and carries on
+// with the rest. Deleted threads are copied deleted, so that they can
+// still be restored or purged on time.
+//
+// Only the attachment rows are copied. Their content is kept in a blob
+// store that doesn't depend on the backend, it is addressed by hash and
+// can be used by the destination as it is.
+package transfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	chat "com.adoublef.wss/internal/communications"
+	repo "com.adoublef.wss/internal/communications/sql"
+	"github.com/google/uuid"
+)
+
+// DefaultBatch is how many messages are read ahead from the source while
+// they are written to the destination.
+const DefaultBatch = 500
+
+// Store is the set of repositories of a backend.
+type Store struct {
+	Threads     repo.ThreadRepo
+	Messages    repo.MessageRepo
+	Attachments repo.AttachmentRepo
+}
+
+// Report is the outcome of a copy.
+type Report struct {
+	// Copied and Skipped count the threads written to the destination and
+	// those that were already there, deleted threads included.
+	Copied  int `json:"copied"`
+	Skipped int `json:"skipped"`
+	// Deleted counts the threads of the source that are deleted.
+	Deleted int `json:"deleted"`
+
+	Source      Totals      `json:"source"`
+	Destination Totals      `json:"destination"`
+	Mismatches  []*Mismatch `json:"mismatches"`
+}
+
+// OK reports whether the destination holds the same data as the source.
+func (r *Report) OK() bool {
+	return len(r.Mismatches) == 0 && r.Source == r.Destination
+}
+
+// Totals counts the rows of the threads that were compared.
+type Totals struct {
+	Threads     int64 `json:"threads"`
+	Messages    int64 `json:"messages"`
+	Attachments int64 `json:"attachments"`
+}
+
+// Mismatch is a thread that differs between the source and the
+// destination.
+type Mismatch struct {
+	ID     uuid.UUID `json:"id"`
+	Detail string    `json:"detail"`
+}
+
+// Copier copies every thread of a source to a destination.
+type Copier struct {
+	src, dst Store
+	batch    int
+	progress func(done, total int)
+}
+
+// Option configures a Copier.
+type Option func(c *Copier)
+
+// WithProgress sets a function called after each thread is copied, with
+// the number of threads done so far out of total.
+func WithProgress(fn func(done, total int)) Option {
+	return func(c *Copier) {
+		c.progress = fn
+	}
+}
+
+func NewCopier(src, dst Store, batch int, opts ...Option) *Copier {
+	if batch <= 0 {
+		batch = DefaultBatch
+	}
+
+	c := &Copier{
+		src:      src,
+		dst:      dst,
+		batch:    batch,
+		progress: func(done, total int) {},
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// Copy copies the threads that are missing from the destination and then
+// verifies every thread by comparing row counts and checksums of both
+// sides.
+func (c *Copier) Copy(ctx context.Context) (*Report, error) {
+	ts, err := c.threads(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{Mismatches: []*Mismatch{}}
+	for i, t := range ts {
+		copied, err := c.copyThread(ctx, t)
+		if err != nil {
+			return report, fmt.Errorf("copy thread %s: %w", t.ID, err)
+		}
+
+		if copied {
+			report.Copied++
+		} else {
+			report.Skipped++
+		}
+		if t.DeletedAt != nil {
+			report.Deleted++
+		}
+
+		c.progress(i+1, len(ts))
+	}
+
+	for _, t := range ts {
+		if err := c.verify(ctx, t, report); err != nil {
+			return report, fmt.Errorf("verify thread %s: %w", t.ID, err)
+		}
+	}
+
+	return report, nil
+}
+
+// threads returns the live threads of the source followed by the deleted
+// ones. A thread deleted while they are listed is only returned deleted.
+func (c *Copier) threads(ctx context.Context) ([]*chat.Thread, error) {
+	live, err := c.src.Threads.FindMany(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := c.src.Threads.FindDeleted(ctx, time.Now().Add(time.Hour))
+	if err != nil {
+		return nil, err
+	}
+
+	deleted := make(map[uuid.UUID]bool, len(ids))
+	for _, id := range ids {
+		deleted[id] = true
+	}
+
+	ts := make([]*chat.Thread, 0, len(live)+len(ids))
+	for _, t := range live {
+		if !deleted[t.ID] {
+			ts = append(ts, t)
+		}
+	}
+
+	for _, id := range ids {
+		t, err := c.src.Threads.FindDeletedMeta(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("find deleted thread %s: %w", id, err)
+		}
+		ts = append(ts, t)
+	}
+
+	return ts, nil
+}
+
+// copyThread copies a thread and its messages unless the destination
+// already has it, then copies the attachments that are missing. It reports
+// whether the thread was copied.
+func (c *Copier) copyThread(ctx context.Context, t *chat.Thread) (bool, error) {
+	var copied bool
+	_, err := c.dst.Threads.FindMeta(ctx, t.ID)
+	switch {
+	case errors.Is(err, repo.ErrNotFound):
+		err = c.importThread(ctx, t)
+		// a thread deleted in the destination is reported by verify
+		if errors.Is(err, repo.ErrConflict) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		copied = true
+	case err != nil:
+		return false, err
+	}
+
+	// attachments aren't part of the import so a copy may have stopped
+	// between the two
+	as, err := c.src.Attachments.FindMany(ctx, t.ID)
+	if err != nil {
+		return false, err
+	}
+	for _, a := range as {
+		err := c.dst.Attachments.Create(ctx, a)
+		if err != nil && !errors.Is(err, repo.ErrConflict) {
+			return false, err
+		}
+	}
+
+	return copied, nil
+}
+
+// importThread streams the messages of a thread from the source into an
+// import on the destination, reading up to batch messages ahead.
+func (c *Copier) importThread(ctx context.Context, t *chat.Thread) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		msgs   = make(chan *chat.Message, c.batch)
+		srcErr error
+	)
+	go func() {
+		defer close(msgs)
+		srcErr = c.src.Messages.ForEach(ctx, t.ID, func(msg *chat.Message) error {
+			select {
+			case msgs <- msg:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+
+	err := c.dst.Threads.Import(ctx, t, func() (*chat.Message, error) {
+		msg, ok := <-msgs
+		if !ok {
+			if srcErr != nil {
+				return nil, srcErr
+			}
+			return nil, io.EOF
+		}
+
+		return msg, nil
+	})
+
+	// let the reader stop before returning
+	cancel()
+	for range msgs {
+	}
+
+	return err
+}
+
+func (c *Copier) verify(ctx context.Context, t *chat.Thread, report *Report) error {
+	deleted := t.DeletedAt != nil
+
+	want, err := checksum(ctx, c.src, t.ID, deleted)
+	if err != nil {
+		return err
+	}
+	report.Source.add(want)
+
+	got, err := checksum(ctx, c.dst, t.ID, deleted)
+	if errors.Is(err, repo.ErrNotFound) {
+		detail := "missing or deleted in destination"
+		if deleted {
+			detail = "missing or not deleted in destination"
+		}
+		report.Mismatches = append(report.Mismatches, &Mismatch{ID: t.ID, Detail: detail})
+		return nil
+	} else if err != nil {
+		return err
+	}
+	report.Destination.add(got)
+
+	var detail string
+	switch {
+	case got.messages != want.messages:
+		detail = fmt.Sprintf("%d messages, want %d", got.messages, want.messages)
+	case got.attachments != want.attachments:
+		detail = fmt.Sprintf("%d attachments, want %d", got.attachments, want.attachments)
+	case got.sum != want.sum:
+		detail = fmt.Sprintf("checksum %s, want %s", got.sum, want.sum)
+	}
+	if detail != "" {
+		report.Mismatches = append(report.Mismatches, &Mismatch{ID: t.ID, Detail: detail})
+	}
+
+	return nil
+}
+
+type threadSum struct {
+	messages, attachments int64
+	sum                   string
+}
+
+func (t *Totals) add(s *threadSum) {
+	t.Threads++
+	t.Messages += s.messages
+	t.Attachments += s.attachments
+}
+
+// checksum hashes what a backend stores of a live or deleted thread,
+// leaving out the message ids which each backend assigns itself. Times are
+// compared to the microsecond, the precision of Postgres.
+func checksum(ctx context.Context, s Store, id uuid.UUID, deleted bool) (*threadSum, error) {
+	find := s.Threads.FindMeta
+	if deleted {
+		find = s.Threads.FindDeletedMeta
+	}
+
+	t, err := find(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var ts threadSum
+	h := sha256.New()
+	fmt.Fprintf(h, "thread %s %s %d", t.ID, timestamp(t.CreatedAt), t.Retention.Seconds())
+	if t.DeletedAt != nil {
+		fmt.Fprintf(h, " %s", timestamp(*t.DeletedAt))
+	}
+	fmt.Fprintln(h)
+
+	err = s.Messages.ForEach(ctx, id, func(msg *chat.Message) error {
+		ts.messages++
+		fmt.Fprintf(h, "message %q %q %s", msg.Sender, msg.Content, timestamp(msg.CreatedAt))
+		if msg.EditedAt != nil {
+			fmt.Fprintf(h, " %s", timestamp(*msg.EditedAt))
+		}
+		fmt.Fprintln(h)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	as, err := s.Attachments.FindMany(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range as {
+		ts.attachments++
+		fmt.Fprintf(h, "attachment %s %q %q %d %s %s", a.ID, a.Name, a.MimeType, a.Size, a.Hash, timestamp(a.CreatedAt))
+		fmt.Fprintln(h)
+	}
+
+	ts.sum = hex.EncodeToString(h.Sum(nil))
+	return &ts, nil
+}
+
+func timestamp(t time.Time) string {
+	return t.UTC().Truncate(time.Microsecond).Format(time.RFC3339Nano)
+}
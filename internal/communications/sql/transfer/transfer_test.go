@@ -0,0 +1,193 @@
+package transfer_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	repo "com.adoublef.wss/internal/communications/sql"
+	sqlite "com.adoublef.wss/internal/communications/sql/sqlite"
+	"com.adoublef.wss/internal/communications/sql/transfer"
+	"com.adoublef.wss/internal/migrate"
+	"com.adoublef.wss/sqlite/migrations"
+	"github.com/hyphengolang/prelude/testing/is"
+
+	chat "com.adoublef.wss/internal/communications"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var errStop = errors.New("stop")
+
+func newStore(t *testing.T) transfer.Store {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection to :memory: is a new database
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	m, err := migrate.New(migrate.NewSqliteDriver(db), migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sqlite.CheckFTS5(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return transfer.Store{
+		Threads:     sqlite.NewChatRepo(db),
+		Messages:    sqlite.NewMessageRepo(db),
+		Attachments: sqlite.NewAttachmentRepo(db),
+	}
+}
+
+// seed adds n threads with a few messages and an attachment each, plus a
+// deleted thread with a message which is returned last.
+func seed(t *testing.T, s transfer.Store, n int) []*chat.Thread {
+	ctx := context.Background()
+
+	var ts []*chat.Thread
+	for i := 0; i < n; i++ {
+		thread := chat.NewThread()
+		thread.Retention = chat.Retention(24 * time.Hour)
+		if err := s.Threads.Create(ctx, thread); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, content := range []string{"hello", "world", "bye"} {
+			msg := chat.NewMessage(thread, content)
+			msg.Sender = "ann"
+			edited := msg.CreatedAt.Add(time.Minute)
+			msg.EditedAt = &edited
+			if err := s.Messages.Create(ctx, msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		a := chat.NewAttachment(thread.ID, "cat.png", "image/png", 3)
+		a.Hash = "abc"
+		if err := s.Attachments.Create(ctx, a); err != nil {
+			t.Fatal(err)
+		}
+
+		ts = append(ts, thread)
+	}
+
+	deleted := chat.NewThread()
+	if err := s.Threads.Create(ctx, deleted); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Messages.Create(ctx, chat.NewMessage(deleted, "gone")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Threads.Delete(ctx, deleted.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	return append(ts, deleted)
+}
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("copy and verify", func(t *testing.T) {
+		is := is.New(t)
+
+		src, dst := newStore(t), newStore(t)
+		ts := seed(t, src, 3)
+
+		var done []int
+		progress := transfer.WithProgress(func(n, total int) {
+			is.Equal(total, 4)
+			done = append(done, n)
+		})
+
+		report, err := transfer.NewCopier(src, dst, 2, progress).Copy(ctx)
+		is.NoErr(err)                                      // failed to copy
+		is.True(report.OK())                               // destination differs from source
+		is.Equal(report.Copied, 4)                         // every thread should be copied
+		is.Equal(report.Deleted, 1)                        // deleted thread should be counted
+		is.Equal(report.Destination.Threads, int64(4))     // deleted thread not verified
+		is.Equal(report.Destination.Messages, int64(10))   // messages not copied
+		is.Equal(report.Destination.Attachments, int64(3)) // attachments not copied
+		is.Equal(done, []int{1, 2, 3, 4})                  // progress not reported
+
+		found, err := dst.Threads.Find(ctx, ts[0].ID)
+		is.NoErr(err)                              // thread not copied
+		is.Equal(found.Retention, ts[0].Retention) // retention not copied
+		is.Equal(found.Messages[0].Sender, "ann")  // sender not copied
+		is.True(found.Messages[0].EditedAt != nil) // edit time not copied
+
+		deleted := ts[len(ts)-1]
+		_, err = dst.Threads.FindMeta(ctx, deleted.ID)
+		is.True(errors.Is(err, repo.ErrNotFound)) // deleted thread should stay deleted
+
+		want, err := src.Threads.FindDeletedMeta(ctx, deleted.ID)
+		is.NoErr(err)
+		got, err := dst.Threads.FindDeletedMeta(ctx, deleted.ID)
+		is.NoErr(err)                                 // deleted thread not copied
+		is.True(got.DeletedAt.Equal(*want.DeletedAt)) // deletion time not copied
+	})
+
+	t.Run("resume after interruption", func(t *testing.T) {
+		is := is.New(t)
+
+		src, dst := newStore(t), newStore(t)
+		seed(t, src, 3)
+
+		// a first run stopped while copying the first thread, after the
+		// second had been copied without its messages
+		ts, err := src.Threads.FindMany(ctx)
+		is.NoErr(err)
+		thread, err := src.Threads.Find(ctx, ts[0].ID)
+		is.NoErr(err)
+		msgs := thread.Messages
+		err = dst.Threads.Import(ctx, thread, func() (*chat.Message, error) {
+			if len(msgs) == 0 {
+				return nil, errStop
+			}
+			msg := msgs[0]
+			msgs = msgs[1:]
+			return msg, nil
+		})
+		is.True(err != nil) // import should have been interrupted
+
+		thread, err = src.Threads.FindMeta(ctx, ts[1].ID)
+		is.NoErr(err)
+		is.NoErr(dst.Threads.Import(ctx, thread, func() (*chat.Message, error) { return nil, io.EOF })) // empty thread
+
+		report, err := transfer.NewCopier(src, dst, 0).Copy(ctx)
+		is.NoErr(err)              // failed to copy
+		is.Equal(report.Copied, 3) // rolled back, missing and deleted threads should be copied
+		is.Equal(report.Skipped, 1)
+		is.True(!report.OK()) // thread without messages should not verify
+		is.Equal(len(report.Mismatches), 1)
+		is.Equal(report.Mismatches[0].ID, ts[1].ID)
+	})
+
+	t.Run("run again", func(t *testing.T) {
+		is := is.New(t)
+
+		src, dst := newStore(t), newStore(t)
+		seed(t, src, 2)
+
+		_, err := transfer.NewCopier(src, dst, 0).Copy(ctx)
+		is.NoErr(err) // failed to copy
+
+		report, err := transfer.NewCopier(src, dst, 0).Copy(ctx)
+		is.NoErr(err)               // failed to copy again
+		is.True(report.OK())        // destination differs from source
+		is.Equal(report.Copied, 0)  // nothing left to copy
+		is.Equal(report.Skipped, 3) // threads should be skipped, deleted ones too
+	})
+}
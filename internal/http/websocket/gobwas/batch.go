@@ -0,0 +1,94 @@
+package websocket
+
+import (
+	"sync"
+	"time"
+)
+
+// Most frames written to a peer at once by default, as many as its send
+// queue holds.
+const defaultWriteBatch = int(defaultCapacity)
+
+// WithWriteBatch sets how many queued frames the write goroutine of a
+// connection gathers into a single write. One disables coalescing.
+func WithWriteBatch(n int) Option {
+	return func(cli *Client) {
+		if n > 0 {
+			cli.writeBatch = n
+		}
+	}
+}
+
+// WithWriteDelay sets how long the write goroutine of a connection waits
+// for more frames before it writes an incomplete batch. By default only
+// the frames already queued are gathered, which adds no latency. Pings
+// and pongs wait for the batch too.
+func WithWriteDelay(d time.Duration) Option {
+	return func(cli *Client) {
+		cli.writeDelay = d
+	}
+}
+
+// collect appends the frames queued behind the ones of batch, up to
+// c.writeBatch, waiting up to c.writeDelay for the rest. It reports false
+// if the send queue was closed meanwhile.
+func (c *connHander) collect(batch []*PreparedFrame) ([]*PreparedFrame, bool) {
+	var timeout <-chan time.Time
+
+	for len(batch) < c.writeBatch {
+		select {
+		case f, ok := <-c.send:
+			if !ok {
+				return batch, false
+			}
+			batch = append(batch, f)
+			continue
+		default:
+		}
+
+		if c.writeDelay <= 0 {
+			break
+		}
+		if timeout == nil {
+			t := time.NewTimer(c.writeDelay)
+			defer t.Stop()
+			timeout = t.C
+		}
+
+		select {
+		case f, ok := <-c.send:
+			if !ok {
+				return batch, false
+			}
+			batch = append(batch, f)
+		case <-timeout:
+			return batch, true
+		}
+	}
+
+	return batch, true
+}
+
+var batchPool = sync.Pool{New: func() any { return new([]byte) }}
+
+// flush writes the frames of batch with a single call to Write, so
+// that a burst costs one syscall rather than one per frame.
+func (c *connHander) flush(batch []*PreparedFrame) error {
+	if len(batch) == 1 {
+		_, err := c.rwc.Write(batch[0].b)
+		return err
+	}
+
+	bp := batchPool.Get().(*[]byte)
+	b := (*bp)[:0]
+	for _, f := range batch {
+		b = append(b, f.b...)
+	}
+
+	_, err := c.rwc.Write(b)
+	if cap(b) <= maxPooledBuffer {
+		*bp = b
+		batchPool.Put(bp)
+	}
+	return err
+}
@@ -0,0 +1,178 @@
+package websocket
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+// gateConn records every write, the first one blocks until the gate is
+// opened so that frames queue up behind it.
+type gateConn struct {
+	net.Conn
+	gate, writing chan struct{}
+
+	mu     sync.Mutex
+	writes [][]byte
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newGateConn() *gateConn {
+	return &gateConn{
+		gate:    make(chan struct{}),
+		writing: make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (c *gateConn) Read(p []byte) (int, error) {
+	<-c.closed
+	return 0, io.EOF
+}
+
+func (c *gateConn) Write(p []byte) (int, error) {
+	select {
+	case c.writing <- struct{}{}:
+	default:
+	}
+	<-c.gate
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writes = append(c.writes, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func (c *gateConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *gateConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *gateConn) SetWriteDeadline(time.Time) error { return nil }
+
+// frames returns the length of every write in frames of size bytes.
+func (c *gateConn) frames(size int) []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := make([]int, len(c.writes))
+	for i, p := range c.writes {
+		n[i] = len(p) / size
+	}
+	return n
+}
+
+func newGateClient(t *testing.T, opts ...Option) (*Client, *gateConn) {
+	cli := NewClient(append([]Option{WithLogger(log.New(io.Discard, "", 0))}, opts...)...)
+	conn := newGateConn()
+	t.Cleanup(func() {
+		cli.Close()
+		conn.Close()
+	})
+
+	cli.serve(conn, "")
+	return cli, conn
+}
+
+// waitFor polls cond for up to a second.
+func waitFor(cond func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return false
+}
+
+var batchMessage = &wsutil.Message{OpCode: ws.OpText, Payload: []byte("hello")}
+
+const batchFrameSize = 7
+
+func TestWriteBatch(t *testing.T) {
+	t.Run("queued frames share a write", func(t *testing.T) {
+		is := is.New(t)
+
+		cli, conn := newGateClient(t)
+
+		cli.Broadcast(batchMessage)
+		<-conn.writing
+		for i := 0; i < 10; i++ {
+			cli.Broadcast(batchMessage)
+		}
+		is.True(waitFor(func() bool { return cli.Stats().Delivered == 11 })) // all queued
+		close(conn.gate)
+
+		is.True(waitFor(func() bool { return len(conn.frames(batchFrameSize)) == 2 })) // written twice
+		is.Equal(conn.frames(batchFrameSize), []int{1, 10})                            // the queue in one write
+	})
+
+	t.Run("batches are bounded", func(t *testing.T) {
+		is := is.New(t)
+
+		cli, conn := newGateClient(t, WithWriteBatch(4))
+
+		cli.Broadcast(batchMessage)
+		<-conn.writing
+		for i := 0; i < 10; i++ {
+			cli.Broadcast(batchMessage)
+		}
+		is.True(waitFor(func() bool { return cli.Stats().Delivered == 11 })) // all queued
+		close(conn.gate)
+
+		is.True(waitFor(func() bool { return len(conn.frames(batchFrameSize)) == 4 })) // written four times
+		is.Equal(conn.frames(batchFrameSize), []int{1, 4, 4, 2})                       // at most 4 frames a write
+	})
+
+	t.Run("coalescing can be disabled", func(t *testing.T) {
+		is := is.New(t)
+
+		cli, conn := newGateClient(t, WithWriteBatch(1))
+
+		cli.Broadcast(batchMessage)
+		<-conn.writing
+		for i := 0; i < 3; i++ {
+			cli.Broadcast(batchMessage)
+		}
+		is.True(waitFor(func() bool { return cli.Stats().Delivered == 4 })) // all queued
+		close(conn.gate)
+
+		is.True(waitFor(func() bool { return len(conn.frames(batchFrameSize)) == 4 })) // a write per frame
+	})
+
+	t.Run("delay gathers frames sent later", func(t *testing.T) {
+		is := is.New(t)
+
+		cli, conn := newGateClient(t, WithWriteDelay(time.Second))
+		close(conn.gate)
+
+		cli.Broadcast(batchMessage)
+		time.Sleep(10 * time.Millisecond)
+		cli.Broadcast(batchMessage)
+
+		is.True(waitFor(func() bool { return cli.Stats().Delivered == 2 })) // both queued
+		is.Equal(len(conn.frames(batchFrameSize)), 0)                       // still waiting for more
+	})
+
+	t.Run("delay bounds the wait", func(t *testing.T) {
+		is := is.New(t)
+
+		cli, conn := newGateClient(t, WithWriteDelay(20*time.Millisecond))
+		close(conn.gate)
+
+		cli.Broadcast(batchMessage)
+		cli.Broadcast(batchMessage)
+
+		is.True(waitFor(func() bool { return len(conn.frames(batchFrameSize)) > 0 })) // written without a full batch
+		is.Equal(conn.frames(batchFrameSize), []int{2})                               // in one write
+	})
+}
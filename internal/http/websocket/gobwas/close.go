@@ -0,0 +1,72 @@
+package websocket
+
+import (
+	"errors"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// ErrMessageTooBig is returned when a peer sends a message larger than
+// the limit set by WithMaxMessageSize.
+var ErrMessageTooBig = errors.New("message too big")
+
+// CloseReason describes why a connection ended.
+type CloseReason struct {
+	// Code is the status code of the closing handshake. When no close frame
+	// was exchanged it is ws.StatusAbnormalClosure.
+	Code ws.StatusCode
+	// Text is the optional reason sent alongside Code.
+	Text string
+	// Remote reports whether the peer started the closing handshake.
+	Remote bool
+	// Err is the error that ended the connection, if it was not closed cleanly.
+	Err error
+}
+
+func (r CloseReason) String() string {
+	s := wsutil.ClosedError{Code: r.Code, Reason: r.Text}.Error()
+	if r.Err != nil {
+		s += " (" + r.Err.Error() + ")"
+	}
+	return s
+}
+
+// closeFrame returns the frame that should be sent to the peer to complete
+// the handshake. It reports false when no close frame can be sent.
+func (r CloseReason) closeFrame() (ws.Frame, bool) {
+	switch {
+	case r.Code == ws.StatusAbnormalClosure:
+		return ws.Frame{}, false
+	case r.Code == ws.StatusNoStatusRcvd:
+		// 1005 must never be put on the wire, reply with an empty body.
+		return ws.NewCloseFrame(nil), true
+	case r.Remote:
+		// RFC6455#5.5.1: the endpoint typically echoes the status code it received.
+		return ws.NewCloseFrame(ws.NewCloseFrameBody(r.Code, "")), true
+	default:
+		return ws.NewCloseFrame(ws.NewCloseFrameBody(r.Code, r.Text)), true
+	}
+}
+
+// closeReasonFromError maps the error that stopped the read loop onto
+// the status code that the server should answer with.
+func closeReasonFromError(err error) CloseReason {
+	var (
+		closed wsutil.ClosedError
+		proto  ws.ProtocolError
+	)
+
+	switch {
+	case errors.As(err, &closed):
+		return CloseReason{Code: closed.Code, Text: closed.Reason, Remote: true}
+	case errors.As(err, &proto):
+		return CloseReason{Code: ws.StatusProtocolError, Text: proto.Error(), Err: err}
+	case errors.Is(err, ErrMessageTooBig), errors.Is(err, wsutil.ErrFrameTooLarge):
+		return CloseReason{Code: ws.StatusMessageTooBig, Err: err}
+	case errors.Is(err, wsutil.ErrInvalidUTF8):
+		return CloseReason{Code: ws.StatusInvalidFramePayloadData, Err: err}
+	default:
+		return CloseReason{Code: ws.StatusAbnormalClosure, Err: err}
+	}
+}
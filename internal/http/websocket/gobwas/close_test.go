@@ -0,0 +1,182 @@
+package websocket
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+func TestCloseHandshake(t *testing.T) {
+	t.Run("close from the peer is echoed", func(t *testing.T) {
+		is := is.New(t)
+
+		cli, reasons := newTestClient(t)
+		p := dialTest(t, cli, "").start()
+
+		is.NoErr(p.send(ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusNormalClosure, "bye")))) // peer closes
+
+		f, ok := p.next()
+		is.True(ok) // close frame
+		code, reason := closeCode(f)
+		is.Equal(code, ws.StatusNormalClosure) // code echoed
+		is.Equal(reason, "")                   // reason not echoed
+
+		r := nextReason(t, reasons)
+		is.Equal(r.Code, ws.StatusNormalClosure) // code of the peer
+		is.Equal(r.Text, "bye")                  // reason of the peer
+		is.True(r.Remote)                        // started by the peer
+		is.True(p.closed())                      // connection closed
+	})
+
+	t.Run("close without a status", func(t *testing.T) {
+		is := is.New(t)
+
+		cli, reasons := newTestClient(t)
+		p := dialTest(t, cli, "").start()
+
+		is.NoErr(p.send(ws.NewCloseFrame(nil))) // peer closes without a body
+
+		f, ok := p.next()
+		is.True(ok)                 // close frame
+		is.Equal(len(f.Payload), 0) // 1005 is never sent
+
+		r := nextReason(t, reasons)
+		is.Equal(r.Code, ws.StatusNoStatusRcvd) // no status received
+	})
+
+	t.Run("invalid close code", func(t *testing.T) {
+		is := is.New(t)
+
+		cli, reasons := newTestClient(t)
+		p := dialTest(t, cli, "").start()
+
+		is.NoErr(p.send(ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusNoStatusRcvd, ""))))
+
+		f, ok := p.next()
+		is.True(ok) // close frame
+		code, _ := closeCode(f)
+		is.Equal(code, ws.StatusProtocolError) // 1005 can't be sent by the peer
+
+		r := nextReason(t, reasons)
+		is.Equal(r.Code, ws.StatusProtocolError) // protocol error
+		is.True(r.Err != nil)                    // with the cause
+	})
+
+	t.Run("message too big", func(t *testing.T) {
+		is := is.New(t)
+
+		cli, reasons := newTestClient(t, WithMaxMessageSize(4))
+		p := dialTest(t, cli, "").start()
+
+		// the server stops reading at the header, it fails the write
+		p.send(ws.NewTextFrame([]byte("hello")))
+
+		f, ok := p.next()
+		is.True(ok) // close frame
+		code, _ := closeCode(f)
+		is.Equal(code, ws.StatusMessageTooBig) // 1009
+
+		r := nextReason(t, reasons)
+		is.Equal(r.Code, ws.StatusMessageTooBig)           // 1009
+		is.True(errors.Is(r.Err, wsutil.ErrFrameTooLarge)) // stopped at the frame
+	})
+
+	t.Run("limit spans fragments", func(t *testing.T) {
+		is := is.New(t)
+
+		cli, reasons := newTestClient(t, WithMaxMessageSize(4))
+		p := dialTest(t, cli, "").start()
+
+		first := ws.NewFrame(ws.OpText, false, []byte("hel"))
+		is.NoErr(p.send(first))                                              // under the limit
+		is.NoErr(p.send(ws.NewFrame(ws.OpContinuation, true, []byte("lo")))) // over it
+
+		r := nextReason(t, reasons)
+		is.Equal(r.Code, ws.StatusMessageTooBig)    // 1009
+		is.True(errors.Is(r.Err, ErrMessageTooBig)) // whole message counted
+	})
+
+	t.Run("close from the server", func(t *testing.T) {
+		is := is.New(t)
+
+		cli, reasons := newTestClient(t)
+		p := dialTest(t, cli, "").start()
+
+		cli.Close()
+
+		f, ok := p.next()
+		is.True(ok) // close frame
+		code, reason := closeCode(f)
+		is.Equal(code, ws.StatusGoingAway) // 1001
+		is.Equal(reason, "hub closed")     // with a reason
+
+		is.NoErr(p.send(ws.NewCloseFrame(f.Payload))) // peer answers
+
+		r := nextReason(t, reasons)
+		is.Equal(r.Code, ws.StatusGoingAway) // reason of the server
+		is.True(!r.Remote)                   // started by the server
+		is.True(p.closed())                  // connection closed
+	})
+
+	t.Run("close times out", func(t *testing.T) {
+		is := is.New(t)
+
+		cli, reasons := newTestClient(t, WithCloseWait(50*time.Millisecond))
+		p := dialTest(t, cli, "").start()
+
+		start := time.Now()
+		cli.Close()
+
+		f, ok := p.next()
+		is.True(ok) // close frame
+		code, _ := closeCode(f)
+		is.Equal(code, ws.StatusGoingAway) // 1001
+
+		// the peer never answers
+		r := nextReason(t, reasons)
+		is.Equal(r.Code, ws.StatusGoingAway)              // reason of the server
+		is.True(time.Since(start) >= 50*time.Millisecond) // waited for the peer
+		is.True(p.closed())                               // then closed the connection
+	})
+
+	t.Run("connection lost", func(t *testing.T) {
+		is := is.New(t)
+
+		cli, reasons := newTestClient(t)
+		p := dialTest(t, cli, "").start()
+
+		p.conn.Close()
+
+		r := nextReason(t, reasons)
+		is.Equal(r.Code, ws.StatusAbnormalClosure) // 1006
+		is.True(errors.Is(r.Err, io.EOF))          // with the cause
+	})
+}
+
+func TestCloseReasonFromError(t *testing.T) {
+	tt := []struct {
+		name string
+		err  error
+		want ws.StatusCode
+	}{
+		{"closed by the peer", wsutil.ClosedError{Code: ws.StatusGoingAway}, ws.StatusGoingAway},
+		{"protocol error", ws.ErrProtocolControlPayloadOverflow, ws.StatusProtocolError},
+		{"message too big", ErrMessageTooBig, ws.StatusMessageTooBig},
+		{"frame too big", wsutil.ErrFrameTooLarge, ws.StatusMessageTooBig},
+		{"invalid utf-8", wsutil.ErrInvalidUTF8, ws.StatusInvalidFramePayloadData},
+		{"anything else", io.ErrUnexpectedEOF, ws.StatusAbnormalClosure},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+
+			is.Equal(closeReasonFromError(tc.err).Code, tc.want) // status code
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+func TestControlFrames(t *testing.T) {
+	t.Run("ping is answered with its payload", func(t *testing.T) {
+		is := is.New(t)
+
+		cli, _ := newTestClient(t)
+		p := dialTest(t, cli, "").start()
+
+		is.NoErr(p.send(ws.NewPingFrame([]byte("are you there")))) // ping
+
+		f, ok := p.next()
+		is.True(ok)                                  // a frame
+		is.Equal(f.Header.OpCode, ws.OpPong)         // pong
+		is.Equal(string(f.Payload), "are you there") // same payload
+	})
+
+	t.Run("ping between fragments", func(t *testing.T) {
+		is := is.New(t)
+
+		msgs := make(chan string, 1)
+		cli, _ := newTestClient(t, WithMessageHandler(func(_ *Client, _ Peer, msg *wsutil.Message) {
+			msgs <- string(msg.Payload)
+		}))
+		p := dialTest(t, cli, "").start()
+
+		is.NoErr(p.send(ws.NewFrame(ws.OpText, false, []byte("hel"))))       // first fragment
+		is.NoErr(p.send(ws.NewPingFrame([]byte("ping"))))                    // ping in between
+		is.NoErr(p.send(ws.NewFrame(ws.OpContinuation, true, []byte("lo")))) // last fragment
+
+		f, ok := p.next()
+		is.True(ok)                          // a frame
+		is.Equal(f.Header.OpCode, ws.OpPong) // answered straight away
+
+		select {
+		case msg := <-msgs:
+			is.Equal(msg, "hello") // message put together
+		case <-time.After(testTimeout):
+			t.Fatal("no message")
+		}
+	})
+
+	t.Run("control payload is at most 125 bytes", func(t *testing.T) {
+		is := is.New(t)
+
+		cli, reasons := newTestClient(t)
+		p := dialTest(t, cli, "").start()
+
+		// rejected at the header, the server doesn't read the payload
+		p.send(ws.NewPingFrame(bytes.Repeat([]byte{'a'}, ws.MaxControlFramePayloadSize+1)))
+
+		f, ok := p.next()
+		is.True(ok) // close frame
+		code, _ := closeCode(f)
+		is.Equal(code, ws.StatusProtocolError) // 1002
+
+		r := nextReason(t, reasons)
+		is.Equal(r.Code, ws.StatusProtocolError)                        // protocol error
+		is.True(errors.Is(r.Err, ws.ErrProtocolControlPayloadOverflow)) // payload too long
+	})
+
+	t.Run("peer answering pings is kept", func(t *testing.T) {
+		is := is.New(t)
+
+		cli, reasons := newTestClient(t, WithPongWait(100*time.Millisecond), WithPingPeriod(20*time.Millisecond))
+		p := dialTest(t, cli, "")
+		p.pong = true
+		p.start()
+
+		select {
+		case r := <-reasons:
+			t.Fatalf("disconnected: %v", r)
+		case <-time.After(300 * time.Millisecond):
+		}
+		is.Equal(cli.Len(), 1) // still connected
+	})
+
+	t.Run("peer not answering pings is closed", func(t *testing.T) {
+		is := is.New(t)
+
+		cli, reasons := newTestClient(t, WithPongWait(100*time.Millisecond), WithPingPeriod(20*time.Millisecond))
+		p := dialTest(t, cli, "").start()
+
+		f, ok := p.next()
+		is.True(ok)                          // a frame
+		is.Equal(f.Header.OpCode, ws.OpPing) // pinged
+
+		r := nextReason(t, reasons)
+		is.Equal(r.Code, ws.StatusAbnormalClosure) // 1006
+
+		var ne net.Error
+		is.True(errors.As(r.Err, &ne) && ne.Timeout()) // no pong in time
+	})
+}
+
+func TestQueueControl(t *testing.T) {
+	is := is.New(t)
+
+	c := &connHander{ctrl: make(chan *PreparedFrame, 1)}
+
+	first := NewPreparedFrame(ws.OpPong, []byte("first"))
+	last := NewPreparedFrame(ws.OpPong, []byte("last"))
+	c.queueControl(first)
+	c.queueControl(last)
+
+	is.Equal(len(c.ctrl), 1) // a single pending frame
+	is.Equal(<-c.ctrl, last) // the most recent one
+}
@@ -0,0 +1,134 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// Buffers larger than this are left to the garbage collector rather than
+// pooled, so that a single large message doesn't stay in memory.
+const maxPooledBuffer = 64 << 10
+
+// PreparedFrame is a message encoded once, header and payload, and written
+// as is to every peer it is sent to.
+//
+// Every Broadcast and Send method prepares one from a pool and recycles it
+// once the last peer has written it. NewPreparedFrame is for a message
+// sent through several clients, which is then only encoded once.
+type PreparedFrame struct {
+	b []byte
+
+	// refs counts the queues still holding a pooled frame.
+	refs   atomic.Int32
+	pooled bool
+}
+
+// NewPreparedFrame encodes a single, unmasked, frame as sent by a server.
+// The frame can be sent any number of times and is never recycled.
+func NewPreparedFrame(op ws.OpCode, payload []byte) *PreparedFrame {
+	f := &PreparedFrame{}
+	f.encode(op, payload)
+	return f
+}
+
+var framePool = sync.Pool{New: func() any { return &PreparedFrame{pooled: true} }}
+
+// prepareFrame encodes msg into a frame of the pool. Its single reference
+// belongs to the caller.
+func prepareFrame(msg *wsutil.Message) *PreparedFrame {
+	f := framePool.Get().(*PreparedFrame)
+	f.encode(msg.OpCode, msg.Payload)
+	f.refs.Store(1)
+	return f
+}
+
+func (f *PreparedFrame) encode(op ws.OpCode, payload []byte) {
+	f.b = appendHeader(f.b[:0], op, len(payload))
+	f.b = append(f.b, payload...)
+}
+
+// retain adds a reference to a pooled frame, for a queue it is handed to.
+func (f *PreparedFrame) retain() {
+	if f.pooled {
+		f.refs.Add(1)
+	}
+}
+
+// release drops a reference to a pooled frame, the last one puts it back
+// in the pool. A frame must not be used after it is released.
+func (f *PreparedFrame) release() {
+	if !f.pooled || f.refs.Add(-1) != 0 {
+		return
+	}
+
+	if cap(f.b) <= maxPooledBuffer {
+		framePool.Put(f)
+	}
+}
+
+// appendHeader appends the header of a final, unmasked, frame. Unlike
+// ws.WriteHeader it needs no intermediate buffer.
+func appendHeader(b []byte, op ws.OpCode, n int) []byte {
+	b = append(b, 0x80|byte(op))
+
+	switch {
+	case n < 126:
+		return append(b, byte(n))
+	case n <= 0xffff:
+		b = append(b, 126)
+		return binary.BigEndian.AppendUint16(b, uint16(n))
+	default:
+		b = append(b, 127)
+		return binary.BigEndian.AppendUint64(b, uint64(n))
+	}
+}
+
+var pingFrame = NewPreparedFrame(ws.OpPing, nil)
+
+var (
+	readerPool  = sync.Pool{New: func() any { return new(wsutil.Reader) }}
+	messagePool = sync.Pool{New: func() any { return new(wsutil.Message) }}
+)
+
+// getMessage returns a message of the pool, with room left from its
+// previous use.
+func getMessage(op ws.OpCode) *wsutil.Message {
+	msg := messagePool.Get().(*wsutil.Message)
+	msg.OpCode, msg.Payload = op, msg.Payload[:0]
+	return msg
+}
+
+// putMessage recycles a message returned by connHander.read once it has
+// been handled.
+func putMessage(msg *wsutil.Message) {
+	if cap(msg.Payload) <= maxPooledBuffer {
+		messagePool.Put(msg)
+	}
+}
+
+// readAll appends what is left of r to p, failing with ErrMessageTooBig
+// once more than max bytes have been read when max is positive.
+func readAll(p []byte, r io.Reader, max int64) ([]byte, error) {
+	for {
+		if len(p) == cap(p) {
+			// let append pick the next size
+			p = append(p, 0)[:len(p)]
+		}
+
+		n, err := r.Read(p[len(p):cap(p)])
+		p = p[:len(p)+n]
+		if max > 0 && int64(len(p)) > max {
+			return p, ErrMessageTooBig
+		}
+		if err == io.EOF {
+			return p, nil
+		} else if err != nil {
+			return p, err
+		}
+	}
+}
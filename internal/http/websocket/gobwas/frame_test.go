@@ -0,0 +1,44 @@
+package websocket
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gobwas/ws"
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+func TestPreparedFrame(t *testing.T) {
+	is := is.New(t)
+
+	for _, n := range []int{0, 125, 126, 0xffff, 0x10000} {
+		payload := bytes.Repeat([]byte{'a'}, n)
+
+		var want bytes.Buffer
+		is.NoErr(ws.WriteFrame(&want, ws.NewTextFrame(payload))) // encode with gobwas
+
+		f := NewPreparedFrame(ws.OpText, payload)
+		is.True(bytes.Equal(f.b, want.Bytes())) // same frame for every length
+	}
+}
+
+func TestPreparedFrameRelease(t *testing.T) {
+	is := is.New(t)
+
+	f := NewPreparedFrame(ws.OpText, []byte("hello"))
+	f.retain()
+	f.release()
+	f.release()
+	is.Equal(string(f.b[2:]), "hello") // prepared frames are never recycled
+
+	msg := getMessage(ws.OpText)
+	msg.Payload = append(msg.Payload, "hello"...)
+	p := prepareFrame(msg)
+	putMessage(msg)
+
+	p.retain()
+	p.release()
+	is.Equal(p.refs.Load(), int32(1)) // held by the caller
+	p.release()
+	is.Equal(p.refs.Load(), int32(0)) // back in the pool
+}
@@ -0,0 +1,104 @@
+package websocket
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+var errPongTimeout = errors.New("pong timeout")
+
+// WithPoller reads the connections of the client with p rather than with
+// a goroutine each, leaving a single goroutine per connection for
+// writing. Connections without a file descriptor, such as TLS ones, are
+// still read by their own goroutine.
+func WithPoller(p *Poller) Option {
+	return func(cli *Client) {
+		cli.poller = p
+	}
+}
+
+// ServeConn upgrades a connection accepted from a net.Listener and serves
+// it. The handshake is parsed straight from conn, without the buffers and
+// the http.Request that ServeHTTP goes through.
+func (cli *Client) ServeConn(conn net.Conn, user string) error {
+	var u ws.Upgrader
+	if _, err := u.Upgrade(conn); err != nil {
+		conn.Close()
+		return err
+	}
+
+	cli.serve(conn, user)
+	return nil
+}
+
+// poll hands the reading of conn to the poller. It reports false if the
+// connection can't be polled, it must then be read by a goroutine.
+func (cli *Client) poll(conn *connHander) bool {
+	fd, ok := fdOf(conn.rwc)
+	if !ok {
+		return false
+	}
+
+	// set before it is armed, as a worker may read conn straight away
+	conn.pollID = cli.poller.register(fd, func() { cli.pollRead(conn) })
+	if err := cli.poller.arm(conn.pollID); err != nil {
+		conn.logf("poll err: %v\n", err)
+		cli.poller.remove(conn.pollID)
+		conn.pollID = 0
+		return false
+	}
+
+	return true
+}
+
+// pollRead is called on a worker of the poller when conn is readable. It
+// reads a single frame, or message, and waits for the next one. The read
+// must end within the frame wait, so that a peer trickling bytes can't
+// hold the worker.
+func (cli *Client) pollRead(conn *connHander) {
+	conn.setReadDeadLine(conn.frameWait)
+	msg, err := conn.read()
+	if err != nil {
+		conn.setCloseReason(closeReasonFromError(err))
+		conn.finishRead(cli)
+		return
+	}
+
+	if msg != nil {
+		cli.onMessage(cli, conn.peer(), msg)
+		putMessage(msg)
+	}
+
+	// fails once the write goroutine has removed conn, which it then
+	// finishes itself
+	cli.poller.resume(conn.pollID)
+}
+
+// pongExpired reports whether the peer has stopped answering pings. A
+// polled connection has no read in progress for a deadline to stop.
+func (c *connHander) pongExpired() bool {
+	return time.Since(time.Unix(0, c.pong.Load())) > c.pongWait
+}
+
+func fdOf(conn net.Conn) (int, bool) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, false
+	}
+
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+
+	fd := -1
+	if err := raw.Control(func(f uintptr) { fd = int(f) }); err != nil {
+		return 0, false
+	}
+
+	return fd, fd >= 0
+}
@@ -0,0 +1,189 @@
+//go:build linux
+
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// socketPair returns both ends of a connected unix socket, which unlike
+// net.Pipe have file descriptors that can be polled.
+func socketPair(tb testing.TB) (server, client net.Conn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	conns := make([]net.Conn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		// FileConn works on a copy of the descriptor
+		conns[i], err = net.FileConn(f)
+		f.Close()
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	return conns[0], conns[1]
+}
+
+// memInUse returns the heap and stack memory in use after a collection.
+func memInUse() uint64 {
+	runtime.GC()
+
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapInuse + m.StackInuse
+}
+
+// BenchmarkRead compares reading connections with a goroutine each to
+// reading them with a Poller. It reports what every idle connection costs
+// and times messages sent by peers picked in turn.
+func BenchmarkRead(b *testing.B) {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		b.Fatal(err)
+	}
+
+	// a frame as sent by a client, masked
+	var buf bytes.Buffer
+	if err := wsutil.WriteClientText(&buf, []byte("hello, world")); err != nil {
+		b.Fatal(err)
+	}
+	frame := buf.Bytes()
+
+	for _, n := range []int{1_000, 5_000} {
+		for _, mode := range []string{"goroutine", "netpoll"} {
+			b.Run(fmt.Sprintf("conns=%d/mode=%s", n, mode), func(b *testing.B) {
+				if uint64(2*n+64) > lim.Cur {
+					b.Skipf("needs %d file descriptors, the limit is %d", 2*n+64, lim.Cur)
+				}
+
+				var read atomic.Int64
+				opts := []Option{
+					WithLogger(log.New(io.Discard, "", 0)),
+					WithMessageHandler(func(*Client, Peer, *wsutil.Message) { read.Add(1) }),
+				}
+				if mode == "netpoll" {
+					p, err := NewPoller(runtime.GOMAXPROCS(0))
+					if err != nil {
+						b.Fatal(err)
+					}
+					b.Cleanup(func() { p.Close() })
+
+					opts = append(opts, WithPoller(p))
+				}
+				cli := NewClient(opts...)
+
+				goroutines, mem := runtime.NumGoroutine(), memInUse()
+
+				peers := make([]net.Conn, n)
+				for i := range peers {
+					server, client := socketPair(b)
+					cli.serve(server, "")
+					peers[i] = client
+				}
+				b.Cleanup(func() {
+					cli.Close()
+					for _, c := range peers {
+						c.Close()
+					}
+				})
+
+				// let the goroutines of the connections settle
+				time.Sleep(100 * time.Millisecond)
+				perConn := float64(runtime.NumGoroutine()-goroutines) / float64(n)
+				memPerConn := float64(memInUse()-mem) / float64(n)
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := peers[i%n].Write(frame); err != nil {
+						b.Fatal(err)
+					}
+				}
+				for read.Load() < int64(b.N) {
+					runtime.Gosched()
+				}
+
+				b.ReportMetric(perConn, "goroutines/conn")
+				b.ReportMetric(memPerConn, "B/conn")
+			})
+		}
+	}
+}
+
+// BenchmarkUpgrade compares the upgrade of ServeConn, parsed straight from
+// the connection, to the one of ServeHTTP.
+func BenchmarkUpgrade(b *testing.B) {
+	req := []byte("GET /ws HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n")
+
+	b.Run("conn", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var u ws.Upgrader
+			if _, err := u.Upgrade(&upgradeConn{r: bytes.NewReader(req)}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("http", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var u ws.HTTPUpgrader
+			w := &hijackWriter{conn: &upgradeConn{r: bytes.NewReader(req)}}
+			r, err := readRequest(req)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, _, _, err := u.Upgrade(r, w); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// upgradeConn reads a handshake and discards the response.
+type upgradeConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *upgradeConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *upgradeConn) Write(p []byte) (int, error) { return len(p), nil }
+func (c *upgradeConn) SetDeadline(time.Time) error { return nil }
+
+// hijackWriter is the http.ResponseWriter of an upgrade.
+type hijackWriter struct {
+	http.ResponseWriter
+	conn net.Conn
+}
+
+func (w *hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+}
+
+func readRequest(p []byte) (*http.Request, error) {
+	return http.ReadRequest(bufio.NewReader(bytes.NewReader(p)))
+}
@@ -0,0 +1,240 @@
+//go:build linux
+
+package websocket
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+// newTestPoller returns a poller with n workers, closed with the test.
+func newTestPoller(t *testing.T, workers int) *Poller {
+	p, err := NewPoller(workers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+
+	return p
+}
+
+// dialPolled connects a peer to cli over a unix socket, which unlike
+// net.Pipe can be read by the poller of cli.
+func dialPolled(t *testing.T, cli *Client, user string) *testPeer {
+	server, client := socketPair(t)
+	t.Cleanup(func() { client.Close() })
+
+	cli.serve(server, user)
+	return &testPeer{t: t, conn: client, r: client, frames: make(chan ws.Frame, 64)}
+}
+
+// registered waits a little for p to have want connections registered.
+func registered(p *Poller, want int) int {
+	deadline := time.Now().Add(testTimeout)
+	for {
+		p.mu.Lock()
+		n := len(p.regs)
+		p.mu.Unlock()
+
+		if n == want || time.Now().After(deadline) {
+			return n
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// isTimeout reports whether err is a read that went past its deadline.
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+func TestPoller(t *testing.T) {
+	// received returns a message handler sending what it reads to msgs.
+	received := func(msgs chan<- string) Option {
+		return WithMessageHandler(func(_ *Client, _ Peer, msg *wsutil.Message) {
+			msgs <- string(msg.Payload)
+		})
+	}
+
+	// next returns the next message read.
+	next := func(t *testing.T, msgs <-chan string) string {
+		t.Helper()
+
+		select {
+		case msg := <-msgs:
+			return msg
+		case <-time.After(testTimeout):
+			t.Fatal("no message")
+			return ""
+		}
+	}
+
+	t.Run("messages are read", func(t *testing.T) {
+		is := is.New(t)
+
+		p := newTestPoller(t, 1)
+		msgs := make(chan string, 1)
+		cli, _ := newTestClient(t, WithPoller(p), received(msgs))
+		peer := dialPolled(t, cli, "").start()
+		is.Equal(registered(p, 1), 1) // read by the poller
+
+		is.NoErr(peer.send(ws.NewTextFrame([]byte("hello"))))
+		is.Equal(next(t, msgs), "hello") // first message
+
+		is.NoErr(peer.send(ws.NewPingFrame([]byte("ping"))))
+		f, ok := peer.next()
+		is.True(ok)
+		is.Equal(f.Header.OpCode, ws.OpPong) // control frames answered
+
+		is.NoErr(peer.send(ws.NewTextFrame([]byte("world"))))
+		is.Equal(next(t, msgs), "world") // polled again
+	})
+
+	t.Run("closed by the peer", func(t *testing.T) {
+		is := is.New(t)
+
+		p := newTestPoller(t, 1)
+		cli, reasons := newTestClient(t, WithPoller(p))
+		peer := dialPolled(t, cli, "").start()
+		is.Equal(registered(p, 1), 1)
+
+		is.NoErr(peer.send(ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusGoingAway, "bye"))))
+
+		f, ok := peer.next()
+		is.True(ok)
+		code, _ := closeCode(f)
+		is.Equal(code, ws.StatusGoingAway) // close echoed
+
+		r := nextReason(t, reasons)
+		is.Equal(r.Code, ws.StatusGoingAway) // closed by the peer
+		is.True(r.Remote)
+		is.Equal(registered(p, 0), 0) // removed from the poller
+	})
+
+	t.Run("pong expiry", func(t *testing.T) {
+		is := is.New(t)
+
+		p := newTestPoller(t, 1)
+		cli, reasons := newTestClient(t, WithPoller(p), WithPongWait(100*time.Millisecond), WithPingPeriod(20*time.Millisecond))
+		dialPolled(t, cli, "").start() // pings are not answered
+
+		r := nextReason(t, reasons)
+		is.Equal(r.Code, ws.StatusAbnormalClosure) // dropped
+		is.True(errors.Is(r.Err, errPongTimeout))  // for not answering
+	})
+
+	t.Run("pongs keep the connection", func(t *testing.T) {
+		is := is.New(t)
+
+		p := newTestPoller(t, 1)
+		cli, reasons := newTestClient(t, WithPoller(p), WithPongWait(100*time.Millisecond), WithPingPeriod(20*time.Millisecond))
+		peer := dialPolled(t, cli, "")
+		peer.pong = true
+		peer.start()
+
+		select {
+		case r := <-reasons:
+			t.Fatalf("disconnected: %v", r)
+		case <-time.After(300 * time.Millisecond):
+		}
+		is.Equal(registered(p, 1), 1) // still polled
+	})
+
+	t.Run("slow peer releases the worker", func(t *testing.T) {
+		is := is.New(t)
+
+		p := newTestPoller(t, 1)
+		msgs := make(chan string, 1)
+		cli, reasons := newTestClient(t, WithPoller(p), WithFrameWait(50*time.Millisecond), received(msgs))
+		slow, other := dialPolled(t, cli, "").start(), dialPolled(t, cli, "").start()
+		is.Equal(registered(p, 2), 2)
+
+		// the start of a masked header, the worker waits for the rest
+		_, err := slow.conn.Write([]byte{0x81, 0x85})
+		is.NoErr(err)
+		time.Sleep(10 * time.Millisecond)
+
+		is.NoErr(other.send(ws.NewTextFrame([]byte("hello"))))
+		is.Equal(next(t, msgs), "hello") // read once the slow peer is dropped
+
+		r := nextReason(t, reasons)
+		is.Equal(r.Code, ws.StatusAbnormalClosure) // dropped
+		is.True(isTimeout(r.Err))                  // for going past the frame wait
+	})
+
+	t.Run("pongs don't extend the frame wait", func(t *testing.T) {
+		is := is.New(t)
+
+		p := newTestPoller(t, 1)
+		cli, reasons := newTestClient(t, WithPoller(p), WithFrameWait(100*time.Millisecond))
+		peer := dialPolled(t, cli, "").start()
+		is.Equal(registered(p, 1), 1)
+
+		// a message that never ends, kept going with pongs
+		is.NoErr(peer.send(ws.NewFrame(ws.OpText, false, []byte("hel"))))
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			for {
+				select {
+				case <-stop:
+					return
+				case <-time.After(20 * time.Millisecond):
+					if peer.send(ws.NewPongFrame(nil)) != nil {
+						return
+					}
+				}
+			}
+		}()
+
+		r := nextReason(t, reasons)
+		is.True(isTimeout(r.Err)) // dropped all the same
+	})
+
+	t.Run("close while every worker is busy", func(t *testing.T) {
+		is := is.New(t)
+
+		p := newTestPoller(t, 1)
+		busy, release := make(chan struct{}, 3), make(chan struct{})
+		cli, _ := newTestClient(t, WithPoller(p), WithCloseWait(10*time.Millisecond), WithMessageHandler(func(*Client, Peer, *wsutil.Message) {
+			busy <- struct{}{}
+			<-release
+		}))
+		// released before the client is closed
+		t.Cleanup(func() { close(release) })
+
+		// one read holds the worker, one waits in the queue and one
+		// blocks the poller
+		for i := 0; i < 3; i++ {
+			peer := dialPolled(t, cli, "").start()
+			is.NoErr(peer.send(ws.NewTextFrame([]byte("hello"))))
+		}
+		select {
+		case <-busy:
+		case <-time.After(testTimeout):
+			t.Fatal("worker not busy")
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		closed := make(chan struct{})
+		go func() {
+			p.Close()
+			close(closed)
+		}()
+
+		select {
+		case <-closed:
+		case <-time.After(testTimeout):
+			t.Fatal("close blocked by the workers")
+		}
+
+		is.True(p.resume(1) != nil) // closed to late calls
+	})
+}
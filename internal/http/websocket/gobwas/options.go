@@ -0,0 +1,112 @@
+package websocket
+
+import (
+	"log"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+const (
+	// Time allowed to write a message to the peer.
+	defaultWriteWait = 10 * time.Second
+	// Time allowed to read the next pong message from the peer.
+	defaultPongWait = 60 * time.Second
+	// Time allowed for the peer to answer a close frame sent by the server.
+	defaultCloseWait = 5 * time.Second
+	// Time allowed to read a message once a polled connection is readable.
+	defaultFrameWait = 5 * time.Second
+)
+
+// Option configures a Client.
+type Option func(cli *Client)
+
+// WithWriteWait sets the time allowed to write a message to the peer.
+func WithWriteWait(d time.Duration) Option {
+	return func(cli *Client) {
+		cli.writeWait = d
+	}
+}
+
+// WithPongWait sets the time allowed to read the next pong message from
+// the peer before the connection is considered dead.
+func WithPongWait(d time.Duration) Option {
+	return func(cli *Client) {
+		cli.pongWait = d
+	}
+}
+
+// WithPingPeriod sets how often the server pings the peer. It must be
+// less than the pong wait, it defaults to 90% of it.
+func WithPingPeriod(d time.Duration) Option {
+	return func(cli *Client) {
+		cli.pingPeriod = d
+	}
+}
+
+// WithCloseWait sets the time allowed for the peer to answer a close
+// frame sent by the server.
+func WithCloseWait(d time.Duration) Option {
+	return func(cli *Client) {
+		cli.closeWait = d
+	}
+}
+
+// WithFrameWait sets the time allowed to read a message, or a control
+// frame, once a connection read by a Poller has become readable. A peer
+// sending it slower holds a worker of the poller and is disconnected.
+func WithFrameWait(d time.Duration) Option {
+	return func(cli *Client) {
+		cli.frameWait = d
+	}
+}
+
+// WithCapacity sets the size of every connection's send buffer.
+func WithCapacity(n uint8) Option {
+	return func(cli *Client) {
+		cli.Capacity = n
+	}
+}
+
+// WithMaxMessageSize limits the size in bytes of a message read from the
+// peer, including all of its fragments. Peers that exceed it are closed
+// with ws.StatusMessageTooBig. Zero means no limit.
+func WithMaxMessageSize(n int64) Option {
+	return func(cli *Client) {
+		cli.maxMessageSize = n
+	}
+}
+
+// WithLogger sets the logger used by the client and its connections.
+func WithLogger(l *log.Logger) Option {
+	return func(cli *Client) {
+		cli.l = l
+	}
+}
+
+// WithUpgrader sets the upgrader used to accept new connections, for
+// example to negotiate subprotocols or set a handshake timeout.
+func WithUpgrader(u *ws.HTTPUpgrader) Option {
+	return func(cli *Client) {
+		cli.u = u
+	}
+}
+
+// WithDisconnectHandler sets Client.OnDisconnect.
+func WithDisconnectHandler(f func(p Peer, reason CloseReason)) Option {
+	return func(cli *Client) {
+		cli.OnDisconnect = f
+	}
+}
+
+// WithShards sets how many goroutines deliver messages to the peers of
+// the client, each taking a share of the connections. It defaults to
+// GOMAXPROCS, shards are only started once they have a connection so
+// small rooms don't pay for them.
+func WithShards(n int) Option {
+	return func(cli *Client) {
+		if n > 0 {
+			cli.shards = make([]*shard, n)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package websocket
+
+import (
+	"io"
+	"log"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+func TestClientDefaults(t *testing.T) {
+	is := is.New(t)
+
+	cli := NewClient()
+	t.Cleanup(cli.Close)
+
+	is.Equal(cli.writeWait, defaultWriteWait)        // write wait
+	is.Equal(cli.pongWait, defaultPongWait)          // pong wait
+	is.Equal(cli.pingPeriod, defaultPongWait*9/10)   // ping period within the pong wait
+	is.Equal(cli.closeWait, defaultCloseWait)        // close wait
+	is.Equal(cli.frameWait, defaultFrameWait)        // frame wait
+	is.Equal(cli.maxMessageSize, int64(0))           // no message limit
+	is.Equal(cli.Capacity, uint8(defaultCapacity))   // send queue
+	is.Equal(cli.policy, PolicyDisconnect)           // slow consumers are disconnected
+	is.Equal(cli.blockTimeout, defaultBlockTimeout)  // block timeout
+	is.Equal(len(cli.shards), runtime.GOMAXPROCS(0)) // a shard per processor
+	is.Equal(cli.writeBatch, defaultWriteBatch)      // write batch
+	is.Equal(cli.writeDelay, time.Duration(0))       // no write delay
+	is.Equal(cli.l, log.Default())                   // default logger
+	is.True(cli.u != nil)                            // an upgrader
+}
+
+func TestClientOptions(t *testing.T) {
+	l := log.New(io.Discard, "", 0)
+	u := &ws.HTTPUpgrader{Protocol: func(string) bool { return true }}
+
+	tt := []struct {
+		name  string
+		opt   Option
+		check func(is *is.I, cli *Client)
+	}{
+		{
+			name:  "write wait",
+			opt:   WithWriteWait(time.Second),
+			check: func(is *is.I, cli *Client) { is.Equal(cli.writeWait, time.Second) },
+		},
+		{
+			name: "pong wait moves the ping period",
+			opt:  WithPongWait(10 * time.Second),
+			check: func(is *is.I, cli *Client) {
+				is.Equal(cli.pongWait, 10*time.Second)  // pong wait
+				is.Equal(cli.pingPeriod, 9*time.Second) // 90% of it
+			},
+		},
+		{
+			name:  "ping period within the pong wait",
+			opt:   WithPingPeriod(30 * time.Second),
+			check: func(is *is.I, cli *Client) { is.Equal(cli.pingPeriod, 30*time.Second) },
+		},
+		{
+			name:  "ping period past the pong wait is clamped",
+			opt:   WithPingPeriod(2 * defaultPongWait),
+			check: func(is *is.I, cli *Client) { is.Equal(cli.pingPeriod, defaultPongWait*9/10) },
+		},
+		{
+			name:  "ping period equal to the pong wait is clamped",
+			opt:   WithPingPeriod(defaultPongWait),
+			check: func(is *is.I, cli *Client) { is.Equal(cli.pingPeriod, defaultPongWait*9/10) },
+		},
+		{
+			name:  "zero ping period is clamped",
+			opt:   WithPingPeriod(0),
+			check: func(is *is.I, cli *Client) { is.Equal(cli.pingPeriod, defaultPongWait*9/10) },
+		},
+		{
+			name:  "close wait",
+			opt:   WithCloseWait(time.Second),
+			check: func(is *is.I, cli *Client) { is.Equal(cli.closeWait, time.Second) },
+		},
+		{
+			name:  "frame wait",
+			opt:   WithFrameWait(time.Second),
+			check: func(is *is.I, cli *Client) { is.Equal(cli.frameWait, time.Second) },
+		},
+		{
+			name:  "unbuffered send queue",
+			opt:   WithCapacity(0),
+			check: func(is *is.I, cli *Client) { is.Equal(cli.Capacity, uint8(0)) },
+		},
+		{
+			name:  "max message size",
+			opt:   WithMaxMessageSize(1 << 10),
+			check: func(is *is.I, cli *Client) { is.Equal(cli.maxMessageSize, int64(1<<10)) },
+		},
+		{
+			name:  "logger",
+			opt:   WithLogger(l),
+			check: func(is *is.I, cli *Client) { is.Equal(cli.l, l) },
+		},
+		{
+			name:  "upgrader",
+			opt:   WithUpgrader(u),
+			check: func(is *is.I, cli *Client) { is.Equal(cli.u, u) },
+		},
+		{
+			name:  "shards",
+			opt:   WithShards(3),
+			check: func(is *is.I, cli *Client) { is.Equal(len(cli.shards), 3) },
+		},
+		{
+			name:  "zero shards are ignored",
+			opt:   WithShards(0),
+			check: func(is *is.I, cli *Client) { is.Equal(len(cli.shards), runtime.GOMAXPROCS(0)) },
+		},
+		{
+			name:  "zero write batch is ignored",
+			opt:   WithWriteBatch(0),
+			check: func(is *is.I, cli *Client) { is.Equal(cli.writeBatch, defaultWriteBatch) },
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			cli := NewClient(tc.opt)
+			t.Cleanup(cli.Close)
+
+			tc.check(is.New(t), cli)
+		})
+	}
+}
+
+func TestConnectionOptions(t *testing.T) {
+	is := is.New(t)
+
+	cli, _ := newTestClient(t,
+		WithCapacity(4),
+		WithWriteWait(time.Second),
+		WithPongWait(2*time.Second),
+		WithCloseWait(3*time.Second),
+		WithFrameWait(4*time.Second),
+		WithMaxMessageSize(5),
+	)
+
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	conn := cli.newConn(server, "ann")
+	is.Equal(conn.user, "ann")              // user
+	is.Equal(cap(conn.send), 4)             // send queue
+	is.Equal(conn.writeWait, time.Second)   // write wait
+	is.Equal(conn.pongWait, 2*time.Second)  // pong wait
+	is.Equal(conn.closeWait, 3*time.Second) // close wait
+	is.Equal(conn.frameWait, 4*time.Second) // frame wait
+	is.Equal(conn.maxMessageSize, int64(5)) // max message size
+}
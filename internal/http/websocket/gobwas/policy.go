@@ -0,0 +1,159 @@
+package websocket
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+const (
+	// Default size of a connection's send queue.
+	defaultCapacity = 16
+	// Default time the hub waits on a full queue under PolicyBlock.
+	defaultBlockTimeout = time.Second
+)
+
+// SlowConsumerPolicy decides what the hub does when a connection's send
+// queue is full.
+type SlowConsumerPolicy uint8
+
+const (
+	// PolicyDisconnect closes the connection with ws.StatusPolicyViolation.
+	PolicyDisconnect SlowConsumerPolicy = iota
+	// PolicyDropOldest discards the oldest queued message to make room.
+	PolicyDropOldest
+	// PolicyDropNewest discards the message being sent.
+	PolicyDropNewest
+	// PolicyBlock waits for room in the queue and disconnects the peer if
+	// none frees up within the block timeout.
+	//
+	// The wait happens on the shard of the connection: every other
+	// connection of the shard gets nothing meanwhile, and once the queue of
+	// the shard fills up so does the hub, and with it Broadcast. A single
+	// slow peer can delay the whole hub by up to the block timeout per
+	// message, so keep the timeout short or use more shards.
+	PolicyBlock
+)
+
+func (p SlowConsumerPolicy) String() string {
+	switch p {
+	case PolicyDisconnect:
+		return "disconnect"
+	case PolicyDropOldest:
+		return "drop-oldest"
+	case PolicyDropNewest:
+		return "drop-newest"
+	case PolicyBlock:
+		return "block"
+	}
+	return "unknown"
+}
+
+// Stats holds the delivery counters of a Client.
+type Stats struct {
+	// Delivered is the number of messages queued to a connection.
+	Delivered uint64
+	// Dropped is the number of messages discarded because a queue was full.
+	Dropped uint64
+	// Disconnected is the number of connections closed for being too slow.
+	Disconnected uint64
+}
+
+type stats struct {
+	delivered, dropped, disconnected atomic.Uint64
+}
+
+// Stats returns a snapshot of the client's delivery counters.
+func (cli *Client) Stats() Stats {
+	return Stats{
+		Delivered:    cli.stats.delivered.Load(),
+		Dropped:      cli.stats.dropped.Load(),
+		Disconnected: cli.stats.disconnected.Load(),
+	}
+}
+
+// WithSlowConsumerPolicy sets what happens when a connection's send queue
+// is full. The default is PolicyDisconnect.
+func WithSlowConsumerPolicy(p SlowConsumerPolicy) Option {
+	return func(cli *Client) {
+		cli.policy = p
+	}
+}
+
+// WithBlockTimeout sets how long PolicyBlock waits for room in a queue.
+func WithBlockTimeout(d time.Duration) Option {
+	return func(cli *Client) {
+		cli.blockTimeout = d
+	}
+}
+
+// deliver queues msg on conn, applying the slow consumer policy when the
+// queue is full. The reference to msg is handed to the queue, or released
+// if it is dropped. It must only be called from the goroutine of the shard.
+func (s *shard) deliver(conn *connHander, msg *PreparedFrame) {
+	cli := s.cli
+
+	select {
+	case conn.send <- msg:
+		cli.stats.delivered.Add(1)
+		return
+	default:
+	}
+
+	switch cli.policy {
+	case PolicyDropNewest:
+		cli.stats.dropped.Add(1)
+		msg.release()
+	case PolicyDropOldest:
+		select {
+		case old := <-conn.send:
+			cli.stats.dropped.Add(1)
+			old.release()
+		default:
+		}
+
+		select {
+		case conn.send <- msg:
+			cli.stats.delivered.Add(1)
+		default:
+			cli.stats.dropped.Add(1)
+			msg.release()
+		}
+	case PolicyBlock:
+		t := time.NewTimer(cli.blockTimeout)
+		defer t.Stop()
+
+		select {
+		case conn.send <- msg:
+			cli.stats.delivered.Add(1)
+		case <-t.C:
+			msg.release()
+			s.dropSlow(conn)
+		}
+	default:
+		msg.release()
+		s.dropSlow(conn)
+	}
+}
+
+func (s *shard) dropSlow(conn *connHander) {
+	s.cli.stats.dropped.Add(1)
+	s.cli.stats.disconnected.Add(1)
+
+	conn.setCloseReason(CloseReason{Code: ws.StatusPolicyViolation, Text: "slow consumer"})
+	s.remove(conn)
+}
+
+// remove unregisters conn and closes its send queue, which starts the
+// closing handshake. It is safe to call more than once per connection.
+// It must only be called from the goroutine of the shard.
+func (s *shard) remove(conn *connHander) {
+	if !s.cs[conn] {
+		return
+	}
+
+	delete(s.cs, conn)
+	close(conn.send)
+	s.cli.leave()
+}
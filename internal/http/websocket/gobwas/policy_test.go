@@ -0,0 +1,171 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+func textMessage(s string) *wsutil.Message {
+	return &wsutil.Message{OpCode: ws.OpText, Payload: []byte(s)}
+}
+
+// waitStats waits for the counters of cli to reach want.
+func waitStats(t *testing.T, cli *Client, want Stats) {
+	t.Helper()
+
+	if !waitFor(func() bool { return cli.Stats() == want }) {
+		t.Fatalf("stats: got %+v, want %+v", cli.Stats(), want)
+	}
+}
+
+// nextText returns the payload of the next frame of p, or its close code.
+func nextText(t *testing.T, p *testPeer) string {
+	t.Helper()
+
+	f, ok := p.next()
+	if !ok {
+		return "eof"
+	}
+	if code, reason := closeCode(f); code != 0 {
+		return "close " + reason
+	}
+	return string(f.Payload)
+}
+
+// stall makes the peer of p slow: "m1" is being written to it and "m2" is
+// waiting in its queue of one message.
+func stall(t *testing.T, cli *Client, p *testPeer) {
+	t.Helper()
+
+	cli.Broadcast(textMessage("m1"))
+	// the writer is stuck until the rest of the frame is read
+	p.skip(1)
+	cli.Broadcast(textMessage("m2"))
+}
+
+func TestSlowConsumerPolicy(t *testing.T) {
+	opts := func(p SlowConsumerPolicy, more ...Option) []Option {
+		return append([]Option{
+			WithCapacity(1),
+			WithShards(1),
+			WithSlowConsumerPolicy(p),
+			// the peers don't answer close frames
+			WithCloseWait(10 * time.Millisecond),
+		}, more...)
+	}
+
+	t.Run("disconnect", func(t *testing.T) {
+		is := is.New(t)
+
+		cli, reasons := newTestClient(t, opts(PolicyDisconnect)...)
+		p := dialTest(t, cli, "")
+		stall(t, cli, p)
+
+		cli.Broadcast(textMessage("m3")) // queue full
+		waitStats(t, cli, Stats{Delivered: 2, Dropped: 1, Disconnected: 1})
+
+		p.start()
+		is.Equal(nextText(t, p), "m1")                  // being written
+		is.Equal(nextText(t, p), "m2")                  // queued
+		is.Equal(nextText(t, p), "close slow consumer") // then closed
+
+		r := nextReason(t, reasons)
+		is.Equal(r.Code, ws.StatusPolicyViolation) // 1008
+		is.Equal(cli.Len(), 0)                     // removed
+	})
+
+	t.Run("drop newest", func(t *testing.T) {
+		is := is.New(t)
+
+		cli, _ := newTestClient(t, opts(PolicyDropNewest)...)
+		p := dialTest(t, cli, "")
+		stall(t, cli, p)
+
+		cli.Broadcast(textMessage("m3")) // queue full
+		waitStats(t, cli, Stats{Delivered: 2, Dropped: 1})
+
+		p.start()
+		is.Equal(nextText(t, p), "m1") // being written
+		is.Equal(nextText(t, p), "m2") // queued
+
+		cli.Broadcast(textMessage("m4"))
+		is.Equal(nextText(t, p), "m4") // m3 was dropped
+		is.Equal(cli.Len(), 1)         // still connected
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+		is := is.New(t)
+
+		cli, _ := newTestClient(t, opts(PolicyDropOldest)...)
+		p := dialTest(t, cli, "")
+		stall(t, cli, p)
+
+		cli.Broadcast(textMessage("m3")) // queue full
+		waitStats(t, cli, Stats{Delivered: 3, Dropped: 1})
+
+		p.start()
+		is.Equal(nextText(t, p), "m1") // being written
+		is.Equal(nextText(t, p), "m3") // m2 was dropped
+		is.Equal(cli.Len(), 1)         // still connected
+	})
+
+	t.Run("block", func(t *testing.T) {
+		is := is.New(t)
+
+		cli, _ := newTestClient(t, opts(PolicyBlock, WithBlockTimeout(testTimeout))...)
+		p := dialTest(t, cli, "")
+		stall(t, cli, p)
+
+		cli.Broadcast(textMessage("m3")) // waits for room
+		p.start()
+
+		is.Equal(nextText(t, p), "m1")             // being written
+		is.Equal(nextText(t, p), "m2")             // queued
+		is.Equal(nextText(t, p), "m3")             // queued once there was room
+		is.Equal(cli.Stats(), Stats{Delivered: 3}) // nothing dropped
+	})
+
+	t.Run("block times out", func(t *testing.T) {
+		is := is.New(t)
+
+		cli, reasons := newTestClient(t, opts(PolicyBlock, WithBlockTimeout(20*time.Millisecond))...)
+		p := dialTest(t, cli, "")
+		stall(t, cli, p)
+
+		cli.Broadcast(textMessage("m3")) // no room in time
+		waitStats(t, cli, Stats{Delivered: 2, Dropped: 1, Disconnected: 1})
+
+		p.start()
+		is.Equal(nextText(t, p), "m1")                  // being written
+		is.Equal(nextText(t, p), "m2")                  // queued
+		is.Equal(nextText(t, p), "close slow consumer") // then closed
+
+		r := nextReason(t, reasons)
+		is.Equal(r.Code, ws.StatusPolicyViolation) // 1008
+	})
+
+	t.Run("block stalls the shard", func(t *testing.T) {
+		is := is.New(t)
+
+		const blockTimeout = 200 * time.Millisecond
+
+		cli, _ := newTestClient(t, opts(PolicyBlock, WithBlockTimeout(blockTimeout))...)
+		slow := dialTest(t, cli, "")
+		fast := dialTest(t, cli, "").start()
+		stall(t, cli, slow)
+		is.Equal(nextText(t, fast), "m1") // fast peer is served
+		is.Equal(nextText(t, fast), "m2") // queued behind it
+
+		cli.Broadcast(textMessage("m3")) // the shard waits for the slow peer
+		start := time.Now()
+		cli.Broadcast(textMessage("m4"))
+
+		is.Equal(nextText(t, fast), "m3")              // before or after the block
+		is.Equal(nextText(t, fast), "m4")              // after the block timeout
+		is.True(time.Since(start) >= blockTimeout*3/4) // every peer of the shard waited
+	})
+}
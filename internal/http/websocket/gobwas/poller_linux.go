@@ -0,0 +1,219 @@
+//go:build linux
+
+package websocket
+
+import (
+	"errors"
+	"sync"
+	"syscall"
+)
+
+// Poller waits with epoll for connections to have something to read and
+// reads them on a bounded pool of workers. A connection read this way
+// doesn't need a goroutine of its own while it is idle, which is most of
+// the time for peers that only listen.
+//
+// A Poller can be shared by many clients.
+type Poller struct {
+	epfd int
+	// wake is a pipe used to interrupt epoll_wait on Close.
+	wake [2]int
+
+	mu   sync.Mutex
+	seq  uint64
+	regs map[uint64]*pollReg
+
+	// fdMu is held for reading while epfd is used and for writing while
+	// it is closed, so that a late call can't reach a reused number.
+	fdMu   sync.RWMutex
+	closed bool
+
+	tasks chan func()
+	// closing is closed by Close to stop wait, even while it is blocked
+	// on busy workers, and done once it has returned.
+	closing   chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type pollReg struct {
+	fd     int
+	onRead func()
+}
+
+// wakeID is the registration id of the wake pipe, real registrations
+// start from 1.
+const wakeID = 0
+
+// NewPoller starts a poller that handles readable connections on workers
+// goroutines.
+func NewPoller(workers int) (*Poller, error) {
+	if workers <= 0 {
+		return nil, errors.New("poller needs at least one worker")
+	}
+
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Poller{
+		epfd:    epfd,
+		regs:    make(map[uint64]*pollReg),
+		tasks:   make(chan func(), workers),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	if err := syscall.Pipe2(p.wake[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		syscall.Close(epfd)
+		return nil, err
+	}
+	if err := p.ctl(syscall.EPOLL_CTL_ADD, p.wake[0], wakeID, syscall.EPOLLIN); err != nil {
+		p.closeFDs()
+		return nil, err
+	}
+
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	go p.wait()
+
+	return p, nil
+}
+
+// Close stops the poller. Connections still registered are no longer
+// read. It doesn't wait for the workers to finish the reads in progress.
+func (p *Poller) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closing)
+		syscall.Write(p.wake[1], []byte{0})
+		<-p.done
+
+		p.fdMu.Lock()
+		defer p.fdMu.Unlock()
+		p.closed = true
+		p.closeFDs()
+	})
+
+	return nil
+}
+
+func (p *Poller) closeFDs() {
+	syscall.Close(p.wake[0])
+	syscall.Close(p.wake[1])
+	syscall.Close(p.epfd)
+}
+
+// register adds fd, onRead will be called on a worker once it is
+// readable. Nothing is polled until the id returned is armed.
+func (p *Poller) register(fd int, onRead func()) uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.seq++
+	p.regs[p.seq] = &pollReg{fd: fd, onRead: onRead}
+	return p.seq
+}
+
+// arm starts polling a registration. Polling is one-shot: resume must be
+// called to be told again.
+func (p *Poller) arm(id uint64) error {
+	p.mu.Lock()
+	reg, ok := p.regs[id]
+	p.mu.Unlock()
+	if !ok {
+		return errors.New("connection not registered")
+	}
+
+	return p.ctl(syscall.EPOLL_CTL_ADD, reg.fd, id, pollEvents)
+}
+
+// resume asks to be told again once the connection is readable.
+func (p *Poller) resume(id uint64) error {
+	p.mu.Lock()
+	reg, ok := p.regs[id]
+	p.mu.Unlock()
+	if !ok {
+		return errors.New("connection not registered")
+	}
+
+	return p.ctl(syscall.EPOLL_CTL_MOD, reg.fd, id, pollEvents)
+}
+
+// remove unregisters a connection. It must be called before its file
+// descriptor is closed, as the number may then be reused.
+func (p *Poller) remove(id uint64) {
+	p.mu.Lock()
+	reg, ok := p.regs[id]
+	delete(p.regs, id)
+	p.mu.Unlock()
+
+	if ok {
+		p.fdMu.RLock()
+		defer p.fdMu.RUnlock()
+		if !p.closed {
+			syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, reg.fd, nil)
+		}
+	}
+}
+
+const pollEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+// ctl registers fd under id, which is what epoll gives back in events so
+// that a late event for a closed and reused fd is not mistaken for the
+// new connection.
+func (p *Poller) ctl(op, fd int, id uint64, events uint32) error {
+	p.fdMu.RLock()
+	defer p.fdMu.RUnlock()
+	if p.closed {
+		return errPollerClosed
+	}
+
+	ev := syscall.EpollEvent{Events: events, Fd: int32(id), Pad: int32(id >> 32)}
+	return syscall.EpollCtl(p.epfd, op, fd, &ev)
+}
+
+var errPollerClosed = errors.New("poller closed")
+
+func (p *Poller) wait() {
+	defer close(p.done)
+	defer close(p.tasks)
+
+	events := make([]syscall.EpollEvent, 128)
+	for {
+		n, err := syscall.EpollWait(p.epfd, events, -1)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		} else if err != nil {
+			return
+		}
+
+		for _, ev := range events[:n] {
+			id := uint64(uint32(ev.Fd)) | uint64(uint32(ev.Pad))<<32
+			if id == wakeID {
+				return
+			}
+
+			p.mu.Lock()
+			reg, ok := p.regs[id]
+			p.mu.Unlock()
+			if !ok {
+				continue
+			}
+
+			// blocks while every worker is busy
+			select {
+			case p.tasks <- reg.onRead:
+			case <-p.closing:
+				return
+			}
+		}
+	}
+}
+
+func (p *Poller) work() {
+	for f := range p.tasks {
+		f()
+	}
+}
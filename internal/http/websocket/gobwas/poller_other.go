@@ -0,0 +1,25 @@
+//go:build !linux
+
+package websocket
+
+import "errors"
+
+// Poller is only available on Linux, where it uses epoll.
+type Poller struct{}
+
+// NewPoller always fails outside of Linux.
+func NewPoller(workers int) (*Poller, error) {
+	return nil, errors.New("poller is only supported on linux")
+}
+
+func (p *Poller) Close() error { return nil }
+
+func (p *Poller) register(fd int, onRead func()) uint64 { return 0 }
+
+func (p *Poller) arm(id uint64) error {
+	return errors.New("poller is only supported on linux")
+}
+
+func (p *Poller) resume(id uint64) error { return nil }
+
+func (p *Poller) remove(id uint64) {}
@@ -0,0 +1,125 @@
+package websocket
+
+import (
+	"context"
+
+	"github.com/gobwas/ws/wsutil"
+)
+
+// ConnID identifies a connection within a Client.
+type ConnID uint64
+
+// Peer describes the connection a message was received from.
+type Peer struct {
+	ID   ConnID
+	User string
+}
+
+// MessageHandler is called by the read loop for every message received
+// from a peer. It decides where the message goes, by default it is
+// broadcast to every connection.
+//
+// The message and its payload are reused once the handler returns, they
+// must be copied to be kept. Sending msg from the handler is safe as it
+// is encoded straight away.
+type MessageHandler func(cli *Client, from Peer, msg *wsutil.Message)
+
+// WithMessageHandler sets the handler for messages received from peers.
+func WithMessageHandler(h MessageHandler) Option {
+	return func(cli *Client) {
+		cli.onMessage = h
+	}
+}
+
+func broadcastHandler(cli *Client, from Peer, msg *wsutil.Message) {
+	cli.Broadcast(msg)
+}
+
+type contextKey string
+
+func (k contextKey) String() string {
+	return "websocket context key " + string(k)
+}
+
+const userKey contextKey = "user"
+
+// NewContext returns a copy of ctx carrying the user of a connection.
+// Requests passed to Client.ServeHTTP with such a context can later be
+// addressed with Client.SendToUser.
+func NewContext(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey, user)
+}
+
+// UserFromContext returns the user stored in ctx by NewContext.
+func UserFromContext(ctx context.Context) (string, bool) {
+	user, ok := ctx.Value(userKey).(string)
+	return user, ok
+}
+
+// envelope is a message together with the connections it is addressed to.
+type envelope struct {
+	// f is the message encoded once for every peer.
+	f *PreparedFrame
+	// to is the only connection that receives f when non-zero.
+	to ConnID
+	// user restricts f to the connections of a user when non-empty.
+	user string
+	// except is a connection skipped by f.
+	except ConnID
+}
+
+func (e *envelope) match(conn *connHander) bool {
+	switch {
+	case e.to != 0:
+		return conn.id == e.to
+	case e.user != "":
+		return conn.user == e.user
+	default:
+		return conn.id != e.except
+	}
+}
+
+// Broadcast sends msg to every connection.
+func (cli *Client) Broadcast(msg *wsutil.Message) {
+	cli.send(msg, envelope{})
+}
+
+// BroadcastExcept sends msg to every connection but id, typically the
+// sender so that it doesn't receive its own message back.
+func (cli *Client) BroadcastExcept(id ConnID, msg *wsutil.Message) {
+	cli.send(msg, envelope{except: id})
+}
+
+// SendTo sends msg to a single connection. It is a no-op if the
+// connection is gone.
+func (cli *Client) SendTo(id ConnID, msg *wsutil.Message) {
+	cli.send(msg, envelope{to: id})
+}
+
+// SendToUser sends msg to every connection of user.
+func (cli *Client) SendToUser(user string, msg *wsutil.Message) {
+	cli.send(msg, envelope{user: user})
+}
+
+// BroadcastFrame sends a prepared frame to every connection.
+func (cli *Client) BroadcastFrame(f *PreparedFrame) {
+	f.retain()
+	cli.sendFrame(f, envelope{})
+}
+
+// send encodes msg once and hands it to the hub with env.
+func (cli *Client) send(msg *wsutil.Message, env envelope) {
+	cli.sendFrame(prepareFrame(msg), env)
+}
+
+// sendFrame hands f to the hub with env, it is dropped once the hub is
+// closed. The reference of the caller to f goes with it.
+func (cli *Client) sendFrame(f *PreparedFrame, env envelope) {
+	env.f = f
+
+	select {
+	case cli.bc <- env:
+	case <-cli.quit:
+		f.release()
+	}
+}
@@ -0,0 +1,61 @@
+package websocket
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+func TestSend(t *testing.T) {
+	// setup connects ann, then bob twice. Connections are numbered from
+	// one in the order they are served.
+	setup := func(t *testing.T) (*Client, map[string]*testPeer) {
+		cli, _ := newTestClient(t)
+		ps := map[string]*testPeer{}
+		for _, name := range []string{"ann", "bob", "bob2"} {
+			ps[name] = dialTest(t, cli, strings.TrimSuffix(name, "2")).start()
+		}
+		if !waitFor(func() bool { return cli.Len() == len(ps) }) {
+			t.Fatalf("got %d connections, want %d", cli.Len(), len(ps))
+		}
+		return cli, ps
+	}
+	const ann, bob = ConnID(1), ConnID(2)
+
+	t.Run("send to a connection", func(t *testing.T) {
+		is := is.New(t)
+
+		cli, ps := setup(t)
+		cli.SendTo(bob, textMessage("only one bob"))
+		cli.Broadcast(textMessage("everyone"))
+
+		is.Equal(nextText(t, ps["ann"]), "everyone")     // not addressed
+		is.Equal(nextText(t, ps["bob"]), "only one bob") // addressed
+		is.Equal(nextText(t, ps["bob2"]), "everyone")    // other connection of the user
+	})
+
+	t.Run("send to a user", func(t *testing.T) {
+		is := is.New(t)
+
+		cli, ps := setup(t)
+		cli.SendToUser("bob", textMessage("bobs"))
+		cli.Broadcast(textMessage("everyone"))
+
+		is.Equal(nextText(t, ps["ann"]), "everyone") // other user
+		is.Equal(nextText(t, ps["bob"]), "bobs")     // every connection
+		is.Equal(nextText(t, ps["bob2"]), "bobs")    // of the user
+	})
+
+	t.Run("broadcast except the sender", func(t *testing.T) {
+		is := is.New(t)
+
+		cli, ps := setup(t)
+		cli.BroadcastExcept(ann, textMessage("not ann"))
+		cli.Broadcast(textMessage("everyone"))
+
+		is.Equal(nextText(t, ps["ann"]), "everyone") // skipped
+		is.Equal(nextText(t, ps["bob"]), "not ann")  // sent
+		is.Equal(nextText(t, ps["bob2"]), "not ann") // to the others
+	})
+}
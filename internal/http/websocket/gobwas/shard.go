@@ -0,0 +1,88 @@
+package websocket
+
+import "github.com/gobwas/ws"
+
+// Capacity of the queue of operations of a shard.
+const shardQueue = 64
+
+// A shard owns some of the connections of a Client and delivers messages
+// to them from its own goroutine, so that a broadcast to a large room is
+// spread over as many goroutines as there are shards. Connections are
+// assigned to a shard by id.
+type shard struct {
+	cli *Client
+	// ops are applied in the order the hub sent them.
+	ops chan shardOp
+	cs  map[*connHander]bool
+}
+
+// shardOp is one of adding or removing a connection, or delivering an
+// envelope.
+type shardOp struct {
+	add, remove *connHander
+	env         envelope
+}
+
+func newShard(cli *Client) *shard {
+	s := &shard{
+		cli: cli,
+		ops: make(chan shardOp, shardQueue),
+		cs:  make(map[*connHander]bool),
+	}
+
+	go s.run()
+	return s
+}
+
+// run applies the operations of the shard until the hub closes its queue,
+// then closes the connections left.
+func (s *shard) run() {
+	for op := range s.ops {
+		switch {
+		case op.add != nil:
+			s.cs[op.add] = true
+		case op.remove != nil:
+			s.remove(op.remove)
+		default:
+			for conn := range s.cs {
+				if op.env.match(conn) {
+					op.env.f.retain()
+					s.deliver(conn, op.env.f)
+				}
+			}
+			op.env.f.release()
+		}
+	}
+
+	for conn := range s.cs {
+		conn.setCloseReason(CloseReason{Code: ws.StatusGoingAway, Text: "hub closed"})
+		s.remove(conn)
+	}
+}
+
+// push queues op, a frame pushed with op is released by the shard. It
+// must only be called from the listen goroutine.
+func (s *shard) push(op shardOp) {
+	if op.env.f != nil {
+		op.env.f.retain()
+	}
+
+	s.ops <- op
+}
+
+// stop closes the queue of the shard once every operation pushed before
+// has been applied. It must only be called from the listen goroutine.
+func (s *shard) stop() {
+	close(s.ops)
+}
+
+// shardFor returns the shard of a connection, starting it on first use.
+// It must only be called from the listen goroutine.
+func (cli *Client) shardFor(id ConnID) *shard {
+	i := int(uint64(id) % uint64(len(cli.shards)))
+	if cli.shards[i] == nil {
+		cli.shards[i] = newShard(cli)
+	}
+
+	return cli.shards[i]
+}
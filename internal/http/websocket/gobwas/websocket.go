@@ -5,63 +5,98 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
 )
 
-const (
-	// Time allowed to write a message to the peer.
-	writeWait = 10 * time.Second
-	// Time allowed to read the next pong message from the peer.
-	pongWait   = 60 * time.Second
-	pingPeriod = (pongWait * 9) / 10
-)
-
 func read(conn *connHander, cli *Client) {
-	defer func() {
-		cli.d <- conn
-		conn.rwc.Close()
-	}()
-
-	conn.setReadDeadLine(pongWait)
+	defer conn.finishRead(cli)
 
 	for {
 		msg, err := conn.read()
 		if err != nil {
-			// handle error
-			break
+			conn.setCloseReason(closeReasonFromError(err))
+			return
 		}
 
-		cli.bc <- msg
+		cli.onMessage(cli, conn.peer(), msg)
+		putMessage(msg)
 	}
 }
 
-func write(conn *connHander) {
-	ticker := time.NewTicker(pingPeriod)
+// write is the only goroutine that writes to, and closes, the underlying
+// connection. It completes the closing handshake once the send channel is
+// closed by the hub.
+func write(conn *connHander, cli *Client) {
+	var batch []*PreparedFrame
+
+	ticker := time.NewTicker(cli.pingPeriod)
 	defer func() {
 		ticker.Stop()
+		if conn.polled() {
+			// before the fd is closed and its number reused
+			cli.poller.remove(conn.pollID)
+		}
 		conn.rwc.Close()
+		if conn.polled() {
+			// nothing reads the connection any more
+			conn.finishRead(cli)
+		}
+		// wait for the read loop so the close reason is final
+		<-conn.done
+		cli.disconnect(conn)
 	}()
 
 	for {
 		select {
-		case msg, ok := <-conn.send:
-			conn.setWriteDeadLine(writeWait)
+		case f := <-conn.ctrl:
+			conn.setWriteDeadLine(conn.writeWait)
+			if _, err := conn.rwc.Write(f.b); err != nil {
+				conn.logf("ctrl err: %v\n", err)
+				conn.setCloseReason(CloseReason{Code: ws.StatusAbnormalClosure, Err: err})
+				return
+			}
+		case f, ok := <-conn.send:
 			if !ok {
-				conn.write(&wsutil.Message{OpCode: ws.OpClose, Payload: []byte{}})
+				conn.close()
 				return
 			}
 
-			if err := conn.write(msg); err != nil {
+			// frames queued behind f go out with it
+			var open bool
+			batch, open = conn.collect(append(batch[:0], f))
+
+			conn.setWriteDeadLine(conn.writeWait)
+			err := conn.flush(batch)
+			for i, f := range batch {
+				f.release()
+				batch[i] = nil
+			}
+			if err != nil {
 				conn.logf("msg err: %v\n", err)
+				conn.setCloseReason(CloseReason{Code: ws.StatusAbnormalClosure, Err: err})
+				return
+			}
+
+			if !open {
+				conn.close()
 				return
 			}
 		case <-ticker.C:
-			conn.setWriteDeadLine(writeWait)
-			if err := conn.write(&wsutil.Message{OpCode: ws.OpPing, Payload: nil}); err != nil {
+			if conn.polled() && conn.pongExpired() {
+				conn.setCloseReason(CloseReason{Code: ws.StatusAbnormalClosure, Err: errPongTimeout})
+				return
+			}
+
+			conn.setWriteDeadLine(conn.writeWait)
+			if _, err := conn.rwc.Write(pingFrame.b); err != nil {
 				conn.logf("ticker err: %v\n", err)
+				conn.setCloseReason(CloseReason{Code: ws.StatusAbnormalClosure, Err: err})
 				return
 			}
 		}
@@ -70,80 +105,340 @@ func write(conn *connHander) {
 
 type Client struct {
 	r, d chan *connHander
-	bc   chan *wsutil.Message
-	cs   map[*connHander]bool
+	bc   chan envelope
 	u    *ws.HTTPUpgrader
+	l    *log.Logger
+
+	// shards are started as connections are assigned to them, they are
+	// only used by the listen goroutine.
+	shards []*shard
+
+	// poller reads the connections when set, see WithPoller.
+	poller *Poller
+
+	// quit is closed by Close to stop the hub.
+	quit      chan struct{}
+	closeOnce sync.Once
+	// n is the number of connections, idle is when it last dropped to
+	// zero in unix nanoseconds.
+	n    atomic.Int64
+	idle atomic.Int64
+
+	writeWait, pongWait, pingPeriod, closeWait, frameWait time.Duration
+	maxMessageSize                                        int64
+
+	writeBatch int
+	writeDelay time.Duration
+
+	policy       SlowConsumerPolicy
+	blockTimeout time.Duration
+	stats        stats
 
-	// Capacity of the send channel.
+	onMessage MessageHandler
+	seq       atomic.Uint64
+
+	// Capacity of the send channel, 16 by default.
 	// If capacity is 0, the send channel is unbuffered.
 	Capacity uint8
+
+	// OnDisconnect, if set, is called once for every connection after it
+	// has been closed, with the reason it ended.
+	OnDisconnect func(p Peer, reason CloseReason)
 }
 
-func NewClient() *Client {
+func NewClient(opts ...Option) *Client {
 	cli := &Client{
-		r:  make(chan *connHander),
-		d:  make(chan *connHander),
-		bc: make(chan *wsutil.Message),
-		cs: make(map[*connHander]bool),
-		u:  &ws.HTTPUpgrader{},
+		r:    make(chan *connHander),
+		d:    make(chan *connHander),
+		bc:   make(chan envelope),
+		u:    &ws.HTTPUpgrader{},
+		l:    log.Default(),
+		quit: make(chan struct{}),
+
+		writeWait: defaultWriteWait,
+		pongWait:  defaultPongWait,
+		closeWait: defaultCloseWait,
+		frameWait: defaultFrameWait,
+
+		writeBatch: defaultWriteBatch,
+
+		blockTimeout: defaultBlockTimeout,
+		Capacity:     defaultCapacity,
+
+		onMessage: broadcastHandler,
 	}
 
+	cli.shards = make([]*shard, runtime.GOMAXPROCS(0))
+
+	for _, opt := range opts {
+		opt(cli)
+	}
+
+	if cli.pingPeriod <= 0 || cli.pingPeriod >= cli.pongWait {
+		cli.pingPeriod = (cli.pongWait * 9) / 10
+	}
+	cli.idle.Store(time.Now().UnixNano())
+
 	go cli.listen()
 	return cli
 }
 
+// listen hands connections and messages to the shards. Going through a
+// single goroutine keeps messages in the same order for every peer.
 func (cli *Client) listen() {
 	for {
 		select {
 		case conn := <-cli.r:
-			cli.cs[conn] = true
+			cli.shardFor(conn.id).push(shardOp{add: conn})
 		case conn := <-cli.d:
-			delete(cli.cs, conn)
-			close(conn.send)
-		case msg := <-cli.bc:
-			for conn := range cli.cs {
-				select {
-				case conn.send <- msg:
-				default:
-					close(conn.send)
-					delete(cli.cs, conn)
+			cli.shardFor(conn.id).push(shardOp{remove: conn})
+		case env := <-cli.bc:
+			if env.to != 0 {
+				cli.shardFor(env.to).push(shardOp{env: env})
+			} else {
+				for _, s := range cli.shards {
+					if s != nil {
+						s.push(shardOp{env: env})
+					}
+				}
+			}
+			// the shards hold their own references
+			env.f.release()
+		case <-cli.quit:
+			// after the last push, so that connections registered as
+			// the hub closes are closed too
+			for _, s := range cli.shards {
+				if s != nil {
+					s.stop()
 				}
 			}
+			return
 		}
 	}
 }
 
+// Close stops the hub and starts the closing handshake of every
+// connection with ws.StatusGoingAway. Connections made afterwards are
+// refused and messages sent afterwards are dropped. It is safe to call
+// more than once.
+func (cli *Client) Close() {
+	cli.closeOnce.Do(func() { close(cli.quit) })
+}
+
+// leave uncounts a connection.
+func (cli *Client) leave() {
+	if cli.n.Add(-1) == 0 {
+		cli.idle.Store(time.Now().UnixNano())
+	}
+}
+
+// Len returns the number of open connections.
+func (cli *Client) Len() int {
+	return int(cli.n.Load())
+}
+
+// IdleSince returns when the client was last left without connections,
+// or when it was created if it never had any. It reports false while
+// there are open connections.
+func (cli *Client) IdleSince() (time.Time, bool) {
+	if cli.n.Load() > 0 {
+		return time.Time{}, false
+	}
+
+	return time.Unix(0, cli.idle.Load()), true
+}
+
 func (cli *Client) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-cli.quit:
+		http.Error(w, "hub closed", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+
 	rwc, _, _, err := cli.u.Upgrade(r, w)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	l := log.Default()
+	user, _ := UserFromContext(r.Context())
+	cli.serve(rwc, user)
+}
 
+// newConn wraps an upgraded connection with the settings of the client.
+func (cli *Client) newConn(rwc net.Conn, user string) *connHander {
 	conn := &connHander{
+		id:   ConnID(cli.seq.Add(1)),
+		user: user,
 		rwc:  rwc,
-		send: make(chan *wsutil.Message),
-		log:  l.Println,
-		logf: l.Printf,
+		send: make(chan *PreparedFrame, cli.Capacity),
+		ctrl: make(chan *PreparedFrame, 1),
+		done: make(chan struct{}),
+		log:  cli.l.Println,
+		logf: cli.l.Printf,
+
+		writeWait:      cli.writeWait,
+		pongWait:       cli.pongWait,
+		closeWait:      cli.closeWait,
+		frameWait:      cli.frameWait,
+		maxMessageSize: cli.maxMessageSize,
+		writeBatch:     cli.writeBatch,
+		writeDelay:     cli.writeDelay,
+	}
+	conn.onControl = conn.controlHandler
+	conn.pong.Store(time.Now().UnixNano())
+
+	return conn
+}
+
+// serve runs an upgraded connection until it is closed.
+func (cli *Client) serve(rwc net.Conn, user string) {
+	conn := cli.newConn(rwc, user)
+
+	// counted before it is registered so that once serve returns the
+	// client is no longer idle
+	cli.n.Add(1)
+	select {
+	case cli.r <- conn:
+	case <-cli.quit:
+		cli.leave()
+		// closed while upgrading, the handshake is already done
+		ws.WriteFrame(rwc, ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusGoingAway, "hub closed")))
+		rwc.Close()
+		return
 	}
 
-	cli.r <- conn
+	// set before the write goroutine starts, which may shorten it to
+	// close the connection
+	conn.setReadDeadLine(conn.pongWait)
+
+	if cli.poller != nil && cli.poll(conn) {
+		go write(conn, cli)
+		return
+	}
 
-	go write(conn)
+	go write(conn, cli)
 	go read(conn, cli)
 }
 
-type connHander struct {
-	rwc net.Conn
+func (cli *Client) disconnect(conn *connHander) {
+	reason := conn.closeReason()
+	conn.logf("close: %v\n", reason)
 
-	send chan *wsutil.Message
+	if f := cli.OnDisconnect; f != nil {
+		f(conn.peer(), reason)
+	}
+}
+
+type connHander struct {
+	id   ConnID
+	user string
+	rwc  net.Conn
+
+	send chan *PreparedFrame
+	// ctrl holds control frames queued by the read loop, such as pongs,
+	// so that only the write goroutine writes to rwc.
+	ctrl chan *PreparedFrame
+	// done is closed once the read loop has returned.
+	done chan struct{}
+
+	mu     sync.Mutex
+	reason *CloseReason
+
+	// readOnce guards the end of reading, which may be reached by a
+	// worker of the poller and by the write goroutine.
+	readOnce sync.Once
+	// pollID is the registration of the connection with the poller, zero
+	// if it is read by its own goroutine.
+	pollID uint64
+	// pong is when the last pong was read in unix nanoseconds.
+	pong atomic.Int64
+
+	writeWait, pongWait, closeWait, frameWait time.Duration
+	maxMessageSize                            int64
+
+	// writeBatch and writeDelay bound the frames gathered into a write.
+	writeBatch int
+	writeDelay time.Duration
+
+	// onControl is c.controlHandler, bound once rather than on every read.
+	onControl wsutil.FrameHandlerFunc
 
 	logf func(format string, v ...any)
 	log  func(v ...any)
 }
 
+// finishRead signals that the connection will not be read any more and
+// hands it back to the hub.
+func (c *connHander) finishRead(cli *Client) {
+	c.readOnce.Do(func() {
+		close(c.done)
+		select {
+		case cli.d <- c:
+		case <-cli.quit:
+		}
+	})
+}
+
+func (c *connHander) polled() bool {
+	return c.pollID != 0
+}
+
+func (c *connHander) peer() Peer {
+	return Peer{ID: c.id, User: c.user}
+}
+
+// setCloseReason records why the connection is ending. Only the first
+// reason is kept, as it is the one that started the shutdown.
+func (c *connHander) setCloseReason(r CloseReason) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.reason == nil {
+		c.reason = &r
+	}
+}
+
+func (c *connHander) closeReason() CloseReason {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.reason == nil {
+		return CloseReason{Code: ws.StatusAbnormalClosure}
+	}
+	return *c.reason
+}
+
+// close performs the server's half of the closing handshake. When the
+// peer started it, its status code is echoed back; otherwise the server
+// sends its own close frame and waits for the reply, bounded by c.closeWait.
+func (c *connHander) close() {
+	c.setCloseReason(CloseReason{Code: ws.StatusNormalClosure})
+
+	if f, ok := c.closeReason().closeFrame(); ok {
+		c.setWriteDeadLine(c.writeWait)
+		if err := ws.WriteFrame(c.rwc, f); err != nil {
+			return
+		}
+	}
+
+	c.setReadDeadLine(c.closeWait)
+	if !c.polled() {
+		<-c.done
+		return
+	}
+
+	// the deadline only applies to reads in progress
+	t := time.NewTimer(c.closeWait)
+	defer t.Stop()
+
+	select {
+	case <-c.done:
+	case <-t.C:
+	}
+}
+
 func (c *connHander) setWriteDeadLine(d time.Duration) error {
 	return c.rwc.SetWriteDeadline(time.Now().Add(d))
 }
@@ -152,8 +447,27 @@ func (c *connHander) setReadDeadLine(d time.Duration) error {
 	return c.rwc.SetReadDeadline(time.Now().Add(d))
 }
 
+// read returns the next message of the peer, answering the control frames
+// that come before it. A polled connection returns a nil message after a
+// control frame instead, as the rest may not have arrived.
+//
+// The message comes from a pool, it must be given back with putMessage
+// once handled.
 func (c *connHander) read() (*wsutil.Message, error) {
-	r := wsutil.NewReader(c.rwc, ws.StateServerSide)
+	r := readerPool.Get().(*wsutil.Reader)
+	defer func() {
+		// don't keep the connection alive from the pool
+		*r = wsutil.Reader{}
+		readerPool.Put(r)
+	}()
+
+	*r = wsutil.Reader{
+		Source:       c.rwc,
+		State:        ws.StateServerSide,
+		MaxFrameSize: c.maxMessageSize,
+		// control frames may be interleaved with the fragments of a message
+		OnIntermediate: c.onControl,
+	}
 
 	for {
 		h, err := r.NextFrame()
@@ -162,9 +476,13 @@ func (c *connHander) read() (*wsutil.Message, error) {
 		}
 
 		if h.OpCode.IsControl() {
-			if err := c.controlHandler(h, r); err != nil {
+			if err := c.onControl(h, r); err != nil {
 				return nil, err
 			}
+			if c.polled() {
+				// there may be nothing else to read yet
+				return nil, nil
+			}
 			continue
 		}
 
@@ -174,51 +492,111 @@ func (c *connHander) read() (*wsutil.Message, error) {
 			if err := r.Discard(); err != nil {
 				return nil, err
 			}
+			if c.polled() {
+				return nil, nil
+			}
 			continue
 		}
 
-		p, err := io.ReadAll(r)
-		if err != nil {
+		// the remaining payload of the message, the limit applies across
+		// all of its fragments
+		msg := getMessage(h.OpCode)
+		if msg.Payload, err = readAll(msg.Payload, r, c.maxMessageSize); err != nil {
+			putMessage(msg)
 			return nil, err
 		}
-		return &wsutil.Message{OpCode: h.OpCode, Payload: p}, nil
+		return msg, nil
 	}
 }
 
-func (c *connHander) write(msg *wsutil.Message) error {
-	// This is server-side
-	frame := ws.NewFrame(msg.OpCode, true, msg.Payload)
-	return ws.WriteFrame(c.rwc, frame)
-}
-
 func (c *connHander) controlHandler(h ws.Header, r io.Reader) error {
 	switch op := h.OpCode; op {
 	case ws.OpPing:
-		return c.handlePing(h)
+		return c.handlePing(h, r)
 	case ws.OpPong:
-		return c.handlePong(h)
+		return c.handlePong(h, r)
 	case ws.OpClose:
-		return c.handleClose(h)
+		return c.handleClose(h, r)
 	}
 
 	return wsutil.ErrNotControlFrame
 }
 
-func (c *connHander) handlePing(h ws.Header) error {
-	c.log("ping")
-	return nil
+// queueControl hands a control frame to the write goroutine. If a frame
+// is still pending it is replaced, as RFC6455#5.5.3 allows answering only
+// the most recent ping.
+func (c *connHander) queueControl(f *PreparedFrame) {
+	for {
+		select {
+		case c.ctrl <- f:
+			return
+		default:
+		}
+
+		select {
+		case <-c.ctrl:
+		default:
+		}
+	}
 }
 
-func (c *connHander) handlePong(h ws.Header) error {
-	c.log("pong")
-	return c.setReadDeadLine(pongWait)
+// readControl reads the payload of a control frame.
+func (c *connHander) readControl(h ws.Header, r io.Reader) ([]byte, error) {
+	if h.Length > ws.MaxControlFramePayloadSize {
+		return nil, ws.ErrProtocolControlPayloadOverflow
+	}
+
+	p := make([]byte, h.Length)
+	_, err := io.ReadFull(r, p)
+	return p, err
 }
 
-func (c *connHander) handleClose(h ws.Header) error {
-	c.log("close")
+func (c *connHander) handlePing(h ws.Header, r io.Reader) error {
+	p, err := c.readControl(h, r)
+	if err != nil {
+		return err
+	}
+
+	c.queueControl(NewPreparedFrame(ws.OpPong, p))
 	return nil
 }
 
+func (c *connHander) handlePong(h ws.Header, r io.Reader) error {
+	if _, err := c.readControl(h, r); err != nil {
+		return err
+	}
+
+	c.pong.Store(time.Now().UnixNano())
+	if c.polled() {
+		// the deadline of a polled connection bounds the read in
+		// progress, pongs are checked by the write goroutine
+		return nil
+	}
+	return c.setReadDeadLine(c.pongWait)
+}
+
+// handleClose reads the status code and reason sent by the peer. The
+// returned wsutil.ClosedError stops the read loop, the echo is sent by
+// the write goroutine.
+func (c *connHander) handleClose(h ws.Header, r io.Reader) error {
+	p, err := c.readControl(h, r)
+	if err != nil {
+		return err
+	}
+
+	if len(p) == 0 {
+		// RFC6455#7.1.5: no status code is considered to be 1005.
+		return wsutil.ClosedError{Code: ws.StatusNoStatusRcvd}
+	}
+
+	code, reason := ws.ParseCloseFrameData(p)
+	if err := ws.CheckCloseFrameData(code, reason); err != nil {
+		return err
+	}
+
+	return wsutil.ClosedError{Code: code, Reason: reason}
+}
+
 // Recommended to use connHander.readRaw instead
 // func (c *connHander) read() (*wsutil.Message, error) {
 // 	p, op, err := wsutil.ReadClientData(c.rwc)
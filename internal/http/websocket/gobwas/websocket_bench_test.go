@@ -0,0 +1,227 @@
+package websocket
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// benchConn is an in-process peer that never sends anything and counts
+// what is written to it.
+type benchConn struct {
+	net.Conn
+	w *benchWrites
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// benchWrites counts the writes and bytes written to the peers of a room.
+type benchWrites struct {
+	calls, bytes atomic.Int64
+}
+
+func newBenchConn(w *benchWrites) *benchConn {
+	return &benchConn{w: w, closed: make(chan struct{})}
+}
+
+func (c *benchConn) Read(p []byte) (int, error) {
+	<-c.closed
+	return 0, io.EOF
+}
+
+func (c *benchConn) Write(p []byte) (int, error) {
+	c.w.calls.Add(1)
+	c.w.bytes.Add(int64(len(p)))
+	return len(p), nil
+}
+
+func (c *benchConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *benchConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *benchConn) SetWriteDeadline(time.Time) error { return nil }
+
+// repeatConn plays the same bytes to its reader over and over.
+type repeatConn struct {
+	net.Conn
+	p   []byte
+	off int
+}
+
+func (c *repeatConn) Read(p []byte) (int, error) {
+	n := copy(p, c.p[c.off:])
+	c.off = (c.off + n) % len(c.p)
+	return n, nil
+}
+
+// newBenchRoom returns a client with n peers connected and the counters
+// of what is written to them.
+func newBenchRoom(b *testing.B, n, shards int, opts ...Option) (*Client, *benchWrites) {
+	opts = append([]Option{
+		WithShards(shards),
+		WithLogger(log.New(io.Discard, "", 0)),
+		// deliveries wait for the writers instead of dropping peers
+		WithSlowConsumerPolicy(PolicyBlock),
+		WithBlockTimeout(time.Minute),
+	}, opts...)
+	cli := NewClient(opts...)
+
+	var (
+		written benchWrites
+		conns   = make([]*benchConn, n)
+	)
+	for i := range conns {
+		conns[i] = newBenchConn(&written)
+		cli.serve(conns[i], "")
+	}
+
+	b.Cleanup(func() {
+		cli.Close()
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+
+	return cli, &written
+}
+
+// waitWritten waits for frames of size bytes to be written.
+func waitWritten(written *benchWrites, frames, size int64) {
+	for written.bytes.Load() < frames*size {
+		runtime.Gosched()
+	}
+}
+
+// benchMessage is the message broadcast by the benchmarks, size is the
+// length of its frame.
+var (
+	benchMessage = &wsutil.Message{OpCode: ws.OpText, Payload: []byte("hello, world")}
+	benchSize    = int64(len(NewPreparedFrame(benchMessage.OpCode, benchMessage.Payload).b))
+)
+
+var benchRooms = []int{1_000, 10_000, 50_000}
+
+func benchShards() []int {
+	if n := runtime.GOMAXPROCS(0); n > 1 {
+		return []int{1, n}
+	}
+	return []int{1}
+}
+
+// BenchmarkBroadcastLatency measures how long a broadcast takes to reach
+// every peer of a room.
+func BenchmarkBroadcastLatency(b *testing.B) {
+	for _, n := range benchRooms {
+		for _, shards := range benchShards() {
+			b.Run(fmt.Sprintf("conns=%d/shards=%d", n, shards), func(b *testing.B) {
+				cli, written := newBenchRoom(b, n, shards)
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					cli.Broadcast(benchMessage)
+					waitWritten(written, int64(i+1)*int64(n), benchSize)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkBroadcastThroughput measures how many frames are delivered per
+// second when broadcasts are sent back to back.
+func BenchmarkBroadcastThroughput(b *testing.B) {
+	for _, n := range benchRooms {
+		for _, shards := range benchShards() {
+			b.Run(fmt.Sprintf("conns=%d/shards=%d", n, shards), func(b *testing.B) {
+				cli, written := newBenchRoom(b, n, shards)
+
+				b.ResetTimer()
+				start := time.Now()
+				for i := 0; i < b.N; i++ {
+					cli.Broadcast(benchMessage)
+				}
+				waitWritten(written, int64(b.N)*int64(n), benchSize)
+
+				b.ReportMetric(float64(b.N)*float64(n)/time.Since(start).Seconds(), "frames/s")
+			})
+		}
+	}
+}
+
+// BenchmarkBroadcastAllocs counts what a broadcast allocates, from Broadcast
+// to the write of every peer. Run it with -benchmem.
+func BenchmarkBroadcastAllocs(b *testing.B) {
+	for _, n := range []int{1, 100, 1_000} {
+		b.Run(fmt.Sprintf("conns=%d", n), func(b *testing.B) {
+			cli, written := newBenchRoom(b, n, 1)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				cli.Broadcast(benchMessage)
+				waitWritten(written, int64(i+1)*int64(n), benchSize)
+			}
+		})
+	}
+}
+
+// BenchmarkReadMessage counts what reading a message from a peer
+// allocates. Run it with -benchmem.
+func BenchmarkReadMessage(b *testing.B) {
+	for _, size := range []int{16, 4 << 10} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			var buf bytes.Buffer
+			if err := wsutil.WriteClientText(&buf, make([]byte, size)); err != nil {
+				b.Fatal(err)
+			}
+			conn := &connHander{rwc: &repeatConn{p: buf.Bytes()}, maxMessageSize: 1 << 20}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				msg, err := conn.read()
+				if err != nil {
+					b.Fatal(err)
+				}
+				putMessage(msg)
+			}
+		})
+	}
+}
+
+// BenchmarkWriteBatch sends bursts of broadcasts and reports how many
+// writes each frame costs, with and without coalescing.
+func BenchmarkWriteBatch(b *testing.B) {
+	const (
+		conns = 100
+		burst = 16
+	)
+
+	for _, batch := range []int{1, defaultWriteBatch} {
+		b.Run(fmt.Sprintf("batch=%d", batch), func(b *testing.B) {
+			cli, written := newBenchRoom(b, conns, 1, WithWriteBatch(batch))
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for j := 0; j < burst; j++ {
+					cli.Broadcast(benchMessage)
+				}
+				waitWritten(written, int64(i+1)*burst*conns, benchSize)
+			}
+
+			b.ReportMetric(float64(written.calls.Load())/float64(b.N*burst*conns), "writes/frame")
+		})
+	}
+}
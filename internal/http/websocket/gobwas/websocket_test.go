@@ -0,0 +1,169 @@
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+// How long a test waits for something to happen on a connection.
+const testTimeout = time.Second
+
+// newTestClient returns a client that logs nothing and is closed with the
+// test. Disconnections are sent to the returned channel.
+func newTestClient(t *testing.T, opts ...Option) (*Client, <-chan CloseReason) {
+	reasons := make(chan CloseReason, 16)
+
+	opts = append([]Option{
+		WithLogger(log.New(io.Discard, "", 0)),
+		WithDisconnectHandler(func(_ Peer, r CloseReason) { reasons <- r }),
+	}, opts...)
+
+	cli := NewClient(opts...)
+	t.Cleanup(cli.Close)
+	return cli, reasons
+}
+
+// testPeer is the client end of a connection served over net.Pipe.
+type testPeer struct {
+	t    *testing.T
+	conn net.Conn
+
+	// r is what the frames are read from, see skip.
+	r io.Reader
+	// frames are read from the server once started.
+	frames chan ws.Frame
+
+	mu sync.Mutex
+	// pong answers the pings of the server when set.
+	pong bool
+}
+
+// dialTest connects a peer to cli as user. Frames are only read from the
+// server once start is called, until then the server is stuck on its
+// first write.
+func dialTest(t *testing.T, cli *Client, user string) *testPeer {
+	server, client := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+
+	cli.serve(server, user)
+	return &testPeer{t: t, conn: client, r: client, frames: make(chan ws.Frame, 64)}
+}
+
+// start reads frames from the server in the background.
+func (p *testPeer) start() *testPeer {
+	go func() {
+		defer close(p.frames)
+
+		for {
+			f, err := ws.ReadFrame(p.r)
+			if err != nil {
+				return
+			}
+
+			p.mu.Lock()
+			pong := p.pong
+			p.mu.Unlock()
+			if pong && f.Header.OpCode == ws.OpPing {
+				p.send(ws.NewPongFrame(f.Payload))
+				continue
+			}
+
+			p.frames <- f
+		}
+	}()
+
+	return p
+}
+
+// skip reads n bytes of the stream of the server, leaving it stuck on the
+// write in progress. They are read again by start.
+func (p *testPeer) skip(n int) {
+	p.t.Helper()
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(p.conn, b); err != nil {
+		p.t.Fatalf("skip: %v", err)
+	}
+	p.r = io.MultiReader(bytes.NewReader(b), p.conn)
+}
+
+// send writes f, masked as frames sent by clients must be. The frame is
+// written at once, net.Pipe would otherwise block on an empty payload.
+func (p *testPeer) send(f ws.Frame) error {
+	var buf bytes.Buffer
+	if err := ws.WriteFrame(&buf, ws.MaskFrameInPlace(f)); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, err := p.conn.Write(buf.Bytes())
+	return err
+}
+
+// next returns the next frame sent by the server. It reports false if the
+// connection was closed first.
+func (p *testPeer) next() (ws.Frame, bool) {
+	p.t.Helper()
+
+	select {
+	case f, ok := <-p.frames:
+		return f, ok
+	case <-time.After(testTimeout):
+		p.t.Fatal("no frame from the server")
+		return ws.Frame{}, false
+	}
+}
+
+// closed reports whether the server closed the connection without sending
+// any more frames.
+func (p *testPeer) closed() bool {
+	p.t.Helper()
+
+	for {
+		select {
+		case f, ok := <-p.frames:
+			if !ok {
+				return true
+			}
+			if f.Header.OpCode != ws.OpPing {
+				return false
+			}
+		case <-time.After(testTimeout):
+			return false
+		}
+	}
+}
+
+// nextReason returns the next disconnection of a client.
+func nextReason(t *testing.T, reasons <-chan CloseReason) CloseReason {
+	t.Helper()
+
+	select {
+	case r := <-reasons:
+		return r
+	case <-time.After(testTimeout):
+		t.Fatal("no disconnection")
+		return CloseReason{}
+	}
+}
+
+// closeCode parses the body of a close frame.
+func closeCode(f ws.Frame) (ws.StatusCode, string) {
+	if f.Header.OpCode != ws.OpClose {
+		return 0, ""
+	}
+	if len(f.Payload) == 0 {
+		return ws.StatusNoStatusRcvd, ""
+	}
+
+	return ws.ParseCloseFrameData(f.Payload)
+}
@@ -0,0 +1,219 @@
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrChecksumMismatch = errors.New("applied migration has been edited")
+	ErrUnknownVersion   = errors.New("applied migration is unknown")
+	ErrNoChange         = errors.New("no migration to apply")
+)
+
+// Migration is a pair of scripts read from files named
+// <version>_<name>.up.sql and <version>_<name>.down.sql.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Checksum identifies the content of the up script. It is recorded when
+// the migration is applied so that later edits can be detected.
+func (m *Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(m.Up))
+	return hex.EncodeToString(sum[:])
+}
+
+// Record is a row of the schema_version table.
+type Record struct {
+	Version   int64
+	Checksum  string
+	AppliedAt time.Time
+}
+
+// Driver stores migration records and runs scripts for one database.
+type Driver interface {
+	// Init creates the schema_version table if it does not exist.
+	Init(ctx context.Context) error
+	// Applied returns the applied migrations ordered by version.
+	Applied(ctx context.Context) ([]Record, error)
+	// Apply runs the up (or down) script of m and adds (or removes) its
+	// record within a single transaction. It returns ErrNoChange if m has
+	// been applied (or reverted) by another migrator meanwhile.
+	Apply(ctx context.Context, m *Migration, up bool) error
+}
+
+// Status describes a migration and whether it has been applied.
+type Status struct {
+	Migration *Migration
+	// Applied is nil if the migration is pending.
+	Applied *Record
+}
+
+type Migrator struct {
+	d  Driver
+	ms []*Migration
+}
+
+func New(d Driver, fsys fs.FS) (*Migrator, error) {
+	ms, err := Load(fsys)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Migrator{d: d, ms: ms}
+	return m, nil
+}
+
+// Load reads the migrations in the root of fsys ordered by version.
+func Load(fsys fs.FS) ([]*Migration, error) {
+	paths, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, path := range paths {
+		base, up := strings.TrimSuffix(path, ".up.sql"), true
+		if base == path {
+			base, up = strings.TrimSuffix(path, ".down.sql"), false
+		}
+
+		version, name, ok := strings.Cut(base, "_")
+		v, err := strconv.ParseInt(version, 10, 64)
+		if base == path || !ok || err != nil {
+			return nil, fmt.Errorf("invalid migration file name %q", path)
+		}
+
+		p, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[v]
+		if !ok {
+			m = &Migration{Version: v, Name: name}
+			byVersion[v] = m
+		}
+		if m.Name != name {
+			return nil, fmt.Errorf("migration %d has two names %q and %q", v, m.Name, name)
+		}
+
+		script := &m.Down
+		if up {
+			script = &m.Up
+		}
+		if *script != "" {
+			// such as 1_init.up.sql and 01_init.up.sql
+			return nil, fmt.Errorf("migration %d_%s has two scripts named %q", v, name, path)
+		}
+		*script = string(p)
+	}
+
+	ms := make([]*Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have an up and a down script", m.Version, m.Name)
+		}
+		ms = append(ms, m)
+	}
+
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Version < ms[j].Version })
+	return ms, nil
+}
+
+// Status returns every known migration, checking that the applied ones
+// have not been edited since.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	if err := m.d.Init(ctx); err != nil {
+		return nil, err
+	}
+
+	rs, err := m.d.Applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int64]*Record, len(rs))
+	for i := range rs {
+		applied[rs[i].Version] = &rs[i]
+	}
+
+	ss := make([]Status, 0, len(m.ms))
+	for _, mig := range m.ms {
+		r, ok := applied[mig.Version]
+		if ok && r.Checksum != mig.Checksum() {
+			return nil, fmt.Errorf("%w: %d_%s", ErrChecksumMismatch, mig.Version, mig.Name)
+		}
+
+		delete(applied, mig.Version)
+		ss = append(ss, Status{Migration: mig, Applied: r})
+	}
+
+	for v := range applied {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownVersion, v)
+	}
+
+	return ss, nil
+}
+
+// Up applies every pending migration in order and returns them.
+func (m *Migrator) Up(ctx context.Context) ([]*Migration, error) {
+	ss, err := m.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []*Migration
+	for _, s := range ss {
+		if s.Applied != nil {
+			continue
+		}
+
+		err := m.d.Apply(ctx, s.Migration, true)
+		if errors.Is(err, ErrNoChange) {
+			// applied by another migrator
+			continue
+		} else if err != nil {
+			return done, fmt.Errorf("migration %d_%s: %w", s.Migration.Version, s.Migration.Name, err)
+		}
+		done = append(done, s.Migration)
+	}
+
+	return done, nil
+}
+
+// Down reverts the latest applied migration and returns it. It returns
+// ErrNoChange if none has been applied.
+func (m *Migrator) Down(ctx context.Context) (*Migration, error) {
+	ss, err := m.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(ss) - 1; i >= 0; i-- {
+		if s := ss[i]; s.Applied != nil {
+			err := m.d.Apply(ctx, s.Migration, false)
+			if errors.Is(err, ErrNoChange) {
+				// reverted by another migrator
+				return nil, err
+			} else if err != nil {
+				return nil, fmt.Errorf("migration %d_%s: %w", s.Migration.Version, s.Migration.Name, err)
+			}
+			return s.Migration, nil
+		}
+	}
+
+	return nil, ErrNoChange
+}
@@ -0,0 +1,365 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"sort"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/hyphengolang/prelude/testing/is"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// memDriver keeps the records of applied migrations in memory.
+type memDriver struct {
+	rs map[int64]Record
+	// ran lists the scripts run, in order.
+	ran []string
+	// fail is returned when applying the migration with that version.
+	fail map[int64]error
+}
+
+func newMemDriver() *memDriver {
+	return &memDriver{rs: make(map[int64]Record), fail: make(map[int64]error)}
+}
+
+func (d *memDriver) Init(ctx context.Context) error { return nil }
+
+func (d *memDriver) Applied(ctx context.Context) ([]Record, error) {
+	rs := make([]Record, 0, len(d.rs))
+	for _, r := range d.rs {
+		rs = append(rs, r)
+	}
+
+	sort.Slice(rs, func(i, j int) bool { return rs[i].Version < rs[j].Version })
+	return rs, nil
+}
+
+func (d *memDriver) Apply(ctx context.Context, m *Migration, up bool) error {
+	if err := d.fail[m.Version]; err != nil {
+		return err
+	}
+
+	if up {
+		d.ran = append(d.ran, m.Up)
+		d.rs[m.Version] = Record{Version: m.Version, Checksum: m.Checksum(), AppliedAt: time.Now()}
+	} else {
+		d.ran = append(d.ran, m.Down)
+		delete(d.rs, m.Version)
+	}
+	return nil
+}
+
+func file(s string) *fstest.MapFile {
+	return &fstest.MapFile{Data: []byte(s)}
+}
+
+// migrations holds two migrations, listed out of order.
+var migrations = fstest.MapFS{
+	"2_messages.up.sql":   file("create messages"),
+	"2_messages.down.sql": file("drop messages"),
+	"1_threads.up.sql":    file("create threads"),
+	"1_threads.down.sql":  file("drop threads"),
+	// only .sql files in the root are read
+	"README.md":           file("migrations"),
+	"old/0_legacy.up.sql": file("create legacy"),
+}
+
+func TestLoad(t *testing.T) {
+	t.Run("ordered by version", func(t *testing.T) {
+		is := is.New(t)
+
+		ms, err := Load(migrations)
+		is.NoErr(err)
+		is.Equal(len(ms), 2) // other files are ignored
+
+		is.Equal(*ms[0], Migration{Version: 1, Name: "threads", Up: "create threads", Down: "drop threads"})    // first
+		is.Equal(*ms[1], Migration{Version: 2, Name: "messages", Up: "create messages", Down: "drop messages"}) // then
+	})
+
+	t.Run("name with underscores", func(t *testing.T) {
+		is := is.New(t)
+
+		ms, err := Load(fstest.MapFS{
+			"2302050000_messages_fts.up.sql":   file("up"),
+			"2302050000_messages_fts.down.sql": file("down"),
+		})
+		is.NoErr(err)
+		is.Equal(ms[0].Version, int64(2302050000)) // version before the first underscore
+		is.Equal(ms[0].Name, "messages_fts")       // name after it
+	})
+
+	tt := []struct {
+		name string
+		fsys fstest.MapFS
+	}{
+		{
+			name: "version is not a number",
+			fsys: fstest.MapFS{"v1_threads.up.sql": file("up"), "v1_threads.down.sql": file("down")},
+		},
+		{
+			name: "no name",
+			fsys: fstest.MapFS{"1.up.sql": file("up"), "1.down.sql": file("down")},
+		},
+		{
+			name: "neither up nor down",
+			fsys: fstest.MapFS{"1_threads.sql": file("up")},
+		},
+		{
+			name: "missing down",
+			fsys: fstest.MapFS{"1_threads.up.sql": file("up")},
+		},
+		{
+			name: "missing up",
+			fsys: fstest.MapFS{"1_threads.down.sql": file("down")},
+		},
+		{
+			name: "two names for a version",
+			fsys: fstest.MapFS{"1_threads.up.sql": file("up"), "1_chats.down.sql": file("down")},
+		},
+		{
+			name: "two scripts for a version",
+			fsys: fstest.MapFS{
+				"1_threads.up.sql":   file("up"),
+				"01_threads.up.sql":  file("up again"),
+				"1_threads.down.sql": file("down"),
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			is := is.New(t)
+
+			_, err := Load(tc.fsys)
+			is.True(err != nil) // rejected
+		})
+	}
+}
+
+func TestMigrator(t *testing.T) {
+	ctx := context.Background()
+
+	// versions returns the versions of ms.
+	versions := func(ms []*Migration) []int64 {
+		vs := []int64{}
+		for _, m := range ms {
+			vs = append(vs, m.Version)
+		}
+		return vs
+	}
+
+	t.Run("up applies pending migrations in order", func(t *testing.T) {
+		is := is.New(t)
+
+		d := newMemDriver()
+		m, err := New(d, migrations)
+		is.NoErr(err)
+
+		ms, err := m.Up(ctx)
+		is.NoErr(err)
+		is.Equal(versions(ms), []int64{1, 2})                          // both applied
+		is.Equal(d.ran, []string{"create threads", "create messages"}) // in order
+
+		ms, err = m.Up(ctx)
+		is.NoErr(err)
+		is.Equal(len(ms), 0) // nothing left to apply
+		is.Equal(len(d.ran), 2)
+	})
+
+	t.Run("status", func(t *testing.T) {
+		is := is.New(t)
+
+		d := newMemDriver()
+		d.rs[1] = Record{Version: 1, Checksum: (&Migration{Up: "create threads"}).Checksum()}
+
+		m, err := New(d, migrations)
+		is.NoErr(err)
+
+		ss, err := m.Status(ctx)
+		is.NoErr(err)
+		is.Equal(len(ss), 2)                        // every migration
+		is.Equal(ss[0].Migration.Version, int64(1)) // first
+		is.True(ss[0].Applied != nil)               // applied
+		is.Equal(ss[1].Migration.Version, int64(2)) // then
+		is.True(ss[1].Applied == nil)               // pending
+	})
+
+	t.Run("down reverts the latest migration", func(t *testing.T) {
+		is := is.New(t)
+
+		d := newMemDriver()
+		m, err := New(d, migrations)
+		is.NoErr(err)
+		_, err = m.Up(ctx)
+		is.NoErr(err)
+
+		mig, err := m.Down(ctx)
+		is.NoErr(err)
+		is.Equal(mig.Version, int64(2)) // latest
+		mig, err = m.Down(ctx)
+		is.NoErr(err)
+		is.Equal(mig.Version, int64(1)) // then the one before
+		is.Equal(d.ran[2:], []string{"drop messages", "drop threads"})
+
+		_, err = m.Down(ctx)
+		is.True(errors.Is(err, ErrNoChange)) // nothing left to revert
+	})
+
+	t.Run("edited migration", func(t *testing.T) {
+		is := is.New(t)
+
+		d := newMemDriver()
+		d.rs[1] = Record{Version: 1, Checksum: (&Migration{Up: "create threads (v0)"}).Checksum()}
+
+		m, err := New(d, migrations)
+		is.NoErr(err)
+
+		_, err = m.Up(ctx)
+		is.True(errors.Is(err, ErrChecksumMismatch)) // applied script has changed
+		is.Equal(len(d.ran), 0)                      // nothing applied
+	})
+
+	t.Run("unknown version", func(t *testing.T) {
+		is := is.New(t)
+
+		d := newMemDriver()
+		d.rs[3] = Record{Version: 3, Checksum: "newer"}
+
+		m, err := New(d, migrations)
+		is.NoErr(err)
+
+		_, err = m.Status(ctx)
+		is.True(errors.Is(err, ErrUnknownVersion)) // applied by a newer release
+		_, err = m.Up(ctx)
+		is.True(errors.Is(err, ErrUnknownVersion)) // not migrated
+		is.Equal(len(d.ran), 0)                    // nothing applied
+	})
+
+	t.Run("failed migration stops up", func(t *testing.T) {
+		is := is.New(t)
+
+		d := newMemDriver()
+		d.fail[2] = errors.New("syntax error")
+
+		m, err := New(d, migrations)
+		is.NoErr(err)
+
+		ms, err := m.Up(ctx)
+		is.True(err != nil)                // failed
+		is.Equal(versions(ms), []int64{1}) // after applying the first
+	})
+
+	t.Run("migration applied by another migrator", func(t *testing.T) {
+		is := is.New(t)
+
+		d := newMemDriver()
+		d.fail[1] = ErrNoChange
+
+		m, err := New(d, migrations)
+		is.NoErr(err)
+
+		ms, err := m.Up(ctx)
+		is.NoErr(err)                      // not an error
+		is.Equal(versions(ms), []int64{2}) // only the others are applied
+	})
+}
+
+func TestSqliteDriver(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	is.NoErr(err)
+	t.Cleanup(func() { db.Close() })
+	// every connection would have its own database
+	db.SetMaxOpenConns(1)
+
+	m, err := New(NewSqliteDriver(db), fstest.MapFS{
+		"1_threads.up.sql":   file("CREATE TABLE threads (id TEXT PRIMARY KEY)"),
+		"1_threads.down.sql": file("DROP TABLE threads"),
+		"2_broken.up.sql":    file("CREATE TABLE"),
+		"2_broken.down.sql":  file("SELECT 1"),
+	})
+	is.NoErr(err)
+
+	ms, err := m.Up(ctx)
+	is.True(err != nil) // second migration is broken
+	is.Equal(len(ms), 1)
+
+	ss, err := m.Status(ctx)
+	is.NoErr(err)
+	is.True(ss[0].Applied != nil) // first applied
+	is.True(ss[1].Applied == nil) // second rolled back
+
+	_, err = db.ExecContext(ctx, `INSERT INTO threads (id) VALUES ('a')`)
+	is.NoErr(err) // table created
+
+	mig, err := m.Down(ctx)
+	is.NoErr(err)
+	is.Equal(mig.Version, int64(1)) // reverted
+
+	_, err = db.ExecContext(ctx, `INSERT INTO threads (id) VALUES ('a')`)
+	is.True(err != nil) // table dropped
+}
+
+func TestSqliteDriverApplied(t *testing.T) {
+	ctx := context.Background()
+	dsn := "file:" + filepath.Join(t.TempDir(), "wss.db") + "?_busy_timeout=5000"
+	mig := &Migration{Version: 1, Up: "CREATE TABLE threads (id TEXT PRIMARY KEY)", Down: "DROP TABLE threads"}
+
+	// driver returns a driver with a pool of its own, as another instance
+	// sharing the database would have.
+	driver := func(t *testing.T) Driver {
+		db, err := sql.Open("sqlite3", dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+
+		d := NewSqliteDriver(db)
+		if err := d.Init(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	t.Run("applied by another driver", func(t *testing.T) {
+		is := is.New(t)
+
+		a, b := driver(t), driver(t)
+		is.NoErr(a.Apply(ctx, mig, true))
+		is.True(errors.Is(b.Apply(ctx, mig, true), ErrNoChange)) // already applied
+
+		is.NoErr(b.Apply(ctx, mig, false))
+		is.True(errors.Is(a.Apply(ctx, mig, false), ErrNoChange)) // already reverted
+	})
+
+	t.Run("applied together", func(t *testing.T) {
+		is := is.New(t)
+
+		errs := make(chan error, 4)
+		for i := 0; i < cap(errs); i++ {
+			d := driver(t)
+			go func() { errs <- d.Apply(ctx, mig, true) }()
+		}
+
+		var applied, unchanged int
+		for i := 0; i < cap(errs); i++ {
+			switch err := <-errs; {
+			case err == nil:
+				applied++
+			case errors.Is(err, ErrNoChange):
+				unchanged++
+			default:
+				t.Fatal(err)
+			}
+		}
+		is.Equal(applied, 1)   // by a single driver
+		is.Equal(unchanged, 3) // the others waited for it
+	})
+}
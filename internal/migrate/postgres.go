@@ -0,0 +1,87 @@
+package migrate
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+type postgresDriver struct {
+	conn *pgxpool.Pool
+}
+
+func NewPostgresDriver(conn *pgxpool.Pool) Driver {
+	d := &postgresDriver{conn: conn}
+	return d
+}
+
+func (d *postgresDriver) Init(ctx context.Context) error {
+	const q = `CREATE TABLE IF NOT EXISTS public.schema_version (
+		version BIGINT PRIMARY KEY,
+		checksum TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`
+
+	_, err := d.conn.Exec(ctx, q)
+	return err
+}
+
+func (d *postgresDriver) Applied(ctx context.Context) ([]Record, error) {
+	const q = `SELECT version, checksum, applied_at FROM public.schema_version ORDER BY version`
+
+	rows, err := d.conn.Query(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rs []Record
+	for rows.Next() {
+		var r Record
+		if err := rows.Scan(&r.Version, &r.Checksum, &r.AppliedAt); err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+
+	return rs, rows.Err()
+}
+
+// migrationLock is the key of the advisory lock taken by migrations, so
+// that instances starting together don't apply them twice.
+const migrationLock = 0x77737300
+
+func (d *postgresDriver) Apply(ctx context.Context, m *Migration, up bool) error {
+	return pgx.BeginFunc(ctx, d.conn, func(tx pgx.Tx) error {
+		// held until the transaction ends
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationLock); err != nil {
+			return err
+		}
+
+		var applied bool
+		q := `SELECT EXISTS (SELECT 1 FROM public.schema_version WHERE version = $1)`
+		if err := tx.QueryRow(ctx, q, m.Version).Scan(&applied); err != nil {
+			return err
+		}
+		if applied == up {
+			return ErrNoChange
+		}
+
+		if !up {
+			if _, err := tx.Exec(ctx, m.Down); err != nil {
+				return err
+			}
+
+			_, err := tx.Exec(ctx, `DELETE FROM public.schema_version WHERE version = $1`, m.Version)
+			return err
+		}
+
+		if _, err := tx.Exec(ctx, m.Up); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec(ctx, `INSERT INTO public.schema_version (version, checksum) VALUES ($1, $2)`, m.Version, m.Checksum())
+		return err
+	})
+}
@@ -0,0 +1,99 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type sqliteDriver struct {
+	db *sql.DB
+}
+
+func NewSqliteDriver(db *sql.DB) Driver {
+	d := &sqliteDriver{db: db}
+	return d
+}
+
+func (d *sqliteDriver) Init(ctx context.Context) error {
+	q := `CREATE TABLE IF NOT EXISTS "schema_version" (
+		version INTEGER PRIMARY KEY,
+		checksum TEXT NOT NULL,
+		applied_at DATETIME NOT NULL
+	)`
+
+	_, err := d.db.ExecContext(ctx, q)
+	return err
+}
+
+func (d *sqliteDriver) Applied(ctx context.Context) ([]Record, error) {
+	q := `SELECT version, checksum, applied_at FROM "schema_version" ORDER BY version`
+
+	rows, err := d.db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rs []Record
+	for rows.Next() {
+		var r Record
+		if err := rows.Scan(&r.Version, &r.Checksum, &r.AppliedAt); err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+
+	return rs, rows.Err()
+}
+
+func (d *sqliteDriver) Apply(ctx context.Context, m *Migration, up bool) (err error) {
+	conn, err := d.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// takes the write lock up front, so that a migrator starting alongside
+	// waits for this one rather than applying m again
+	if _, err := conn.ExecContext(ctx, `BEGIN IMMEDIATE`); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			conn.ExecContext(context.Background(), `ROLLBACK`)
+		}
+	}()
+
+	var applied bool
+	q := `SELECT EXISTS (SELECT 1 FROM "schema_version" WHERE version = ?)`
+	if err := conn.QueryRowContext(ctx, q, m.Version).Scan(&applied); err != nil {
+		return err
+	}
+	if applied == up {
+		return ErrNoChange
+	}
+
+	if up {
+		if _, err := conn.ExecContext(ctx, m.Up); err != nil {
+			return err
+		}
+
+		q := `INSERT INTO "schema_version" (version, checksum, applied_at) VALUES (?, ?, ?)`
+		if _, err := conn.ExecContext(ctx, q, m.Version, m.Checksum(), time.Now().UTC()); err != nil {
+			return err
+		}
+	} else {
+		if _, err := conn.ExecContext(ctx, m.Down); err != nil {
+			return err
+		}
+
+		q := `DELETE FROM "schema_version" WHERE version = ?`
+		if _, err := conn.ExecContext(ctx, q, m.Version); err != nil {
+			return err
+		}
+	}
+
+	_, err = conn.ExecContext(ctx, `COMMIT`)
+	return err
+}
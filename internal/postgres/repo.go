@@ -4,12 +4,18 @@ import (
 	"context"
 
 	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 type Conn[T any] interface {
-	Conn() *pgxpool.Pool
+	// Conn returns what queries are run against, the pool or a
+	// transaction.
+	Conn() Querier
+	// WithTx runs fn in a transaction, see WithTx.
+	WithTx(ctx context.Context, fn func(tx pgx.Tx) error, opts ...TxOption) error
 	ExecContext(ctx context.Context, query string, args pgx.NamedArgs) error
+	// ExecRowsContext is like ExecContext but also returns the number of
+	// rows affected.
+	ExecRowsContext(ctx context.Context, query string, args pgx.NamedArgs) (int64, error)
 	QueryRowContext(ctx context.Context, scanner func(row pgx.Row, t *T) error, query string, args pgx.NamedArgs) (*T, error)
 	QueryContext(ctx context.Context, scanner func(row pgx.Rows, t *T) error, query string, args pgx.NamedArgs) ([]*T, error)
 }
@@ -19,21 +25,31 @@ type C interface {
 }
 
 type connHandler[T any] struct {
-	conn *pgxpool.Pool
+	conn Querier
 }
 
-func NewHandler[T any](conn *pgxpool.Pool) Conn[T] {
+// NewHandler returns a Conn running queries against conn, which is either
+// the pool or a transaction.
+func NewHandler[T any](conn Querier) Conn[T] {
 	return &connHandler[T]{conn: conn}
 }
 
-func (h *connHandler[T]) Conn() *pgxpool.Pool {
+func (h *connHandler[T]) Conn() Querier {
 	return h.conn
 }
 
+func (h *connHandler[T]) WithTx(ctx context.Context, fn func(tx pgx.Tx) error, opts ...TxOption) error {
+	return WithTx(ctx, h.conn, fn, opts...)
+}
+
 func (h *connHandler[T]) ExecContext(ctx context.Context, query string, args pgx.NamedArgs) error {
 	return ExecContext(ctx, h.conn, query, args)
 }
 
+func (h *connHandler[T]) ExecRowsContext(ctx context.Context, query string, args pgx.NamedArgs) (int64, error) {
+	return ExecRowsContext(ctx, h.conn, query, args)
+}
+
 func (h *connHandler[T]) QueryRowContext(ctx context.Context, scanner func(row pgx.Row, t *T) error, query string, args pgx.NamedArgs) (*T, error) {
 	return QueryRowContext(ctx, h.conn, scanner, query, args)
 }
@@ -42,18 +58,23 @@ func (h *connHandler[T]) QueryContext(ctx context.Context, scanner func(row pgx.
 	return QueryContext(ctx, h.conn, scanner, query, args)
 }
 
-func ExecContext(ctx context.Context, q *pgxpool.Pool, query string, args ...any) error {
+func ExecContext(ctx context.Context, q Querier, query string, args ...any) error {
 	_, err := q.Exec(ctx, query, args...)
 	return err
 }
 
-func QueryRowContext[T any](ctx context.Context, q *pgxpool.Pool, scanner func(r pgx.Row, t *T) error, query string, args ...any) (*T, error) {
+func ExecRowsContext(ctx context.Context, q Querier, query string, args ...any) (int64, error) {
+	tag, err := q.Exec(ctx, query, args...)
+	return tag.RowsAffected(), err
+}
+
+func QueryRowContext[T any](ctx context.Context, q Querier, scanner func(r pgx.Row, t *T) error, query string, args ...any) (*T, error) {
 	var t T
 	err := scanner(q.QueryRow(ctx, query, args...), &t)
 	return &t, err
 }
 
-func QueryContext[T any](ctx context.Context, q *pgxpool.Pool, scanner func(r pgx.Rows, v *T) error, query string, args ...any) ([]*T, error) {
+func QueryContext[T any](ctx context.Context, q Querier, scanner func(r pgx.Rows, v *T) error, query string, args ...any) ([]*T, error) {
 	rows, err := q.Query(ctx, query, args...)
 	if err != nil {
 		return nil, err
@@ -71,13 +92,35 @@ func QueryContext[T any](ctx context.Context, q *pgxpool.Pool, scanner func(r pg
 	return vs, rows.Err()
 }
 
-type ReadWriter[T any] interface {
-	Reader[T]
+// ForEachContext is like QueryContext but hands every row to fn instead
+// of keeping them all, it stops at the first error of fn.
+func ForEachContext[T any](ctx context.Context, q Querier, scanner func(r pgx.Rows, v *T) error, fn func(v *T) error, query string, args ...any) error {
+	rows, err := q.Query(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v T
+		if err := scanner(rows, &v); err != nil {
+			return err
+		}
+		if err := fn(&v); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ReadWriter stores values of type T identified by keys of type K.
+type ReadWriter[K comparable, T any] interface {
+	Reader[K, T]
 	Writer[T]
 }
 
-type Reader[T any] interface {
-	Find(ctx context.Context, key any) (T, error)
+// Reader finds values of type T identified by keys of type K.
+type Reader[K comparable, T any] interface {
+	Find(ctx context.Context, key K) (T, error)
 	FindMany(ctx context.Context) ([]T, error)
 }
 
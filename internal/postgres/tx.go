@@ -0,0 +1,135 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Querier runs queries against the pool or inside a transaction, it is
+// implemented by *pgxpool.Pool and pgx.Tx.
+type Querier interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+var (
+	_ Querier = (*pgxpool.Pool)(nil)
+	_ Querier = (pgx.Tx)(nil)
+)
+
+const defaultTxRetries = 3
+
+// Postgres error codes of transactions that may succeed when retried.
+const (
+	codeSerializationFailure = "40001"
+	codeDeadlockDetected     = "40P01"
+)
+
+type txConfig struct {
+	opts    pgx.TxOptions
+	retries int
+}
+
+type TxOption func(c *txConfig)
+
+// WithIsolation sets the isolation level of the transaction, the default
+// is the one of the server, usually read committed.
+func WithIsolation(level pgx.TxIsoLevel) TxOption {
+	return func(c *txConfig) {
+		c.opts.IsoLevel = level
+	}
+}
+
+// WithReadOnly makes the transaction read only.
+func WithReadOnly() TxOption {
+	return func(c *txConfig) {
+		c.opts.AccessMode = pgx.ReadOnly
+	}
+}
+
+// WithRetries sets how many times a transaction is retried after a
+// serialization failure or a deadlock.
+func WithRetries(n int) TxOption {
+	return func(c *txConfig) {
+		c.retries = n
+	}
+}
+
+// WithTx runs fn inside a transaction which is committed if fn returns nil
+// and rolled back otherwise, or if fn panics. fn may be called again when
+// the transaction fails to serialize, so it must not have side effects
+// outside of tx.
+//
+// When q is itself a transaction fn runs in a savepoint of it instead. The
+// options are ignored as it is up to the outer transaction to retry.
+func WithTx(ctx context.Context, q Querier, fn func(tx pgx.Tx) error, opts ...TxOption) error {
+	c := txConfig{retries: defaultTxRetries}
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	pool, ok := q.(*pgxpool.Pool)
+	if !ok {
+		tx, err := q.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		return runTx(ctx, tx, fn)
+	}
+
+	for attempt := 0; ; attempt++ {
+		tx, err := pool.BeginTx(ctx, c.opts)
+		if err != nil {
+			return err
+		}
+
+		err = runTx(ctx, tx, fn)
+		if !retryable(err) || attempt >= c.retries {
+			return err
+		}
+
+		// back off a little so that the conflicting transaction can finish
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(attempt+1) * 10 * time.Millisecond):
+		}
+	}
+}
+
+func runTx(ctx context.Context, tx pgx.Tx, fn func(tx pgx.Tx) error) error {
+	defer func() {
+		if p := recover(); p != nil {
+			_ = tx.Rollback(ctx)
+			panic(p)
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		if rerr := tx.Rollback(ctx); rerr != nil && !errors.Is(rerr, pgx.ErrTxClosed) {
+			return fmt.Errorf("%w (rollback failed: %v)", err, rerr)
+		}
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// retryable reports whether err aborted a transaction that may succeed
+// if run again.
+func retryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+
+	return pgErr.Code == codeSerializationFailure || pgErr.Code == codeDeadlockDetected
+}
@@ -0,0 +1,138 @@
+package postgres_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hyphengolang/prelude/testing/is"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"com.adoublef.wss/internal/postgres"
+	"com.adoublef.wss/pkg/docker"
+)
+
+// newPool starts a database with a table of two doctors on call.
+func newPool(t *testing.T) *pgxpool.Pool {
+	ctx := context.Background()
+
+	const schema = `CREATE TABLE doctors (id INT PRIMARY KEY, on_call BOOLEAN NOT NULL);
+	INSERT INTO doctors VALUES (1, TRUE), (2, TRUE);`
+
+	container, pool, err := docker.NewPostgresConnection(ctx, "5432/tcp", 15*time.Second, schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		pool.Close()
+		container.Terminate(ctx)
+	})
+
+	return pool
+}
+
+func TestWithTx(t *testing.T) {
+	ctx := context.Background()
+	pool := newPool(t)
+
+	errSerialization := &pgconn.PgError{Code: "40001"}
+
+	t.Run("serialization failure is retried", func(t *testing.T) {
+		is := is.New(t)
+
+		var (
+			calls atomic.Int32
+			// both transactions read before either writes, on their first
+			// attempt only
+			read sync.WaitGroup
+		)
+		read.Add(2)
+
+		// goOffCall takes doctor id off call if another one is on call, the
+		// two transactions can't both see the other doctor on call.
+		goOffCall := func(id int) error {
+			first := true
+			return postgres.WithTx(ctx, pool, func(tx pgx.Tx) error {
+				calls.Add(1)
+
+				var onCall int
+				if err := tx.QueryRow(ctx, `SELECT count(*) FROM doctors WHERE on_call`).Scan(&onCall); err != nil {
+					return err
+				}
+				if first {
+					first = false
+					read.Done()
+					read.Wait()
+				}
+				if onCall < 2 {
+					return nil
+				}
+
+				_, err := tx.Exec(ctx, `UPDATE doctors SET on_call = FALSE WHERE id = $1`, id)
+				return err
+			}, postgres.WithIsolation(pgx.Serializable))
+		}
+
+		errs := make(chan error, 2)
+		for _, id := range []int{1, 2} {
+			go func(id int) { errs <- goOffCall(id) }(id)
+		}
+		is.NoErr(<-errs) // committed, if only after a retry
+		is.NoErr(<-errs)
+
+		// the loser may fail again if it retries before the winner commits
+		is.True(calls.Load() >= 3) // one of them ran again
+
+		var onCall int
+		is.NoErr(pool.QueryRow(ctx, `SELECT count(*) FROM doctors WHERE on_call`).Scan(&onCall))
+		is.Equal(onCall, 1) // the retry saw the other doctor off call
+	})
+
+	t.Run("gives up after the retries", func(t *testing.T) {
+		is := is.New(t)
+
+		var calls int
+		err := postgres.WithTx(ctx, pool, func(tx pgx.Tx) error {
+			calls++
+			return errSerialization
+		}, postgres.WithRetries(2))
+
+		is.True(errors.Is(err, errSerialization)) // last error returned
+		is.Equal(calls, 3)                        // first attempt and two retries
+	})
+
+	t.Run("other errors are not retried", func(t *testing.T) {
+		is := is.New(t)
+
+		errOther := errors.New("other")
+
+		var calls int
+		err := postgres.WithTx(ctx, pool, func(tx pgx.Tx) error {
+			calls++
+			return errOther
+		})
+
+		is.True(errors.Is(err, errOther)) // error of fn
+		is.Equal(calls, 1)                // not retried
+	})
+
+	t.Run("savepoints are not retried", func(t *testing.T) {
+		is := is.New(t)
+
+		var calls int
+		err := postgres.WithTx(ctx, pool, func(tx pgx.Tx) error {
+			return postgres.WithTx(ctx, tx, func(tx pgx.Tx) error {
+				calls++
+				return errSerialization
+			})
+		}, postgres.WithRetries(0))
+
+		is.True(errors.Is(err, errSerialization)) // error of the savepoint
+		is.Equal(calls, 1)                        // left to the outer transaction
+	})
+}
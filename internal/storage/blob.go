@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+var (
+	ErrNotFound      = errors.New("blob not found")
+	ErrQuotaExceeded = errors.New("blob quota exceeded")
+)
+
+// Blob describes content held by a BlobStore.
+type Blob struct {
+	// Hash is the hex encoded SHA-256 of the content, which is also its key.
+	Hash string
+	Size int64
+	// MimeType is sniffed from the first bytes of the content.
+	MimeType string
+}
+
+// BlobStore holds content addressed by its SHA-256. Blobs are referenced
+// from namespaces, such as a thread, that are subject to a size quota.
+// Identical content put twice is only stored once.
+type BlobStore interface {
+	// Put streams r into the store and references it from ns. It returns
+	// ErrQuotaExceeded if ns can't fit the content.
+	Put(ctx context.Context, ns string, r io.Reader) (*Blob, error)
+	// Open returns the content of a blob, it returns ErrNotFound if there
+	// is no such blob.
+	Open(ctx context.Context, hash string) (io.ReadSeekCloser, error)
+	// Delete removes the reference from ns to a blob. The content is
+	// removed once no namespace references it.
+	Delete(ctx context.Context, ns, hash string) error
+	// Usage returns the number of bytes referenced from ns.
+	Usage(ctx context.Context, ns string) (int64, error)
+}
@@ -0,0 +1,262 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var errInvalidKey = errors.New("invalid blob key")
+
+// localBlobStore keeps blobs on the local filesystem:
+//
+//	root/blobs/<hash[:2]>/<hash>	content
+//	root/refs/<ns>/<hash>		empty file referencing a blob from ns
+//	root/tmp/			uploads in progress
+type localBlobStore struct {
+	root  string
+	quota int64
+
+	mu sync.Mutex
+	// usage caches the bytes referenced per namespace, it is loaded from
+	// disk the first time a namespace is used.
+	usage map[string]int64
+}
+
+var _ BlobStore = (*localBlobStore)(nil)
+
+// NewLocalBlobStore returns a BlobStore that keeps blobs under root. Each
+// namespace may reference at most quota bytes, zero means no limit.
+func NewLocalBlobStore(root string, quota int64) (BlobStore, error) {
+	for _, dir := range []string{"blobs", "refs", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &localBlobStore{
+		root:  root,
+		quota: quota,
+		usage: make(map[string]int64),
+	}
+
+	return s, nil
+}
+
+func (s *localBlobStore) Put(ctx context.Context, ns string, r io.Reader) (*Blob, error) {
+	if !validNamespace(ns) {
+		return nil, errInvalidKey
+	}
+
+	if s.quota > 0 {
+		// read one byte past the quota to know it was exceeded, content
+		// already referenced from ns still fits however full it is
+		r = io.LimitReader(r, s.quota+1)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Join(s.root, "tmp"), "blob-*")
+	if err != nil {
+		return nil, err
+	}
+	// once renamed into place this is a no-op
+	defer os.Remove(tmp.Name())
+
+	var (
+		h     = sha256.New()
+		sniff sniffer
+	)
+
+	n, err := io.Copy(io.MultiWriter(tmp, h, &sniff), &contextReader{ctx: ctx, r: r})
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.quota > 0 && n > s.quota {
+		return nil, ErrQuotaExceeded
+	}
+
+	blob := &Blob{
+		Hash:     hex.EncodeToString(h.Sum(nil)),
+		Size:     n,
+		MimeType: http.DetectContentType(sniff.p),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ref := s.refPath(ns, blob.Hash)
+	if _, err := os.Stat(ref); err == nil {
+		// already referenced from ns, nothing to account for
+		return blob, nil
+	}
+
+	used, err := s.usageLocked(ns)
+	if err != nil {
+		return nil, err
+	}
+	if s.quota > 0 && used+n > s.quota {
+		return nil, ErrQuotaExceeded
+	}
+
+	path := s.blobPath(blob.Hash)
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(tmp.Name(), path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(ref), 0o755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(ref, nil, 0o644); err != nil {
+		return nil, err
+	}
+
+	s.usage[ns] = used + n
+	return blob, nil
+}
+
+func (s *localBlobStore) Open(ctx context.Context, hash string) (io.ReadSeekCloser, error) {
+	if !validHash(hash) {
+		return nil, errInvalidKey
+	}
+
+	f, err := os.Open(s.blobPath(hash))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+
+	return f, err
+}
+
+func (s *localBlobStore) Delete(ctx context.Context, ns, hash string) error {
+	if !validNamespace(ns) || !validHash(hash) {
+		return errInvalidKey
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	used, err := s.usageLocked(ns)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(s.refPath(ns, hash)); errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	path := s.blobPath(hash)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	s.usage[ns] = used - fi.Size()
+
+	refs, err := filepath.Glob(filepath.Join(s.root, "refs", "*", hash))
+	if err != nil || len(refs) > 0 {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+func (s *localBlobStore) Usage(ctx context.Context, ns string) (int64, error) {
+	if !validNamespace(ns) {
+		return 0, errInvalidKey
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.usageLocked(ns)
+}
+
+func (s *localBlobStore) usageLocked(ns string) (int64, error) {
+	if n, ok := s.usage[ns]; ok {
+		return n, nil
+	}
+
+	refs, err := os.ReadDir(filepath.Join(s.root, "refs", ns))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+
+	var n int64
+	for _, ref := range refs {
+		fi, err := os.Stat(s.blobPath(ref.Name()))
+		if err != nil {
+			return 0, err
+		}
+		n += fi.Size()
+	}
+
+	s.usage[ns] = n
+	return n, nil
+}
+
+func (s *localBlobStore) blobPath(hash string) string {
+	return filepath.Join(s.root, "blobs", hash[:2], hash)
+}
+
+func (s *localBlobStore) refPath(ns, hash string) string {
+	return filepath.Join(s.root, "refs", ns, hash)
+}
+
+// validNamespace reports whether ns can safely be used as a directory name.
+func validNamespace(ns string) bool {
+	return ns != "" && ns != "." && ns != ".." && filepath.Base(ns) == ns
+}
+
+func validHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// sniffer keeps the first bytes written to it, enough to detect the
+// content type.
+type sniffer struct {
+	p []byte
+}
+
+func (s *sniffer) Write(p []byte) (int, error) {
+	if n := 512 - len(s.p); n > 0 {
+		if len(p) < n {
+			n = len(p)
+		}
+		s.p = append(s.p, p[:n]...)
+	}
+
+	return len(p), nil
+}
+
+// contextReader stops reading once ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return r.r.Read(p)
+}
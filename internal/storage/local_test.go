@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hyphengolang/prelude/testing/is"
+)
+
+func hashOf(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+// files returns the number of files under dir.
+func files(t *testing.T, dir string) int {
+	t.Helper()
+
+	var n int
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			n++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestLocalBlobStore(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("put and open", func(t *testing.T) {
+		is := is.New(t)
+
+		bs, err := NewLocalBlobStore(t.TempDir(), 0)
+		is.NoErr(err)
+
+		b, err := bs.Put(ctx, "ns", strings.NewReader("hello"))
+		is.NoErr(err)
+		is.Equal(b.Hash, hashOf("hello"))                 // content hash
+		is.Equal(b.Size, int64(5))                        // size
+		is.Equal(b.MimeType, "text/plain; charset=utf-8") // sniffed
+
+		f, err := bs.Open(ctx, b.Hash)
+		is.NoErr(err)
+		defer f.Close()
+
+		p, err := io.ReadAll(f)
+		is.NoErr(err)
+		is.Equal(string(p), "hello") // same content
+
+		_, err = bs.Open(ctx, hashOf("missing"))
+		is.True(errors.Is(err, ErrNotFound)) // unknown blob
+	})
+
+	t.Run("quota", func(t *testing.T) {
+		is := is.New(t)
+
+		bs, err := NewLocalBlobStore(t.TempDir(), 10)
+		is.NoErr(err)
+
+		_, err = bs.Put(ctx, "ns", strings.NewReader("hello"))
+		is.NoErr(err) // within the quota
+		b, err := bs.Put(ctx, "ns", strings.NewReader("world"))
+		is.NoErr(err) // up to the quota
+
+		_, err = bs.Put(ctx, "ns", strings.NewReader("!"))
+		is.True(errors.Is(err, ErrQuotaExceeded)) // over the quota
+
+		used, err := bs.Usage(ctx, "ns")
+		is.NoErr(err)
+		is.Equal(used, int64(10)) // rejected put not counted
+
+		_, err = bs.Put(ctx, "ns", strings.NewReader("hello"))
+		is.NoErr(err) // already referenced, nothing more used
+
+		_, err = bs.Put(ctx, "other", strings.NewReader("0123456789+"))
+		is.True(errors.Is(err, ErrQuotaExceeded)) // larger than the quota
+
+		is.NoErr(bs.Delete(ctx, "ns", b.Hash))
+		used, err = bs.Usage(ctx, "ns")
+		is.NoErr(err)
+		is.Equal(used, int64(5)) // freed by delete
+
+		_, err = bs.Put(ctx, "ns", strings.NewReader("!"))
+		is.NoErr(err) // room again
+	})
+
+	t.Run("content is shared across namespaces", func(t *testing.T) {
+		is := is.New(t)
+
+		root := t.TempDir()
+		bs, err := NewLocalBlobStore(root, 0)
+		is.NoErr(err)
+
+		a, err := bs.Put(ctx, "a", strings.NewReader("hello"))
+		is.NoErr(err)
+		b, err := bs.Put(ctx, "b", strings.NewReader("hello"))
+		is.NoErr(err)
+
+		is.Equal(a.Hash, b.Hash)                            // same blob
+		is.Equal(files(t, filepath.Join(root, "blobs")), 1) // stored once
+		is.Equal(files(t, filepath.Join(root, "refs")), 2)  // referenced twice
+		is.Equal(files(t, filepath.Join(root, "tmp")), 0)   // nothing left behind
+
+		for _, ns := range []string{"a", "b"} {
+			used, err := bs.Usage(ctx, ns)
+			is.NoErr(err)
+			is.Equal(used, int64(5)) // counted in every namespace
+		}
+	})
+
+	t.Run("blob removed with its last reference", func(t *testing.T) {
+		is := is.New(t)
+
+		bs, err := NewLocalBlobStore(t.TempDir(), 0)
+		is.NoErr(err)
+
+		b, err := bs.Put(ctx, "a", strings.NewReader("hello"))
+		is.NoErr(err)
+		_, err = bs.Put(ctx, "b", strings.NewReader("hello"))
+		is.NoErr(err)
+
+		is.NoErr(bs.Delete(ctx, "a", b.Hash))
+		f, err := bs.Open(ctx, b.Hash)
+		is.NoErr(err) // still referenced from b
+		f.Close()
+
+		err = bs.Delete(ctx, "a", b.Hash)
+		is.True(errors.Is(err, ErrNotFound)) // no longer referenced from a
+
+		is.NoErr(bs.Delete(ctx, "b", b.Hash))
+		_, err = bs.Open(ctx, b.Hash)
+		is.True(errors.Is(err, ErrNotFound)) // gone with the last reference
+
+		for _, ns := range []string{"a", "b"} {
+			used, err := bs.Usage(ctx, ns)
+			is.NoErr(err)
+			is.Equal(used, int64(0)) // nothing used
+		}
+	})
+
+	t.Run("usage is reloaded on restart", func(t *testing.T) {
+		is := is.New(t)
+
+		root := t.TempDir()
+		bs, err := NewLocalBlobStore(root, 0)
+		is.NoErr(err)
+
+		_, err = bs.Put(ctx, "ns", strings.NewReader("hello"))
+		is.NoErr(err)
+		_, err = bs.Put(ctx, "ns", strings.NewReader("hi"))
+		is.NoErr(err)
+
+		bs, err = NewLocalBlobStore(root, 0)
+		is.NoErr(err)
+
+		used, err := bs.Usage(ctx, "ns")
+		is.NoErr(err)
+		is.Equal(used, int64(7)) // counted from the references on disk
+	})
+
+	t.Run("cancelled put", func(t *testing.T) {
+		is := is.New(t)
+
+		root := t.TempDir()
+		bs, err := NewLocalBlobStore(root, 0)
+		is.NoErr(err)
+
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, err = bs.Put(ctx, "ns", strings.NewReader("hello"))
+		is.True(errors.Is(err, context.Canceled))         // stopped
+		is.Equal(files(t, filepath.Join(root, "tmp")), 0) // nothing left behind
+	})
+}
+
+func TestInvalidKeys(t *testing.T) {
+	ctx := context.Background()
+
+	bs, err := NewLocalBlobStore(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, ns := range []string{"", ".", "..", "../ns", "ns/..", "a/b", "/ns"} {
+		t.Run("namespace "+ns, func(t *testing.T) {
+			is := is.New(t)
+
+			is.True(!validNamespace(ns)) // rejected
+
+			_, err := bs.Put(ctx, ns, strings.NewReader("hello"))
+			is.Equal(err, errInvalidKey) // put
+			_, err = bs.Usage(ctx, ns)
+			is.Equal(err, errInvalidKey)                                 // usage
+			is.Equal(bs.Delete(ctx, ns, hashOf("hello")), errInvalidKey) // delete
+		})
+	}
+
+	for _, hash := range []string{"", "../" + hashOf("hello")[3:], strings.Repeat("z", 64), hashOf("hello")[:63]} {
+		t.Run("hash "+hash, func(t *testing.T) {
+			is := is.New(t)
+
+			_, err := bs.Open(ctx, hash)
+			is.Equal(err, errInvalidKey)                        // open
+			is.Equal(bs.Delete(ctx, "ns", hash), errInvalidKey) // delete
+		})
+	}
+}
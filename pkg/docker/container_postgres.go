@@ -77,6 +77,8 @@ func NewPostgresConnection(ctx context.Context, natPort string, timeout time.Dur
 	}
 
 	// make migration here
-	_, err = pool.Exec(ctx, migrationSource)
+	if migrationSource != "" {
+		_, err = pool.Exec(ctx, migrationSource)
+	}
 	return container, pool, err
 }
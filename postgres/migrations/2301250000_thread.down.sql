@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS communications.thread;
+
+DROP SCHEMA IF EXISTS communications;
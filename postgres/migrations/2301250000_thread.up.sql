@@ -0,0 +1,7 @@
+CREATE SCHEMA IF NOT EXISTS communications;
+
+CREATE EXTENSION IF NOT EXISTS pgcrypto;
+
+CREATE TABLE IF NOT EXISTS communications.thread (
+	id UUID PRIMARY KEY DEFAULT gen_random_uuid()
+);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS communications.attachment (
+	id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+	thread_id UUID NOT NULL REFERENCES communications.thread (id) ON DELETE CASCADE,
+	name TEXT NOT NULL,
+	mime_type TEXT NOT NULL,
+	size BIGINT NOT NULL,
+	hash TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS communications.message;
+
+ALTER TABLE communications.thread DROP COLUMN IF EXISTS created_at;
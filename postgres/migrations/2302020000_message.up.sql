@@ -0,0 +1,9 @@
+ALTER TABLE communications.thread ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+
+CREATE TABLE IF NOT EXISTS communications.message (
+	id BIGSERIAL PRIMARY KEY,
+	thread_id UUID NOT NULL REFERENCES communications.thread (id) ON DELETE CASCADE,
+	content TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS message_thread_id_idx ON communications.message (thread_id, id);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS communications.thread_deleted_at_idx;
+
+ALTER TABLE communications.thread DROP COLUMN IF EXISTS deleted_at;
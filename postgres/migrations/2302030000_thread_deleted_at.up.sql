@@ -0,0 +1,3 @@
+ALTER TABLE communications.thread ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+
+CREATE INDEX IF NOT EXISTS thread_deleted_at_idx ON communications.thread (deleted_at) WHERE deleted_at IS NOT NULL;
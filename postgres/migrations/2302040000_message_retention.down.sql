@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS communications.message_created_at_idx;
+
+ALTER TABLE communications.message DROP COLUMN IF EXISTS created_at;
+
+ALTER TABLE communications.thread DROP COLUMN IF EXISTS message_retention;
@@ -0,0 +1,5 @@
+ALTER TABLE communications.thread ADD COLUMN IF NOT EXISTS message_retention BIGINT NOT NULL DEFAULT 0;
+
+ALTER TABLE communications.message ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+
+CREATE INDEX IF NOT EXISTS message_created_at_idx ON communications.message (created_at);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS communications.message_search_idx;
+
+ALTER TABLE communications.message DROP COLUMN IF EXISTS search;
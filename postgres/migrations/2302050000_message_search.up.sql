@@ -0,0 +1,4 @@
+ALTER TABLE communications.message ADD COLUMN IF NOT EXISTS search TSVECTOR
+	GENERATED ALWAYS AS (to_tsvector('english', content)) STORED;
+
+CREATE INDEX IF NOT EXISTS message_search_idx ON communications.message USING GIN (search);
@@ -0,0 +1,3 @@
+ALTER TABLE communications.message DROP COLUMN IF EXISTS edited_at;
+
+ALTER TABLE communications.message DROP COLUMN IF EXISTS sender;
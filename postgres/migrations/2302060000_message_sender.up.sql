@@ -0,0 +1,3 @@
+ALTER TABLE communications.message ADD COLUMN IF NOT EXISTS sender TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE communications.message ADD COLUMN IF NOT EXISTS edited_at TIMESTAMPTZ;
@@ -0,0 +1,10 @@
+// Package migrations embeds the schema migrations of the postgres backend.
+//
+// Files are named <version>_<name>.up.sql and <version>_<name>.down.sql,
+// versions are timestamps formatted as YYMMDDhhmm.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS
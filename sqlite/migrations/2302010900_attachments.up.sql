@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS "attachments" (
+    id BLOB,
+    chat_id BLOB NOT NULL REFERENCES chats(id),
+    name TEXT NOT NULL,
+    mime_type TEXT NOT NULL,
+    size INTEGER NOT NULL,
+    hash TEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (id)
+);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS messages_chat_id_idx;
+
+ALTER TABLE "chats" DROP COLUMN created_at;
@@ -0,0 +1,3 @@
+ALTER TABLE "chats" ADD COLUMN created_at DATETIME NOT NULL DEFAULT '1970-01-01 00:00:00';
+
+CREATE INDEX IF NOT EXISTS messages_chat_id_idx ON "messages" (chat_id, id);
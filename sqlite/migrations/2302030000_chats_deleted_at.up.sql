@@ -0,0 +1,3 @@
+ALTER TABLE "chats" ADD COLUMN deleted_at DATETIME;
+
+CREATE INDEX IF NOT EXISTS chats_deleted_at_idx ON "chats" (deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS messages_created_at_idx;
+
+ALTER TABLE "messages" DROP COLUMN created_at;
+
+ALTER TABLE "chats" DROP COLUMN message_retention;
@@ -0,0 +1,8 @@
+ALTER TABLE "chats" ADD COLUMN message_retention INTEGER NOT NULL DEFAULT 0;
+
+-- existing messages are taken to be created now
+ALTER TABLE "messages" ADD COLUMN created_at DATETIME;
+
+UPDATE "messages" SET created_at = strftime('%Y-%m-%d %H:%M:%S+00:00', 'now');
+
+CREATE INDEX IF NOT EXISTS messages_created_at_idx ON "messages" (created_at);
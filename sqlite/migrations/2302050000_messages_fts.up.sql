@@ -0,0 +1,22 @@
+-- needs a build of sqlite with FTS5, see the sqlite_fts5 build tag
+CREATE VIRTUAL TABLE IF NOT EXISTS "messages_fts" USING fts5(
+    content,
+    content='messages',
+    content_rowid='id',
+    tokenize='porter unicode61'
+);
+
+INSERT INTO "messages_fts" ("messages_fts") VALUES ('rebuild');
+
+CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON "messages" BEGIN
+    INSERT INTO "messages_fts" (rowid, content) VALUES (new.id, new.content);
+END;
+
+CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON "messages" BEGIN
+    INSERT INTO "messages_fts" ("messages_fts", rowid, content) VALUES ('delete', old.id, old.content);
+END;
+
+CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE ON "messages" BEGIN
+    INSERT INTO "messages_fts" ("messages_fts", rowid, content) VALUES ('delete', old.id, old.content);
+    INSERT INTO "messages_fts" (rowid, content) VALUES (new.id, new.content);
+END;
@@ -0,0 +1,3 @@
+ALTER TABLE "messages" ADD COLUMN sender TEXT NOT NULL DEFAULT '';
+
+ALTER TABLE "messages" ADD COLUMN edited_at DATETIME;